@@ -1,21 +1,65 @@
 package main
 
+import (
+	"strings"
+	"time"
+)
+
 // Config holds the configuration values for the agent.
 // These settings can be configured via environment variables or command-line flags.
 type Config struct {
+	// Aggregation specifies per-metric aggregation of gauges collected between reports.
+	// Format: "name=func[,func];..." (e.g., "Alloc=max,mean;HeapInuse=min").
+	Aggregation string `env:"AGGREGATION"`
+
+	// AggregationSuffix determines whether the aggregation name is appended to reported gauge names.
+	AggregationSuffix bool `env:"AGGREGATION_SUFFIX"`
+
 	// BatchMode determines whether metrics are sent in batch or individually.
 	BatchMode bool `env:"BATCH_MODE"`
 
+	// BreakerThreshold specifies the number of consecutive failed requests that opens
+	// the circuit breaker of a server.
+	BreakerThreshold int `env:"BREAKER_THRESHOLD"`
+
+	// BreakerTimeout specifies how long the circuit breaker stays open before a probe request
+	// is allowed (e.g., "30s").
+	BreakerTimeout time.Duration `env:"BREAKER_TIMEOUT"`
+
+	// DefaultAggregation specifies the aggregation for gauges without a rule in Aggregation.
+	// Supported values: last, min, max, mean, sum, count.
+	DefaultAggregation string `env:"DEFAULT_AGGREGATION"`
+
 	// PollInterval specifies the interval in seconds for polling system metrics.
 	PollInterval int `env:"POLL_INTERVAL"`
 
+	// RateLimit specifies the maximum number of concurrent requests to the server.
+	RateLimit int `env:"RATE_LIMIT"`
+
 	// ReportInterval specifies the interval in seconds for reporting metrics to the server.
 	ReportInterval int `env:"REPORT_INTERVAL"`
 
-	// ServerAddress specifies the address of the metrics server.
-	// Format: "host:port" (e.g., "localhost:8080").
+	// RequestTimeout specifies how long a request to a server may take (e.g., "10s").
+	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT"`
+
+	// RetryBaseWait specifies the base of the full-jitter exponential backoff between retries (e.g., "1s").
+	RetryBaseWait time.Duration `env:"RETRY_BASE_WAIT"`
+
+	// RetryCount specifies the number of retries of a failed request.
+	RetryCount int `env:"RETRY_COUNT"`
+
+	// RetryMaxWait caps the backoff between retries and the wait requested by the
+	// Retry-After header of the server (e.g., "5s").
+	RetryMaxWait time.Duration `env:"RETRY_MAX_WAIT"`
+
+	// ServerAddress specifies the addresses of the metrics servers as a comma-separated list.
+	// Format: "host:port[,host:port...]" (e.g., "localhost:8080,localhost:8081").
 	ServerAddress string `env:"ADDRESS"`
 
+	// ServerMode specifies how multiple servers are used: "failover" sends to the first
+	// healthy server, "fanout" sends to all servers.
+	ServerMode string `env:"SERVER_MODE"`
+
 	// UseHTTPS determines whether to use HTTPS for communication with the server.
 	UseHTTPS bool `env:"USE_HTTPS"`
 }
@@ -25,11 +69,27 @@ func NewConfig() *Config {
 	return &Config{}
 }
 
-// GetServerURL constructs the server URL based on the configuration.
-func (c Config) GetServerURL() string {
+// GetServerAddresses returns the list of server addresses from the configuration.
+func (c Config) GetServerAddresses() []string {
+	var addresses []string
+	for _, addr := range strings.Split(c.ServerAddress, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+// GetServerURLs constructs the server URLs based on the configuration.
+func (c Config) GetServerURLs() []string {
 	proto := "http://"
 	if c.UseHTTPS {
 		proto = "https://"
 	}
-	return proto + c.ServerAddress
+	addresses := c.GetServerAddresses()
+	urls := make([]string, len(addresses))
+	for i, addr := range addresses {
+		urls[i] = proto + addr
+	}
+	return urls
 }
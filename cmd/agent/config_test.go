@@ -5,7 +5,7 @@ import (
 	"testing"
 )
 
-func TestConfig_GetServerURL(t *testing.T) {
+func TestConfig_GetServerURLs(t *testing.T) {
 	type fields struct {
 		BatchMode      bool
 		PollInterval   int
@@ -16,7 +16,7 @@ func TestConfig_GetServerURL(t *testing.T) {
 	tests := []struct {
 		name   string
 		fields fields
-		want   string
+		want   []string
 	}{
 		{
 			name: "HTTP URL",
@@ -24,7 +24,7 @@ func TestConfig_GetServerURL(t *testing.T) {
 				ServerAddress: "localhost:8080",
 				UseHTTPS:      false,
 			},
-			want: "http://localhost:8080",
+			want: []string{"http://localhost:8080"},
 		},
 		{
 			name: "HTTPS URL",
@@ -32,7 +32,14 @@ func TestConfig_GetServerURL(t *testing.T) {
 				ServerAddress: "localhost:8080",
 				UseHTTPS:      true,
 			},
-			want: "https://localhost:8080",
+			want: []string{"https://localhost:8080"},
+		},
+		{
+			name: "multiple servers",
+			fields: fields{
+				ServerAddress: "localhost:8080, localhost:8081,",
+			},
+			want: []string{"http://localhost:8080", "http://localhost:8081"},
 		},
 	}
 	for _, tt := range tests {
@@ -44,8 +51,8 @@ func TestConfig_GetServerURL(t *testing.T) {
 				ServerAddress:  tt.fields.ServerAddress,
 				UseHTTPS:       tt.fields.UseHTTPS,
 			}
-			if got := c.GetServerURL(); got != tt.want {
-				t.Errorf("GetServerURL() = %v, want %v", got, tt.want)
+			if got := c.GetServerURLs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetServerURLs() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -7,7 +7,6 @@ package main
 
 import (
 	"fmt"
-	"sync"
 
 	"go.uber.org/zap"
 
@@ -20,8 +19,6 @@ var (
 	buildCommit  = "N/A"
 )
 
-var wg sync.WaitGroup
-
 func main() {
 	logger.InitLogger()
 	defer func(Sugar *zap.SugaredLogger) {
@@ -38,6 +35,4 @@ func main() {
 	if err := Execute(); err != nil {
 		logger.Sugar.Fatalf("error starting agent: %v", err)
 	}
-
-	wg.Wait()
 }
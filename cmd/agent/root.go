@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v10"
@@ -17,17 +21,25 @@ import (
 )
 
 const (
-	defaultServerAddress  = "localhost:8080"
-	defaultPollInterval   = 2
-	defaultReportInterval = 10
-	defaultBatchMode      = true
+	defaultServerAddress    = "localhost:8080"
+	defaultPollInterval     = 2
+	defaultReportInterval   = 10
+	defaultBatchMode        = true
+	defaultRateLimit        = 1
+	defaultServerMode       = agentcore.ModeFailover
+	defaultAggregation      = "last"
+	defaultRetryCount       = 3
+	defaultRetryBaseWait    = 1 * time.Second
+	defaultRetryMaxWait     = 5 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerTimeout   = 30 * time.Second
+	defaultRequestTimeout   = 10 * time.Second
+	shutdownTimeout         = 5 * time.Second
 )
 
 var (
-	collectedMetrics []agentcore.MetricInterface
-	pollCount        int64
-	cfg              *Config
-	rootCmd          = &cobra.Command{
+	cfg     *Config
+	rootCmd = &cobra.Command{
 		Use:   "agent",
 		Short: "A simple agent for collecting and sending metrics",
 		Long:  `Metrics agent is a lightweight and easy-to-use solution for collecting and sending various metrics`,
@@ -35,50 +47,157 @@ var (
 	}
 )
 
+func collect(aggregator *agentcore.Aggregator, sender *agentcore.Sender) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	collected := agentcore.CollectMetrics(&m)
+	collected = append(collected, metrics.NewCounter("PollCount", 1))
+	collected = append(collected, sender.SelfMetrics()...)
+	if err := aggregator.Add(collected); err != nil {
+		logger.Sugar.Errorf("error aggregating metrics: %v", err)
+	}
+}
+
+func pollMetrics(ctx context.Context, interval time.Duration, aggregator *agentcore.Aggregator, sender *agentcore.Sender) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			collect(aggregator, sender)
+		}
+	}
+}
+
+// reportMetrics flushes the aggregated metrics to jobs on every tick. It returns
+// the batch it could not hand over before ctx was cancelled.
+func reportMetrics(ctx context.Context, interval time.Duration, aggregator *agentcore.Aggregator, jobs chan<- []agentcore.MetricInterface) []agentcore.MetricInterface {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			collected := aggregator.Flush()
+			if len(collected) == 0 {
+				continue
+			}
+			select {
+			case jobs <- collected:
+			case <-ctx.Done():
+				return collected
+			}
+		}
+	}
+}
+
 func runAgent(cmd *cobra.Command, args []string) {
-	wg.Add(1)
 	if err := env.Parse(cfg); err != nil {
 		logger.Sugar.Fatalf("error to parse environment variables: %v", err)
 	}
-	if err := validateAddress(cfg.ServerAddress); err != nil {
-		logger.Sugar.Fatalf("invalid address format: %v", err)
+	for _, addr := range cfg.GetServerAddresses() {
+		if err := validateAddress(addr); err != nil {
+			logger.Sugar.Fatalf("invalid address format: %v", err)
+		}
+	}
+	if cfg.RateLimit < 1 {
+		logger.Sugar.Fatalf("invalid rate limit: must be greater than 0")
+	}
+	if cfg.PollInterval < 1 || cfg.ReportInterval < 1 {
+		logger.Sugar.Fatalf("invalid intervals: poll and report intervals must be greater than 0")
+	}
+	aggregation, err := agentcore.ParseAggregation(cfg.DefaultAggregation)
+	if err != nil {
+		logger.Sugar.Fatalf("invalid default aggregation: %v", err)
+	}
+	aggregationRules, err := agentcore.ParseAggregationRules(cfg.Aggregation)
+	if err != nil {
+		logger.Sugar.Fatalf("invalid aggregation rules: %v", err)
 	}
 
-	serverURL := cfg.GetServerURL()
-	pollInterval := time.Duration(cfg.PollInterval) * time.Second
-	reportInterval := time.Duration(cfg.ReportInterval) * time.Second
-	lastPollTime, lastReportTime := time.Now(), time.Now()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+
+	aggregator := agentcore.NewAggregator(aggregation, aggregationRules, cfg.AggregationSuffix)
+	jobs := make(chan []agentcore.MetricInterface, cfg.RateLimit)
+	sender, err := agentcore.NewSender(agentcore.SenderConfig{
+		ServerURLs:       cfg.GetServerURLs(),
+		Mode:             cfg.ServerMode,
+		RateLimit:        cfg.RateLimit,
+		BatchMode:        cfg.BatchMode,
+		RetryCount:       cfg.RetryCount,
+		RetryBaseWait:    cfg.RetryBaseWait,
+		RetryMaxWait:     cfg.RetryMaxWait,
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerTimeout:   cfg.BreakerTimeout,
+		RequestTimeout:   cfg.RequestTimeout,
+	})
+	if err != nil {
+		logger.Sugar.Fatalf("error initializing sender: %v", err)
+	}
+	senderDone := make(chan struct{})
+	go func() {
+		defer close(senderDone)
+		sender.Run(sendCtx, jobs)
+	}()
 
+	logger.Sugar.Infoln("starting agent")
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		logger.Sugar.Infoln("starting agent")
-		for {
-			now := time.Now()
-
-			if now.Sub(lastPollTime) >= pollInterval {
-				pollCount++
-				var m runtime.MemStats
-				runtime.ReadMemStats(&m)
-				collectedMetrics = agentcore.CollectMetrics(&m)
-				collectedMetrics = append(collectedMetrics, metrics.NewCounter("PollCount", pollCount))
-
-				lastPollTime = now
-			}
-
-			if now.Sub(lastReportTime) > reportInterval {
-				if !cfg.BatchMode {
-					agentcore.SendMetrics(collectedMetrics, serverURL)
-				} else {
-					agentcore.SendBatchMetrics(collectedMetrics, serverURL)
-				}
-				collectedMetrics = []agentcore.MetricInterface{}
+		pollMetrics(ctx, time.Duration(cfg.PollInterval)*time.Second, aggregator, sender)
+	}()
+	var pending []agentcore.MetricInterface
+	go func() {
+		defer wg.Done()
+		pending = reportMetrics(ctx, time.Duration(cfg.ReportInterval)*time.Second, aggregator, jobs)
+	}()
 
-				lastReportTime = now
-			}
+	<-ctx.Done()
+	wg.Wait()
+
+	logger.Sugar.Infoln("shutting down agent, flushing pending metrics")
+	deadline := time.After(shutdownTimeout)
+	collect(aggregator, sender)
+	flushed := handOver(jobs, deadline, pending, aggregator.Flush())
+	close(jobs)
+
+	if flushed {
+		select {
+		case <-senderDone:
+			logger.Sugar.Infoln("pending metrics flushed")
+			return
+		case <-deadline:
+		}
+	}
+	logger.Sugar.Errorf("flushing metrics timed out after %v", shutdownTimeout)
+	cancelSend()
+	<-senderDone
+}
 
-			time.Sleep(1 * time.Second)
+// handOver sends the non-empty batches to jobs. It reports false if the deadline
+// expires first, for example because the workers are stuck on an unresponsive server.
+func handOver(jobs chan<- []agentcore.MetricInterface, deadline <-chan time.Time, batches ...[]agentcore.MetricInterface) bool {
+	for _, batch := range batches {
+		if len(batch) == 0 {
+			continue
 		}
-	}()
+		select {
+		case jobs <- batch:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
 }
 
 func validateAddress(addr string) error {
@@ -109,8 +228,19 @@ func Execute() error {
 
 func init() {
 	cfg = NewConfig()
-	rootCmd.Flags().StringVarP(&cfg.ServerAddress, "address", "a", defaultServerAddress, "metrics server address in the format host:port")
+	rootCmd.Flags().StringVarP(&cfg.ServerAddress, "address", "a", defaultServerAddress, "comma-separated metrics server addresses in the format host:port")
+	rootCmd.Flags().StringVarP(&cfg.ServerMode, "server-mode", "m", defaultServerMode, "how to use multiple servers: failover or fanout")
 	rootCmd.Flags().IntVarP(&cfg.PollInterval, "poll-interval", "p", defaultPollInterval, "poll interval in seconds")
 	rootCmd.Flags().IntVarP(&cfg.ReportInterval, "report-interval", "r", defaultReportInterval, "report interval in seconds")
 	rootCmd.Flags().BoolVarP(&cfg.BatchMode, "batch-mode", "b", defaultBatchMode, "send batch of metrics")
+	rootCmd.Flags().StringVar(&cfg.Aggregation, "aggregation", "", "per-metric gauge aggregation between reports, e.g. \"Alloc=max,mean;HeapInuse=min\"")
+	rootCmd.Flags().StringVar(&cfg.DefaultAggregation, "default-aggregation", defaultAggregation, "gauge aggregation for metrics without a rule: last, min, max, mean, sum or count")
+	rootCmd.Flags().BoolVar(&cfg.AggregationSuffix, "aggregation-suffix", false, "append the aggregation name to reported gauge names")
+	rootCmd.Flags().IntVar(&cfg.RetryCount, "retry-count", defaultRetryCount, "number of retries of a failed request")
+	rootCmd.Flags().DurationVar(&cfg.RetryBaseWait, "retry-base-wait", defaultRetryBaseWait, "base of the exponential backoff between retries")
+	rootCmd.Flags().DurationVar(&cfg.RetryMaxWait, "retry-max-wait", defaultRetryMaxWait, "maximum wait between retries, also capping the Retry-After of the server")
+	rootCmd.Flags().IntVar(&cfg.BreakerThreshold, "breaker-threshold", defaultBreakerThreshold, "consecutive failures that open the circuit breaker of a server")
+	rootCmd.Flags().DurationVar(&cfg.BreakerTimeout, "breaker-timeout", defaultBreakerTimeout, "time the circuit breaker stays open before a probe request")
+	rootCmd.Flags().DurationVar(&cfg.RequestTimeout, "request-timeout", defaultRequestTimeout, "maximum duration of a request to a server")
+	rootCmd.Flags().IntVarP(&cfg.RateLimit, "rate-limit", "l", defaultRateLimit, "maximum number of concurrent requests to the server")
 }
@@ -1,6 +1,22 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/agentcore"
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
 
 func Test_validateAddress(t *testing.T) {
 	type args struct {
@@ -50,3 +66,86 @@ func Test_validateAddress(t *testing.T) {
 		})
 	}
 }
+
+func Test_collect(t *testing.T) {
+	aggregator := agentcore.NewAggregator(agentcore.AggregationLast, nil, false)
+	sender, err := agentcore.NewSender(agentcore.SenderConfig{ServerURLs: []string{"http://localhost:8080"}})
+	require.NoError(t, err)
+	assert.Empty(t, aggregator.Flush())
+
+	collect(aggregator, sender)
+	collect(aggregator, sender)
+	collected := aggregator.Flush()
+	assert.Len(t, collected, 29)
+	assert.Contains(t, collected, metrics.NewCounter("PollCount", 2))
+	assert.Empty(t, aggregator.Flush())
+}
+
+func Test_reportMetrics(t *testing.T) {
+	aggregator := agentcore.NewAggregator(agentcore.AggregationLast, nil, false)
+	sender, err := agentcore.NewSender(agentcore.SenderConfig{ServerURLs: []string{"http://localhost:8080"}})
+	require.NoError(t, err)
+	collect(aggregator, sender)
+	jobs := make(chan []agentcore.MetricInterface, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reportMetrics(ctx, 10*time.Millisecond, aggregator, jobs)
+	}()
+
+	select {
+	case batch := <-jobs:
+		assert.Len(t, batch, 29)
+	case <-time.After(time.Second):
+		t.Fatal("metrics were not reported")
+	}
+	cancel()
+	<-done
+}
+
+func Test_handOver(t *testing.T) {
+	batch := []agentcore.MetricInterface{metrics.NewCounter("PollCount", 1)}
+	jobs := make(chan []agentcore.MetricInterface, 1)
+
+	assert.True(t, handOver(jobs, nil, nil, batch))
+	assert.Len(t, jobs, 1)
+
+	// the workers do not take the next batch, so the deadline ends the hand-over
+	deadline := make(chan time.Time, 1)
+	deadline <- time.Now()
+	assert.False(t, handOver(jobs, deadline, batch))
+	assert.Len(t, jobs, 1)
+}
+
+func Test_runAgent(t *testing.T) {
+	logger.InitLogger()
+
+	var received int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	cfg = &Config{
+		BatchMode:          true,
+		PollInterval:       1,
+		ReportInterval:     10,
+		RateLimit:          1,
+		DefaultAggregation: "last",
+		ServerAddress:      strings.TrimPrefix(mockServer.URL, "http://"),
+	}
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+			logger.Sugar.Errorf("error sending SIGTERM signal: %v", err)
+		}
+	}()
+
+	runAgent(rootCmd, []string{})
+	// the report interval has not elapsed, so only the final flush reaches the server
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
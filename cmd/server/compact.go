@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+const defaultCompactTimeout = 5 * time.Second
+
+var (
+	compactTimeout time.Duration
+	compactCmd     = &cobra.Command{
+		Use:   "compact PATH",
+		Short: "Compact the file of the bolt storage",
+		Long: `Compact rewrites the bolt storage file without its free pages.
+The server using the file must be stopped.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runCompact,
+	}
+)
+
+func runCompact(cmd *cobra.Command, args []string) error {
+	before, after, err := storage.CompactBolt(args[0], compactTimeout)
+	if err != nil {
+		return fmt.Errorf("error compacting %s: %w", args[0], err)
+	}
+	logger.Sugar.Infof("compacted %s from %d to %d bytes", args[0], before, after)
+	return nil
+}
+
+func init() {
+	compactCmd.Flags().DurationVar(&compactTimeout, "timeout", defaultCompactTimeout, "how long to wait for the file lock held by another process")
+	rootCmd.AddCommand(compactCmd)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+func Test_runCompact(t *testing.T) {
+	logger.InitLogger()
+	path := filepath.Join(t.TempDir(), "metrics.bolt")
+	s, err := storage.NewBoltStorage(path, time.Second, storage.KeyModeTyped)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	compactTimeout = time.Second
+	assert.NoError(t, runCompact(compactCmd, []string{path}))
+	assert.Error(t, runCompact(compactCmd, []string{filepath.Join(t.TempDir(), "missing.bolt")}))
+}
@@ -1,18 +1,39 @@
 // Package main provides the entry point for the metrics server application.
 // This server collects, processes, and stores various metrics, offering multiple
 // endpoints to interact with the metrics data.
-// The server supports in-memory storage, file-based storage, and database storage
-// for metrics. Configuration options are available via environment variables or
-// command-line flags, allowing flexibility in deployment.
+// The server supports in-memory storage, file-based storage, embedded SQLite and
+// bolt storage, and database storage for metrics. The compact command compacts the
+// file of the bolt storage and the migrate command manages the database schema.
+// Configuration options are available via environment variables or command-line
+// flags, allowing flexibility in deployment.
+// GET /stream streams the metrics as Server-Sent Events or over a WebSocket when
+// WATCH_BUFFER is set.
+// GET /ping responds with 200 while the storage is available and with 200 and the
+// X-Storage-Status header set to "degraded" instead of "ok" while writes are journaled.
+// POST /updates/ reports the result of every metric of a batch, with 207 if only a
+// part of it is written, and, with atomic=true, applies the batch all or nothing.
 // The server also includes optional pprof support for profiling.
 
 // Configuration settings:
 // - ADDRESS: Bind address for the server in the format host:port (e.g., "localhost:8080").
+// - AUTO_MIGRATE: Apply the pending database migrations at startup instead of refusing an outdated schema.
 // - DATABASE_DSN: Data Source Name for connecting to a database.
 // - ENABLE_PPROF: Enable pprof for profiling if set to true (pprof will be available on localhost:6060).
 // - FILE_STORAGE_PATH: Path to the file used for file-based storage of metrics.
+// - JOURNAL_SIZE: Number of metrics journaled in memory while the storage is unavailable (0 to disable).
+// - KEY_MODE: How metrics of different types sharing a name are stored ("typed" or "strict").
+// - MAX_IN_FLIGHT: Maximum number of concurrently processed write requests (100 by default, 0 to disable).
+// - MAX_QUEUE_WAIT: Maximum time a write request waits for admission before it is rejected with 429.
 // - RESTORE: Whether to restore previously saved metrics from the file.
+// - SELF_METRICS: Whether to store the metrics of the server, such as AdmissionInFlight, with the reported metrics.
+// - STORAGE: URL of the storage backend (memory://, memory://?shards=32, file:///path?interval=300&restore=true&wal=true&keep=3&compress=true, sqlite:///path, bolt:///path, postgres://...?retry_backoff=100ms,300ms,1s&cache=false, tiered+postgres://...?interval=1s&max_lag=30s),
+//   overrides DATABASE_DSN, FILE_STORAGE_PATH, RESTORE and STORE_INTERVAL.
 // - STORE_INTERVAL: Interval in seconds for periodically saving metrics to the file (0 to disable).
+// - WATCH_BUFFER: Number of metric change events buffered per subscriber of GET /stream (0, the default, disables the stream;
+//   while there are subscribers, the writes of a metric are serialized and every written metric is read twice).
+// - WRITE_BEHIND_INTERVAL: Interval of flushing writes buffered in memory to the storage (0 to write through).
+// - WRITE_BEHIND_SIZE: Number of buffered metrics that triggers an early flush.
+// - WRITE_BEHIND_LIMIT: Number of buffered metrics past which the writes of new metrics fail (0 for 100 times the size).
 
 package main
 
@@ -34,7 +55,9 @@ var (
 	buildCommit  = "N/A"
 )
 
-func MetricsRouter(s storage.Storage) chi.Router {
+// MetricsRouter returns the router of the server. If ac is not nil, it applies
+// admission control to the write routes.
+func MetricsRouter(s storage.Storage, ac *handlers.AdmissionController) chi.Router {
 	r := chi.NewRouter()
 	r.Use(middleware.Compress(5))
 	r.Get("/", handlers.GetAllMetrics(s))
@@ -42,12 +65,18 @@ func MetricsRouter(s storage.Storage) chi.Router {
 		r.Post("/", handlers.GetMetricsJSON(s))
 		r.Get("/{type}/{name}", handlers.GetMetricsPlain(s))
 	})
-	r.Route("/update", func(r chi.Router) {
-		r.Post("/", handlers.UpdateMetricsJSON(s))
-		r.Post("/{type}/{name}/{value}", handlers.UpdateMetricsPlain(s))
-	})
 	r.Get("/ping", handlers.Ping(s))
-	r.Post("/updates/", handlers.UpdateMetricsCollection(s))
+	r.Get("/stream", handlers.Stream(s))
+	r.Group(func(r chi.Router) {
+		if ac != nil {
+			r.Use(ac.Middleware)
+		}
+		r.Route("/update", func(r chi.Router) {
+			r.Post("/", handlers.UpdateMetricsJSON(s))
+			r.Post("/{type}/{name}/{value}", handlers.UpdateMetricsPlain(s))
+		})
+		r.Post("/updates/", handlers.UpdateMetricsCollection(s))
+	})
 	return r
 }
 
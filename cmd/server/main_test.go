@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+func TestMetricsRouter_Stream(t *testing.T) {
+	logger.InitLogger()
+	s := storage.NewWatchableStorage(storage.NewMemStorage(), 0)
+	defer s.Close()
+	// the stream passes through the compression and logging middlewares
+	ts := httptest.NewServer(logger.WithLogging(MetricsRouter(s, nil)))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/stream", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: snapshot\n", line)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/stream", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"event":"snapshot","metrics":[]}`, string(message))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+var (
+	migrateDSN string
+	migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Manage the schema of the database storage",
+		Long: `Migrate applies and reverts the migrations embedded in the server.
+The database is selected by --database-dsn or DATABASE_DSN, the environment takes precedence.`,
+	}
+	migrateUpCmd = &cobra.Command{
+		Use:   "up",
+		Short: "Apply all pending migrations",
+		Args:  cobra.NoArgs,
+		RunE:  runMigrateUp,
+	}
+	migrateDownCmd = &cobra.Command{
+		Use:   "down [N]",
+		Short: "Revert the last N migrations, one by default",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runMigrateDown,
+	}
+	migrateStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the schema version and the pending migrations",
+		Args:  cobra.NoArgs,
+		RunE:  runMigrateStatus,
+	}
+	migrateForceCmd = &cobra.Command{
+		Use:   "force VERSION",
+		Short: "Set the schema version without running migrations",
+		Long: `Force sets the schema version and clears the dirty flag left by a failed migration.
+Fix the schema by hand first. A version of -1 marks the schema as having no migrations.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runMigrateForce,
+	}
+)
+
+// migrationDSN returns the connection string of the database to migrate.
+func migrationDSN() (string, error) {
+	dsn := migrateDSN
+	if value, ok := os.LookupEnv("DATABASE_DSN"); ok {
+		dsn = value
+	}
+	if dsn == "" {
+		return "", errors.New("database is not set, use --database-dsn or DATABASE_DSN")
+	}
+	return dsn, nil
+}
+
+// withMigrator runs fn with a migrator connected to the database.
+func withMigrator(fn func(m *storage.Migrator) error) error {
+	dsn, err := migrationDSN()
+	if err != nil {
+		return err
+	}
+	m, err := storage.NewMigrator(dsn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.Close(); err != nil {
+			logger.Sugar.Errorf("error closing migrator: %v", err)
+		}
+	}()
+	return fn(m)
+}
+
+func runMigrateUp(cmd *cobra.Command, args []string) error {
+	return withMigrator(func(m *storage.Migrator) error {
+		if err := m.Up(); err != nil {
+			return fmt.Errorf("error applying migrations: %w", err)
+		}
+		return printMigrationStatus(cmd, m)
+	})
+}
+
+func runMigrateDown(cmd *cobra.Command, args []string) error {
+	steps := 1
+	if len(args) == 1 {
+		var err error
+		if steps, err = strconv.Atoi(args[0]); err != nil || steps < 1 {
+			return fmt.Errorf("invalid number of migrations %q: must be a positive number", args[0])
+		}
+	}
+	return withMigrator(func(m *storage.Migrator) error {
+		if err := m.Down(steps); err != nil {
+			return fmt.Errorf("error reverting migrations: %w", err)
+		}
+		return printMigrationStatus(cmd, m)
+	})
+}
+
+func runMigrateStatus(cmd *cobra.Command, args []string) error {
+	return withMigrator(func(m *storage.Migrator) error {
+		return printMigrationStatus(cmd, m)
+	})
+}
+
+func runMigrateForce(cmd *cobra.Command, args []string) error {
+	version, err := strconv.Atoi(args[0])
+	if err != nil || version < -1 {
+		return fmt.Errorf("invalid version %q", args[0])
+	}
+	return withMigrator(func(m *storage.Migrator) error {
+		if err := m.Force(version); err != nil {
+			return fmt.Errorf("error forcing version %d: %w", version, err)
+		}
+		return printMigrationStatus(cmd, m)
+	})
+}
+
+func printMigrationStatus(cmd *cobra.Command, m *storage.Migrator) error {
+	status, err := m.Status()
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), formatMigrationStatus(status))
+	return nil
+}
+
+// formatMigrationStatus describes the status for the migrate commands.
+func formatMigrationStatus(status storage.MigrationStatus) string {
+	description := fmt.Sprintf("schema version %d, latest %d", status.Version, status.Latest)
+	switch {
+	case status.Dirty:
+		return description + ", dirty: fix the schema and run migrate force"
+	case status.Version < status.Latest:
+		return description + fmt.Sprintf(", %d pending", status.Latest-status.Version)
+	case status.Version > status.Latest:
+		return description + ", newer than the server"
+	}
+	return description + ", up to date"
+}
+
+func init() {
+	migrateCmd.PersistentFlags().StringVarP(&migrateDSN, "database-dsn", "d", "", "database connection string")
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateStatusCmd, migrateForceCmd)
+	rootCmd.AddCommand(migrateCmd)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+func Test_migrationDSN(t *testing.T) {
+	migrateDSN = ""
+	_, err := migrationDSN()
+	assert.Error(t, err)
+
+	migrateDSN = "postgres://flag/metrics"
+	dsn, err := migrationDSN()
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres://flag/metrics", dsn)
+
+	t.Setenv("DATABASE_DSN", "postgres://env/metrics")
+	dsn, err = migrationDSN()
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres://env/metrics", dsn)
+	migrateDSN = ""
+}
+
+func Test_formatMigrationStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status storage.MigrationStatus
+		want   string
+	}{
+		{name: "up to date", status: storage.MigrationStatus{Version: 1, Latest: 1}, want: "schema version 1, latest 1, up to date"},
+		{name: "pending", status: storage.MigrationStatus{Latest: 2}, want: "schema version 0, latest 2, 2 pending"},
+		{name: "newer", status: storage.MigrationStatus{Version: 3, Latest: 2}, want: "schema version 3, latest 2, newer than the server"},
+		{name: "dirty", status: storage.MigrationStatus{Version: 2, Dirty: true, Latest: 2}, want: "schema version 2, latest 2, dirty: fix the schema and run migrate force"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, formatMigrationStatus(tt.status))
+		})
+	}
+}
+
+func Test_migrateArgs(t *testing.T) {
+	migrateDSN = ""
+	assert.ErrorContains(t, runMigrateDown(migrateDownCmd, []string{"0"}), "invalid number of migrations")
+	assert.ErrorContains(t, runMigrateForce(migrateForceCmd, []string{"v1"}), "invalid version")
+	assert.ErrorContains(t, runMigrateStatus(migrateStatusCmd, nil), "database is not set")
+}
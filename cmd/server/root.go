@@ -6,15 +6,18 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/spf13/cobra"
 
+	"github.com/evgfitil/go-metrics-server.git/internal/handlers"
 	"github.com/evgfitil/go-metrics-server.git/internal/logger"
 	"github.com/evgfitil/go-metrics-server.git/internal/storage"
 )
@@ -24,6 +27,10 @@ const (
 	defaultStoreInterval   = 300
 	defaultFileStoragePath = "/tmp/metrics-db.json"
 	defaultRestore         = true
+	defaultKeyMode         = string(storage.KeyModeTyped)
+	defaultMaxInFlight     = 100
+	defaultMaxQueueWait    = 500 * time.Millisecond
+	defaultWriteBehindSize = 1000
 )
 
 var (
@@ -36,32 +43,70 @@ var (
 	}
 )
 
-func initStorage() (storage.Storage, error) {
+// storageURL returns the URL of the storage backend. The storage flag takes precedence
+// over its compatibility aliases: a database DSN is preferred to a file path, and
+// an empty file path selects the in-memory storage.
+func storageURL() (*url.URL, error) {
 	switch {
-	case cfg.FileStoragePath == "":
-		logger.Sugar.Infoln("initializing in-memory storage")
-		return storage.NewMemStorage(), nil
+	case cfg.Storage != "":
+		return url.Parse(cfg.Storage)
 	case cfg.DatabaseDSN != "":
-		logger.Sugar.Infoln("initializing db storage")
-		return storage.NewDBStorage(cfg.DatabaseDSN)
+		return url.Parse(cfg.DatabaseDSN)
+	case cfg.FileStoragePath != "":
+		query := url.Values{}
+		query.Set("interval", strconv.Itoa(cfg.StoreInterval))
+		query.Set("restore", strconv.FormatBool(cfg.Restore))
+		return &url.URL{Scheme: "file", Path: cfg.FileStoragePath, RawQuery: query.Encode()}, nil
 	}
-	logger.Sugar.Infoln("initializing filestorage")
-	s, err := storage.NewFileStorage(cfg.FileStoragePath, cfg.StoreInterval)
+	return &url.URL{Scheme: "memory"}, nil
+}
+
+// initStorage opens the storage backend, wrapped with a journal for the time it is
+// unavailable if the journal size is set and with a write buffer if the write-behind
+// interval is set.
+func initStorage() (storage.Storage, error) {
+	keyMode, err := storage.ParseKeyMode(cfg.KeyMode)
 	if err != nil {
 		return nil, err
 	}
+	opts := storage.Options{KeyMode: keyMode, AutoMigrate: cfg.AutoMigrate}
+	s, err := openStorage(opts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.JournalSize > 0 {
+		logger.Sugar.Infof("journaling up to %d metrics while the storage is unavailable", cfg.JournalSize)
+		s = storage.NewResilientStorage(s, cfg.JournalSize, 0)
+	}
+	if cfg.WriteBehindInterval > 0 {
+		logger.Sugar.Infof("buffering writes for %s", cfg.WriteBehindInterval)
+		s = storage.NewWriteBehindStorage(s, cfg.WriteBehindInterval, cfg.WriteBehindSize, cfg.WriteBehindLimit, keyMode)
+	}
+	if cfg.WatchBuffer > 0 {
+		s = storage.NewWatchableStorage(s, cfg.WatchBuffer)
+	}
+	return s, nil
+}
 
-	if cfg.Restore {
-		logger.Sugar.Infoln("starting restore metrics")
-		err = s.LoadMetrics()
+// openStorage opens the storage backend selected by the configuration.
+func openStorage(opts storage.Options) (storage.Storage, error) {
+	if cfg.Storage == "" && cfg.DatabaseDSN != "" && !strings.Contains(cfg.DatabaseDSN, "://") {
+		// a key/value connection string has no scheme to select the backend by
+		logger.Sugar.Infoln("initializing db storage")
+		db, err := storage.NewDBStorage(cfg.DatabaseDSN, opts)
 		if err != nil {
-			logger.Sugar.Errorf("error loading metrics: %v", err)
+			return nil, err
 		}
+		db.EnableCache()
+		return db, nil
 	}
-	if cfg.StoreInterval > 0 {
-		s.AsyncSave()
+
+	u, err := storageURL()
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URL: %w", err)
 	}
-	return s, nil
+	logger.Sugar.Infof("initializing %s storage", u.Scheme)
+	return storage.OpenURL(u, opts)
 }
 
 func runServer(cmd *cobra.Command, args []string) {
@@ -81,6 +126,19 @@ func runServer(cmd *cobra.Command, args []string) {
 		}
 	}()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ac *handlers.AdmissionController
+	if cfg.MaxInFlight > 0 {
+		ac = handlers.NewAdmissionController(cfg.MaxInFlight, cfg.MaxQueueWait)
+	}
+	if cfg.SelfMetrics {
+		if sources := selfMetricsSources(s, ac); len(sources) > 0 {
+			go reportSelfMetrics(ctx, s, selfMetricsInterval, sources...)
+		}
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	if cfg.EnablePprof {
@@ -91,7 +149,7 @@ func runServer(cmd *cobra.Command, args []string) {
 	}
 	go func() {
 		logger.Sugar.Infoln("starting server")
-		err := http.ListenAndServe(cfg.BindAddress, logger.WithLogging(MetricsRouter(s)))
+		err := http.ListenAndServe(cfg.BindAddress, logger.WithLogging(MetricsRouter(s, ac)))
 		if err != nil {
 			logger.Sugar.Fatalf("error starting server: %v", err)
 		}
@@ -132,10 +190,21 @@ func Execute() error {
 
 func init() {
 	cfg = NewConfig()
+	rootCmd.Flags().StringVar(&cfg.Storage, "storage", "", "storage URL: memory://, file:///path?interval=300&restore=true, sqlite:///path, bolt:///path?timeout=1s, postgres://...?retry_backoff=100ms,300ms,1s&cache=false or tiered+postgres://...?interval=1s&max_lag=30s; overrides the file and database flags")
+	rootCmd.Flags().BoolVar(&cfg.AutoMigrate, "auto-migrate", false, "apply the pending database migrations at startup instead of refusing an outdated schema")
 	rootCmd.Flags().StringVarP(&cfg.BindAddress, "address", "a", defaultBindAddress, "bind address for the server in the format host:port")
-	rootCmd.Flags().IntVarP(&cfg.StoreInterval, "store-interval", "i", defaultStoreInterval, "interval in seconds for storage data to a file")
-	rootCmd.Flags().StringVarP(&cfg.FileStoragePath, "file-storage-path", "f", defaultFileStoragePath, "file path where the server writes its data")
-	rootCmd.Flags().BoolVarP(&cfg.Restore, "restore", "r", defaultRestore, "loading previously saved data from a file at startup")
-	rootCmd.Flags().StringVarP(&cfg.DatabaseDSN, "database-dsn", "d", "", "database connection string")
+	rootCmd.Flags().IntVarP(&cfg.StoreInterval, "store-interval", "i", defaultStoreInterval, "interval in seconds for storage data to a file (alias for the interval option of --storage)")
+	rootCmd.Flags().StringVarP(&cfg.FileStoragePath, "file-storage-path", "f", defaultFileStoragePath, "file path where the server writes its data (alias for --storage file://...)")
+	rootCmd.Flags().BoolVarP(&cfg.Restore, "restore", "r", defaultRestore, "loading previously saved data from a file at startup (alias for the restore option of --storage)")
+	rootCmd.Flags().StringVarP(&cfg.DatabaseDSN, "database-dsn", "d", "", "database connection string (alias for --storage postgres://...)")
 	rootCmd.Flags().BoolVarP(&cfg.EnablePprof, "enable-pprof", "p", false, "enable pprof mode")
+	rootCmd.Flags().IntVar(&cfg.JournalSize, "journal-size", 0, "number of metrics journaled in memory while the storage is unavailable, 0 disables the journal")
+	rootCmd.Flags().StringVar(&cfg.KeyMode, "key-mode", defaultKeyMode, "how metrics of different types sharing a name are stored: typed or strict")
+	rootCmd.Flags().IntVar(&cfg.MaxInFlight, "max-in-flight", defaultMaxInFlight, "maximum number of concurrently processed write requests, limited by default, 0 disables the limit")
+	rootCmd.Flags().DurationVar(&cfg.MaxQueueWait, "max-queue-wait", defaultMaxQueueWait, "maximum time a write request waits for admission")
+	rootCmd.Flags().BoolVar(&cfg.SelfMetrics, "self-metrics", false, "store the metrics of the server, such as AdmissionInFlight, with the reported metrics every 10s")
+	rootCmd.Flags().IntVar(&cfg.WatchBuffer, "watch-buffer", 0, "number of metric change events buffered per subscriber of /stream, 0 disables the stream; while there are subscribers, the writes of a metric are serialized and every written metric is read twice")
+	rootCmd.Flags().DurationVar(&cfg.WriteBehindInterval, "write-behind-interval", 0, "interval of flushing buffered writes to the storage, 0 writes through")
+	rootCmd.Flags().IntVar(&cfg.WriteBehindSize, "write-behind-size", defaultWriteBehindSize, "number of buffered metrics that triggers a flush")
+	rootCmd.Flags().IntVar(&cfg.WriteBehindLimit, "write-behind-limit", 0, "number of buffered metrics past which the writes of new metrics fail, 0 for 100 times the size")
 }
@@ -11,8 +11,10 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
 
 	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
 )
 
 func getFreePort() (int, error) {
@@ -176,3 +178,77 @@ func Test_validateAddress(t *testing.T) {
 		})
 	}
 }
+
+func Test_storageURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{
+			name:   "storage flag wins",
+			config: Config{Storage: "file:///var/lib/metrics.json?interval=0", DatabaseDSN: "postgres://localhost/metrics", FileStoragePath: "/tmp/metrics.json"},
+			want:   "file:///var/lib/metrics.json?interval=0",
+		},
+		{
+			name:   "database DSN wins over empty file path",
+			config: Config{DatabaseDSN: "postgres://localhost/metrics"},
+			want:   "postgres://localhost/metrics",
+		},
+		{
+			name:   "database DSN wins over file path",
+			config: Config{DatabaseDSN: "postgres://localhost/metrics", FileStoragePath: "/tmp/metrics.json"},
+			want:   "postgres://localhost/metrics",
+		},
+		{
+			name:   "file path",
+			config: Config{FileStoragePath: "/tmp/metrics.json", StoreInterval: 10, Restore: true},
+			want:   "file:///tmp/metrics.json?interval=10&restore=true",
+		},
+		{
+			name:   "in-memory",
+			config: Config{},
+			want:   "memory:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg = &tt.config
+			got, err := storageURL()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func Test_initStorage(t *testing.T) {
+	logger.InitLogger()
+	cfg = &Config{Storage: "sqlite://" + t.TempDir() + "/metrics.db", KeyMode: "strict"}
+
+	s, err := initStorage()
+	assert.NoError(t, err)
+	assert.IsType(t, &storage.SQLiteStorage{}, s)
+	assert.NoError(t, s.Close())
+
+	cfg = &Config{Storage: "memory://", KeyMode: "typed", WriteBehindInterval: time.Second}
+	s, err = initStorage()
+	assert.NoError(t, err)
+	assert.IsType(t, &storage.WriteBehindStorage{}, s)
+	assert.NoError(t, s.Close())
+
+	cfg = &Config{Storage: "memory://", KeyMode: "typed", JournalSize: 10}
+	s, err = initStorage()
+	assert.NoError(t, err)
+	assert.IsType(t, &storage.ResilientStorage{}, s)
+	assert.NoError(t, s.Close())
+
+	cfg = &Config{Storage: "memory://", KeyMode: "typed", WriteBehindInterval: time.Second, WatchBuffer: 10}
+	s, err = initStorage()
+	assert.NoError(t, err)
+	assert.IsType(t, &storage.WatchableStorage{}, s)
+	assert.NoError(t, s.Close())
+
+	cfg = &Config{Storage: "memory://", KeyMode: "loose"}
+	_, err = initStorage()
+	assert.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/handlers"
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+const selfMetricsInterval = 10 * time.Second
+
+// selfMetricsSource provides internal metrics of the server.
+type selfMetricsSource interface {
+	SelfMetrics() []*metrics.Metrics
+}
+
+// selfMetricsSources returns the admission controller, if any, and the storage if they
+// provide internal metrics.
+func selfMetricsSources(s storage.Storage, ac *handlers.AdmissionController) []selfMetricsSource {
+	var sources []selfMetricsSource
+	if ac != nil {
+		sources = append(sources, ac)
+	}
+	if source, ok := s.(selfMetricsSource); ok {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// reportSelfMetrics periodically writes the metrics of the sources to the storage
+// until ctx is cancelled.
+func reportSelfMetrics(ctx context.Context, s storage.Storage, interval time.Duration, sources ...selfMetricsSource) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var selfMetrics []*metrics.Metrics
+			for _, source := range sources {
+				selfMetrics = append(selfMetrics, source.SelfMetrics()...)
+			}
+			if len(selfMetrics) == 0 {
+				continue
+			}
+			if err := s.UpdateMetrics(ctx, selfMetrics); err != nil {
+				logger.Sugar.Errorf("error storing server metrics: %v", err)
+			}
+		}
+	}
+}
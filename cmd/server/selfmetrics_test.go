@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/handlers"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+type staticSource []*metrics.Metrics
+
+func (s staticSource) SelfMetrics() []*metrics.Metrics {
+	return s
+}
+
+func Test_reportSelfMetrics(t *testing.T) {
+	s := storage.NewMemStorage()
+	gauge := metrics.NewGauge("AdmissionInFlight", 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reportSelfMetrics(ctx, s, 10*time.Millisecond, staticSource{&gauge})
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, err := s.Get(context.Background(), "AdmissionInFlight", "gauge")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func Test_selfMetricsSources(t *testing.T) {
+	assert.Empty(t, selfMetricsSources(storage.NewMemStorage(), nil))
+
+	ac := handlers.NewAdmissionController(1, 0)
+	s := storage.NewResilientStorage(storage.NewMemStorage(), 10, time.Hour)
+	defer s.Close()
+	assert.Equal(t, []selfMetricsSource{ac, s}, selfMetricsSources(s, ac))
+}
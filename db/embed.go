@@ -0,0 +1,14 @@
+// Package db holds the schema migrations of the database storage backends.
+package db
+
+import "embed"
+
+// PostgresMigrations holds the migrations of the PostgreSQL storage in the migrations directory.
+//
+//go:embed migrations/*.sql
+var PostgresMigrations embed.FS
+
+// SQLiteMigrations holds the migrations of the SQLite storage in the sqlite directory.
+//
+//go:embed sqlite/*.sql
+var SQLiteMigrations embed.FS
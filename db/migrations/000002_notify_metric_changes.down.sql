@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS counter_changed ON counter;
+DROP TRIGGER IF EXISTS gauge_changed ON gauge;
+DROP TRIGGER IF EXISTS counter_truncated ON counter;
+DROP TRIGGER IF EXISTS gauge_truncated ON gauge;
+DROP FUNCTION IF EXISTS notify_metric_change();
+
+ALTER TABLE counter DROP COLUMN IF EXISTS version;
+ALTER TABLE gauge DROP COLUMN IF EXISTS version;
@@ -0,0 +1,35 @@
+ALTER TABLE counter ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE gauge ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+
+-- notify_metric_change sends the new state of a changed metric to the listeners of
+-- metric_changes. Gauge values are sent as text to keep their exact value, NaN and
+-- infinities. A change that does not fit into a notification is sent as a reset.
+CREATE OR REPLACE FUNCTION notify_metric_change() RETURNS trigger AS $$
+DECLARE
+    payload TEXT;
+BEGIN
+    IF TG_OP = 'DELETE' OR TG_OP = 'TRUNCATE' THEN
+        payload := json_build_object('op', 'reset')::text;
+    ELSIF TG_TABLE_NAME = 'counter' THEN
+        payload := json_build_object('op', 'set', 'type', 'counter', 'id', NEW.id,
+            'delta', NEW.delta, 'version', NEW.version)::text;
+    ELSE
+        payload := json_build_object('op', 'set', 'type', 'gauge', 'id', NEW.id,
+            'value', NEW.value::text, 'version', NEW.version)::text;
+    END IF;
+    IF octet_length(payload) >= 8000 THEN
+        payload := json_build_object('op', 'reset')::text;
+    END IF;
+    PERFORM pg_notify('metric_changes', payload);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER counter_changed AFTER INSERT OR UPDATE OR DELETE ON counter
+    FOR EACH ROW EXECUTE FUNCTION notify_metric_change();
+CREATE TRIGGER gauge_changed AFTER INSERT OR UPDATE OR DELETE ON gauge
+    FOR EACH ROW EXECUTE FUNCTION notify_metric_change();
+CREATE TRIGGER counter_truncated AFTER TRUNCATE ON counter
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_metric_change();
+CREATE TRIGGER gauge_truncated AFTER TRUNCATE ON gauge
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_metric_change();
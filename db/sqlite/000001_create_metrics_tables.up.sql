@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS counter(
+    id TEXT PRIMARY KEY,
+    delta INTEGER
+);
+CREATE TABLE IF NOT EXISTS gauge(
+    id TEXT PRIMARY KEY,
+    value REAL
+);
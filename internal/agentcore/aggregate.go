@@ -0,0 +1,195 @@
+// Package agentcore provides core functionalities for the agent to collect metrics
+// from the system and send them to the server.
+package agentcore
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// Aggregation is the name of a function used to aggregate gauge samples
+// collected between two reports.
+type Aggregation string
+
+const (
+	AggregationLast  Aggregation = "last"
+	AggregationMin   Aggregation = "min"
+	AggregationMax   Aggregation = "max"
+	AggregationMean  Aggregation = "mean"
+	AggregationSum   Aggregation = "sum"
+	AggregationCount Aggregation = "count"
+)
+
+// ParseAggregation validates the name of an aggregation function.
+func ParseAggregation(name string) (Aggregation, error) {
+	switch a := Aggregation(strings.TrimSpace(name)); a {
+	case AggregationLast, AggregationMin, AggregationMax, AggregationMean, AggregationSum, AggregationCount:
+		return a, nil
+	}
+	return "", fmt.Errorf("unsupported aggregation %q", name)
+}
+
+// ParseAggregationRules parses per-metric aggregation rules in the format
+// "Alloc=max,mean;HeapInuse=min". An empty spec yields no rules.
+func ParseAggregationRules(spec string) (map[string][]Aggregation, error) {
+	rules := make(map[string][]Aggregation)
+	for _, rule := range strings.Split(spec, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		name, funcs, ok := strings.Cut(rule, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.TrimSpace(funcs) == "" {
+			return nil, fmt.Errorf("invalid aggregation rule %q, expected name=func[,func]", rule)
+		}
+		for _, f := range strings.Split(funcs, ",") {
+			a, err := ParseAggregation(f)
+			if err != nil {
+				return nil, err
+			}
+			rules[name] = append(rules[name], a)
+		}
+	}
+	return rules, nil
+}
+
+type gaugeWindow struct {
+	last  float64
+	min   float64
+	max   float64
+	sum   float64
+	count int64
+}
+
+func (w *gaugeWindow) add(value float64) {
+	if w.count == 0 {
+		w.min, w.max = value, value
+	}
+	w.last = value
+	w.min = math.Min(w.min, value)
+	w.max = math.Max(w.max, value)
+	w.sum += value
+	w.count++
+}
+
+func (w *gaugeWindow) value(a Aggregation) float64 {
+	switch a {
+	case AggregationMin:
+		return w.min
+	case AggregationMax:
+		return w.max
+	case AggregationMean:
+		return w.sum / float64(w.count)
+	case AggregationSum:
+		return w.sum
+	case AggregationCount:
+		return float64(w.count)
+	}
+	return w.last
+}
+
+// Aggregator accumulates metrics from several polls within one report window.
+// Gauges are aggregated according to per-metric rules, counters are summed.
+type Aggregator struct {
+	rules              map[string][]Aggregation
+	defaultAggregation Aggregation
+	suffix             bool
+	gauges             map[string]*gaugeWindow
+	counters           map[string]int64
+	mu                 sync.Mutex
+}
+
+// NewAggregator creates a new Aggregator. Gauges without a rule are aggregated with
+// defaultAggregation. If suffix is set, or a metric has several aggregations, the
+// reported gauges are named after the aggregation, e.g. "Alloc_max".
+func NewAggregator(defaultAggregation Aggregation, rules map[string][]Aggregation, suffix bool) *Aggregator {
+	if defaultAggregation == "" {
+		defaultAggregation = AggregationLast
+	}
+	return &Aggregator{
+		rules:              rules,
+		defaultAggregation: defaultAggregation,
+		suffix:             suffix,
+		gauges:             make(map[string]*gaugeWindow),
+		counters:           make(map[string]int64),
+	}
+}
+
+// Add adds the metrics collected by a single poll to the current window.
+func (a *Aggregator) Add(collected []MetricInterface) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, metric := range collected {
+		valueStr, err := metric.GetValueAsString()
+		if err != nil {
+			return fmt.Errorf("error getting value of metric %s: %w", metric.GetName(), err)
+		}
+		switch metric.GetType() {
+		case "gauge":
+			value, err := strconv.ParseFloat(valueStr, 64)
+			if err != nil {
+				return fmt.Errorf("invalid gauge value of metric %s: %w", metric.GetName(), err)
+			}
+			window, ok := a.gauges[metric.GetName()]
+			if !ok {
+				window = &gaugeWindow{}
+				a.gauges[metric.GetName()] = window
+			}
+			window.add(value)
+		case "counter":
+			delta, err := strconv.ParseInt(valueStr, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid counter value of metric %s: %w", metric.GetName(), err)
+			}
+			a.counters[metric.GetName()] += delta
+		default:
+			return fmt.Errorf("unsupported type of metric %s: %s", metric.GetName(), metric.GetType())
+		}
+	}
+	return nil
+}
+
+// Flush returns the aggregated metrics of the current window and starts a new one.
+func (a *Aggregator) Flush() []MetricInterface {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := make([]MetricInterface, 0, len(a.gauges)+len(a.counters))
+	for _, name := range sortedKeys(a.gauges) {
+		window := a.gauges[name]
+		funcs, ok := a.rules[name]
+		if !ok {
+			funcs = []Aggregation{a.defaultAggregation}
+		}
+		for _, f := range funcs {
+			outputName := name
+			if a.suffix || len(funcs) > 1 {
+				outputName = name + "_" + string(f)
+			}
+			result = append(result, metrics.NewGauge(outputName, window.value(f)))
+		}
+	}
+	for _, name := range sortedKeys(a.counters) {
+		result = append(result, metrics.NewCounter(name, a.counters[name]))
+	}
+
+	a.gauges = make(map[string]*gaugeWindow)
+	a.counters = make(map[string]int64)
+	return result
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
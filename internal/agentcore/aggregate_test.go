@@ -0,0 +1,119 @@
+package agentcore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+func TestParseAggregationRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[string][]Aggregation
+		wantErr bool
+	}{
+		{
+			name: "empty spec",
+			spec: "",
+			want: map[string][]Aggregation{},
+		},
+		{
+			name: "several rules",
+			spec: "Alloc=max,mean; HeapInuse=min",
+			want: map[string][]Aggregation{
+				"Alloc":     {AggregationMax, AggregationMean},
+				"HeapInuse": {AggregationMin},
+			},
+		},
+		{
+			name:    "missing functions",
+			spec:    "Alloc=",
+			wantErr: true,
+		},
+		{
+			name:    "unknown function",
+			spec:    "Alloc=median",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAggregationRules(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	polls := [][]MetricInterface{
+		{metrics.NewGauge("Alloc", 10), metrics.NewGauge("Sys", 1), metrics.NewCounter("PollCount", 1)},
+		{metrics.NewGauge("Alloc", 30), metrics.NewGauge("Sys", 2), metrics.NewCounter("PollCount", 1)},
+		{metrics.NewGauge("Alloc", 20), metrics.NewGauge("Sys", 3), metrics.NewCounter("PollCount", 1)},
+	}
+	tests := []struct {
+		name               string
+		defaultAggregation Aggregation
+		rules              map[string][]Aggregation
+		suffix             bool
+		want               []MetricInterface
+	}{
+		{
+			name: "default last",
+			want: []MetricInterface{
+				metrics.NewGauge("Alloc", 20),
+				metrics.NewGauge("Sys", 3),
+				metrics.NewCounter("PollCount", 3),
+			},
+		},
+		{
+			name:               "default with suffix",
+			defaultAggregation: AggregationSum,
+			suffix:             true,
+			want: []MetricInterface{
+				metrics.NewGauge("Alloc_sum", 60),
+				metrics.NewGauge("Sys_sum", 6),
+				metrics.NewCounter("PollCount", 3),
+			},
+		},
+		{
+			name: "per-metric rules",
+			rules: map[string][]Aggregation{
+				"Alloc": {AggregationMin, AggregationMax, AggregationMean, AggregationCount},
+				"Sys":   {AggregationMax},
+			},
+			want: []MetricInterface{
+				metrics.NewGauge("Alloc_min", 10),
+				metrics.NewGauge("Alloc_max", 30),
+				metrics.NewGauge("Alloc_mean", 20),
+				metrics.NewGauge("Alloc_count", 3),
+				metrics.NewGauge("Sys", 3),
+				metrics.NewCounter("PollCount", 3),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAggregator(tt.defaultAggregation, tt.rules, tt.suffix)
+			for _, poll := range polls {
+				require.NoError(t, a.Add(poll))
+			}
+			assert.Equal(t, tt.want, a.Flush())
+			assert.Empty(t, a.Flush())
+		})
+	}
+}
+
+func TestAggregator_AddUnsupportedType(t *testing.T) {
+	a := NewAggregator(AggregationLast, nil, false)
+	err := a.Add([]MetricInterface{metrics.Metrics{ID: "test", MType: "histogram"}})
+	assert.Error(t, err)
+}
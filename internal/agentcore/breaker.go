@@ -0,0 +1,149 @@
+package agentcore
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when a request is rejected because the circuit
+// breaker of its server is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops requests to a server after threshold consecutive failures.
+// After openTimeout it lets a single probe request through; the probe result
+// closes the breaker again or reopens it.
+type circuitBreaker struct {
+	threshold   int
+	openTimeout time.Duration
+	state       breakerState
+	failures    int
+	openUntil   time.Time
+	probing     bool
+	mu          sync.Mutex
+}
+
+func newCircuitBreaker(threshold int, openTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, openTimeout: openTimeout}
+}
+
+// allow reports whether a request may be sent now.
+func (b *circuitBreaker) allow(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records a failed request. A positive retryAfter opens the breaker
+// for exactly the time requested by the server.
+func (b *circuitBreaker) failure(now time.Time, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state != breakerHalfOpen && b.failures < b.threshold && retryAfter <= 0 {
+		return
+	}
+	b.state = breakerOpen
+	wait := b.openTimeout
+	if retryAfter > 0 {
+		wait = retryAfter
+	}
+	b.openUntil = now.Add(wait)
+}
+
+// release gives up a probe without recording its result.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// breakerTransport is an http.RoundTripper that keeps a circuit breaker per server host.
+type breakerTransport struct {
+	next        http.RoundTripper
+	threshold   int
+	openTimeout time.Duration
+	breakers    map[string]*circuitBreaker
+	mu          sync.Mutex
+}
+
+func newBreakerTransport(next http.RoundTripper, threshold int, openTimeout time.Duration) *breakerTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &breakerTransport{
+		next:        next,
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		breakers:    make(map[string]*circuitBreaker),
+	}
+}
+
+func (t *breakerTransport) breaker(host string) *circuitBreaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		b = newCircuitBreaker(t.threshold, t.openTimeout)
+		t.breakers[host] = b
+	}
+	return b
+}
+
+// RoundTrip sends the request unless the breaker of its host is open.
+// Transport errors, 5xx and 429 responses count as failures.
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.breaker(req.URL.Host)
+	if err := b.allow(time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		if req.Context().Err() != nil {
+			// the caller gave up, this says nothing about the server
+			b.release()
+		} else {
+			b.failure(time.Now(), 0)
+		}
+	case isRetriableStatus(resp.StatusCode):
+		b.failure(time.Now(), parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+	default:
+		b.success()
+	}
+	return resp, err
+}
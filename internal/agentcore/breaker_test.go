@@ -0,0 +1,64 @@
+package agentcore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_circuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Minute)
+
+	assert.NoError(t, b.allow(now))
+	b.failure(now, 0)
+	assert.NoError(t, b.allow(now))
+	b.failure(now, 0)
+	assert.ErrorIs(t, b.allow(now), ErrCircuitOpen)
+
+	// a single probe is allowed after the timeout
+	later := now.Add(time.Minute)
+	assert.NoError(t, b.allow(later))
+	assert.ErrorIs(t, b.allow(later), ErrCircuitOpen)
+
+	// a failed probe reopens the breaker
+	b.failure(later, 0)
+	assert.ErrorIs(t, b.allow(later.Add(time.Second)), ErrCircuitOpen)
+
+	// a successful probe closes it
+	evenLater := later.Add(time.Minute)
+	assert.NoError(t, b.allow(evenLater))
+	b.success()
+	assert.NoError(t, b.allow(evenLater))
+	assert.NoError(t, b.allow(evenLater))
+}
+
+func Test_circuitBreaker_RetryAfter(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(5, time.Minute)
+
+	b.failure(now, 3*time.Second)
+	assert.ErrorIs(t, b.allow(now.Add(2*time.Second)), ErrCircuitOpen)
+	assert.NoError(t, b.allow(now.Add(3*time.Second)))
+}
+
+func Test_breakerTransport(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mockServer.Close()
+
+	client := &http.Client{Transport: newBreakerTransport(nil, 1, time.Minute)}
+
+	resp, err := client.Get(mockServer.URL)
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+
+	_, err = client.Get(mockServer.URL)
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+}
@@ -0,0 +1,71 @@
+package agentcore
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retryPolicy describes how failed requests are retried.
+type retryPolicy struct {
+	count    int
+	baseWait time.Duration
+	maxWait  time.Duration
+}
+
+// wait returns the delay before the given retry attempt, starting from zero.
+// A positive retryAfter requested by the server takes precedence over the backoff,
+// capped at maxWait so a server cannot stall the sender for longer.
+func (p retryPolicy) wait(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if p.maxWait > 0 && retryAfter > p.maxWait {
+			return p.maxWait
+		}
+		return retryAfter
+	}
+	return fullJitterBackoff(p.baseWait, p.maxWait, attempt)
+}
+
+// fullJitterBackoff returns a random duration between zero and the exponential
+// backoff base*2^attempt capped at max.
+func fullJitterBackoff(base, max time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	ceiling := base
+	for i := 0; i < attempt && ceiling < max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > max {
+		ceiling = max
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// parseRetryAfter parses the value of a Retry-After header, given either in
+// seconds or as an HTTP date. It returns zero if the value is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// isRetriableStatus reports whether a request that got the status code may be retried.
+func isRetriableStatus(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,47 @@
+package agentcore
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "empty", value: "", want: 0},
+		{name: "seconds", value: "120", want: 2 * time.Minute},
+		{name: "negative seconds", value: "-1", want: 0},
+		{name: "http date", value: now.Add(30 * time.Second).Format(http.TimeFormat), want: 30 * time.Second},
+		{name: "date in the past", value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{name: "invalid", value: "soon", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseRetryAfter(tt.value, now))
+		})
+	}
+}
+
+func Test_fullJitterBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		wait := fullJitterBackoff(100*time.Millisecond, time.Second, attempt)
+		assert.GreaterOrEqual(t, wait, time.Duration(0))
+		assert.LessOrEqual(t, wait, time.Second)
+	}
+	assert.Equal(t, time.Duration(0), fullJitterBackoff(0, time.Second, 3))
+}
+
+func Test_retryPolicy_wait(t *testing.T) {
+	p := retryPolicy{count: 3, baseWait: time.Millisecond, maxWait: 10 * time.Millisecond}
+	assert.Equal(t, 5*time.Millisecond, p.wait(0, 5*time.Millisecond))
+	// an oversized Retry-After of the server is capped
+	assert.Equal(t, 10*time.Millisecond, p.wait(0, parseRetryAfter("86400", time.Now())))
+	assert.LessOrEqual(t, p.wait(5, 0), 10*time.Millisecond)
+}
@@ -3,7 +3,11 @@
 package agentcore
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -12,58 +16,299 @@ import (
 )
 
 const (
-	retryCount       = 3
-	retryWait        = 2 * time.Second
-	retryMaxWaitTime = 5 * time.Second
+	defaultRetryBaseWait    = 1 * time.Second
+	defaultRetryMaxWait     = 5 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerTimeout   = 30 * time.Second
+	defaultRequestTimeout   = 10 * time.Second
 )
 
-// SendMetrics sends individual metrics to the server.
-func SendMetrics(metrics []MetricInterface, serverURL string) {
+const (
+	// ModeFailover sends every request to the first healthy server.
+	ModeFailover = "failover"
+	// ModeFanout sends every request to all servers.
+	ModeFanout = "fanout"
+)
+
+var errNoAvailableTargets = errors.New("no available servers")
+
+// SenderConfig holds the settings of a Sender.
+type SenderConfig struct {
+	// ServerURLs lists the servers to send metrics to, in order of preference.
+	ServerURLs []string
+	// Mode selects how the servers are used: ModeFailover or ModeFanout.
+	Mode string
+	// RateLimit is the maximum number of concurrent requests.
+	RateLimit int
+	// BatchMode determines whether metrics are sent in batch or individually.
+	BatchMode bool
+	// RetryCount is the number of retries of a failed request, zero disables retries.
+	RetryCount int
+	// RetryBaseWait is the base of the full-jitter exponential backoff between retries.
+	RetryBaseWait time.Duration
+	// RetryMaxWait caps the backoff between retries and the wait requested by
+	// the Retry-After header of the server.
+	RetryMaxWait time.Duration
+	// BreakerThreshold is the number of consecutive failures that opens the circuit breaker of a server.
+	BreakerThreshold int
+	// BreakerTimeout is how long the circuit breaker stays open before a probe request is allowed.
+	BreakerTimeout time.Duration
+	// RequestTimeout bounds every request, so an unresponsive server does not hold a worker.
+	RequestTimeout time.Duration
+}
+
+// Sender sends collected metrics to the servers using a bounded pool of workers.
+// All workers share a single keep-alive HTTP client.
+type Sender struct {
+	client       *resty.Client
+	healthClient *resty.Client
+	targets      []*target
+	retry        retryPolicy
+	mode         string
+	batchMode    bool
+	rateLimit    int
+}
+
+// NewSender creates a new Sender from the given configuration.
+func NewSender(cfg SenderConfig) (*Sender, error) {
+	if len(cfg.ServerURLs) == 0 {
+		return nil, errors.New("at least one server is required")
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = ModeFailover
+	}
+	if cfg.Mode != ModeFailover && cfg.Mode != ModeFanout {
+		return nil, fmt.Errorf("unsupported mode %q", cfg.Mode)
+	}
+	if cfg.RateLimit < 1 {
+		cfg.RateLimit = 1
+	}
+	if cfg.RetryCount < 0 {
+		cfg.RetryCount = 0
+	}
+	if cfg.RetryBaseWait <= 0 {
+		cfg.RetryBaseWait = defaultRetryBaseWait
+	}
+	if cfg.RetryMaxWait < cfg.RetryBaseWait {
+		cfg.RetryMaxWait = max(defaultRetryMaxWait, cfg.RetryBaseWait)
+	}
+	if cfg.BreakerThreshold < 1 {
+		cfg.BreakerThreshold = defaultBreakerThreshold
+	}
+	if cfg.BreakerTimeout <= 0 {
+		cfg.BreakerTimeout = defaultBreakerTimeout
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = defaultRequestTimeout
+	}
+
+	// retries are handled by the sender, so the client only counts failures in the breaker
+	client := resty.New().SetTimeout(cfg.RequestTimeout)
+	client.SetTransport(newBreakerTransport(client.GetClient().Transport, cfg.BreakerThreshold, cfg.BreakerTimeout))
+
+	targets := make([]*target, len(cfg.ServerURLs))
+	for i, serverURL := range cfg.ServerURLs {
+		targets[i] = newTarget(serverURL)
+	}
+
+	return &Sender{
+		client:       client,
+		healthClient: resty.NewWithClient(client.GetClient()),
+		targets:      targets,
+		retry: retryPolicy{
+			count:    cfg.RetryCount,
+			baseWait: cfg.RetryBaseWait,
+			maxWait:  cfg.RetryMaxWait,
+		},
+		mode:      cfg.Mode,
+		batchMode: cfg.BatchMode,
+		rateLimit: cfg.RateLimit,
+	}, nil
+}
+
+// Run starts the worker pool and sends every batch received from jobs.
+// It returns when jobs is closed and all in-flight requests have finished,
+// so closing jobs flushes the pending work. Cancelling ctx aborts in-flight requests.
+func (s *Sender) Run(ctx context.Context, jobs <-chan []MetricInterface) {
+	var workers sync.WaitGroup
+	for i := 0; i < s.rateLimit; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for batch := range jobs {
+				if s.batchMode {
+					s.SendBatchMetrics(ctx, batch)
+				} else {
+					s.SendMetrics(ctx, batch)
+				}
+			}
+		}()
+	}
+	workers.Wait()
+}
+
+// SendMetrics sends individual metrics to the servers.
+func (s *Sender) SendMetrics(ctx context.Context, metrics []MetricInterface) {
 	for _, metric := range metrics {
-		sendingMetric, err := json.Marshal(metric)
-		if err != nil {
-			logger.Sugar.Errorln("error marshaling json: %v", err)
+		if ctx.Err() != nil {
+			logger.Sugar.Errorf("sending metrics cancelled: %v", ctx.Err())
+			return
 		}
-		urlFormat := "/update/"
-		url := serverURL + urlFormat
-
-		client := resty.New()
-		client.
-			SetRetryCount(retryCount).
-			SetRetryWaitTime(retryWait).
-			SetRetryMaxWaitTime(retryMaxWaitTime)
-		_, err = client.R().
-			SetHeader("Content-type", "application/json").
-			SetBody(sendingMetric).
-			Post(url)
-
+		sendingMetric, err := json.Marshal(metric)
 		if err != nil {
-			logger.Sugar.Errorln("error sending metric: %v", err)
+			logger.Sugar.Errorf("error marshaling json: %v", err)
 			continue
 		}
+		if err = s.deliver(ctx, "/update/", sendingMetric); err != nil {
+			logger.Sugar.Errorf("error sending metric: %v", err)
+		}
 	}
 }
 
-// SendBatchMetrics sends a batch of metrics to the server.
-func SendBatchMetrics(metrics []MetricInterface, serverURL string) {
+// SendBatchMetrics sends a batch of metrics to the servers.
+func (s *Sender) SendBatchMetrics(ctx context.Context, metrics []MetricInterface) {
+	if len(metrics) == 0 {
+		return
+	}
 	sendingMetrics, err := json.Marshal(metrics)
 	if err != nil {
-		logger.Sugar.Errorln("error marshaling json: %v", err)
+		logger.Sugar.Errorf("error marshaling json: %v", err)
+		return
+	}
+	if err = s.deliver(ctx, "/updates/", sendingMetrics); err != nil {
+		logger.Sugar.Errorf("error sending metrics: %v", err)
 	}
-	urlFormat := "/updates/"
-	url := serverURL + urlFormat
+}
 
-	client := resty.New()
-	client.
-		SetRetryCount(retryCount).
-		SetRetryWaitTime(retryWait).
-		SetRetryMaxWaitTime(retryMaxWaitTime)
-	_, err = client.R().
-		SetHeader("Content-type", "application/json").
-		SetBody(sendingMetrics).
-		Post(url)
+// SelfMetrics returns the per-server delivery counters accumulated since the last call.
+func (s *Sender) SelfMetrics() []MetricInterface {
+	var result []MetricInterface
+	for _, t := range s.targets {
+		result = append(result, t.selfMetrics()...)
+	}
+	return result
+}
+
+func (s *Sender) deliver(ctx context.Context, path string, body []byte) error {
+	if s.mode == ModeFanout {
+		return s.fanout(ctx, path, body)
+	}
+	return s.failover(ctx, path, body)
+}
+
+// failover sends the request to the first available server, falling back to the next one on failure.
+func (s *Sender) failover(ctx context.Context, path string, body []byte) error {
+	var errs []error
+	for _, t := range s.targets {
+		if !s.ready(ctx, t) {
+			continue
+		}
+		err := s.post(ctx, t, path, body)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return errNoAvailableTargets
+	}
+	return errors.Join(errs...)
+}
 
+// fanout sends the request to every available server concurrently.
+func (s *Sender) fanout(ctx context.Context, path string, body []byte) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		sent bool
+	)
+	for _, t := range s.targets {
+		if !s.ready(ctx, t) {
+			continue
+		}
+		sent = true
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			if err := s.post(ctx, t, path, body); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(t)
+	}
+	wg.Wait()
+	if !sent {
+		return errNoAvailableTargets
+	}
+	return errors.Join(errs...)
+}
+
+// ready reports whether t can receive a request, probing /ping once its backoff has expired.
+func (s *Sender) ready(ctx context.Context, t *target) bool {
+	ok, needsCheck := t.available(time.Now())
+	if !ok {
+		return false
+	}
+	if !needsCheck {
+		return true
+	}
+	resp, err := s.healthClient.R().SetContext(ctx).Get(t.url + "/ping")
+	if err != nil || resp.IsError() {
+		logger.Sugar.Infof("server %s is still unavailable", t.url)
+		t.markUnhealthy(time.Now())
+		return false
+	}
+	logger.Sugar.Infof("server %s is available again", t.url)
+	return true
+}
+
+// post sends the request to t, retrying retriable failures with backoff.
+func (s *Sender) post(ctx context.Context, t *target, path string, body []byte) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		var retriable bool
+		retryAfter, retriable, err = s.postOnce(ctx, t, path, body)
+		if err == nil {
+			t.markSuccess()
+			return nil
+		}
+		if !retriable || attempt >= s.retry.count {
+			break
+		}
+		timer := time.NewTimer(s.retry.wait(attempt, retryAfter))
+		select {
+		case <-timer.C:
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+			err = errors.Join(err, ctx.Err())
+		}
+		break
+	}
+	t.markFailure(time.Now())
+	return fmt.Errorf("server %s: %w", t.url, err)
+}
+
+// postOnce sends a single request. It reports whether the failure may be retried
+// and how long the server asked to wait before retrying.
+func (s *Sender) postOnce(ctx context.Context, t *target, path string, body []byte) (time.Duration, bool, error) {
+	resp, err := s.client.R().
+		SetContext(ctx).
+		SetHeader("Content-type", "application/json").
+		SetBody(body).
+		Post(t.url + path)
 	if err != nil {
-		logger.Sugar.Errorf("error sending metrics: %v", err)
+		return 0, !errors.Is(err, ErrCircuitOpen) && ctx.Err() == nil, err
+	}
+	if resp.IsError() {
+		retryAfter := parseRetryAfter(resp.Header().Get("Retry-After"), time.Now())
+		return retryAfter, isRetriableStatus(resp.StatusCode()), fmt.Errorf("unexpected status code: %d", resp.StatusCode())
 	}
+	return 0, false, nil
 }
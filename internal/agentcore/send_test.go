@@ -1,17 +1,24 @@
 package agentcore
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
 	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
 )
 
 func TestSendMetrics(t *testing.T) {
+	logger.InitLogger()
 	type args struct {
 		metrics   []MetricInterface
 		serverURL string
@@ -62,7 +69,7 @@ func TestSendMetrics(t *testing.T) {
 			if tt.name == "Retry on failure" {
 				var retries int
 				mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					if retries < retryCount {
+					if retries < testRetryCount {
 						http.Error(w, "temporary error", http.StatusInternalServerError)
 						retries++
 					} else {
@@ -72,8 +79,8 @@ func TestSendMetrics(t *testing.T) {
 				defer mockServer.Close()
 				tt.args.serverURL = mockServer.URL
 
-				SendMetrics(tt.args.metrics, tt.args.serverURL)
-				assert.Greater(t, retries, 0)
+				newTestSender(t, false, tt.args.serverURL).SendMetrics(context.Background(), tt.args.metrics)
+				assert.Equal(t, testRetryCount, retries)
 			} else {
 				mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					assert.Equal(t, "/update/", r.URL.Path)
@@ -90,12 +97,13 @@ func TestSendMetrics(t *testing.T) {
 				tt.args.serverURL = mockServer.URL
 			}
 
-			SendMetrics(tt.args.metrics, tt.args.serverURL)
+			newTestSender(t, false, tt.args.serverURL).SendMetrics(context.Background(), tt.args.metrics)
 		})
 	}
 }
 
 func TestSendBatchMetrics(t *testing.T) {
+	logger.InitLogger()
 	type args struct {
 		metrics   []MetricInterface
 		serverURL string
@@ -129,7 +137,7 @@ func TestSendBatchMetrics(t *testing.T) {
 			if tt.name == "Retry on failure" {
 				var retries int
 				mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					if retries < retryCount {
+					if retries < testRetryCount {
 						http.Error(w, "temporary error", http.StatusInternalServerError)
 						retries++
 					} else {
@@ -139,8 +147,8 @@ func TestSendBatchMetrics(t *testing.T) {
 				defer mockServer.Close()
 				tt.args.serverURL = mockServer.URL
 
-				SendBatchMetrics(tt.args.metrics, tt.args.serverURL)
-				assert.Greater(t, retries, 0)
+				newTestSender(t, true, tt.args.serverURL).SendBatchMetrics(context.Background(), tt.args.metrics)
+				assert.Equal(t, testRetryCount, retries)
 			} else {
 				mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					assert.Equal(t, "/updates/", r.URL.Path)
@@ -152,8 +160,227 @@ func TestSendBatchMetrics(t *testing.T) {
 				}))
 				defer mockServer.Close()
 				tt.args.serverURL = mockServer.URL
-				SendBatchMetrics(tt.args.metrics, tt.args.serverURL)
+				newTestSender(t, true, tt.args.serverURL).SendBatchMetrics(context.Background(), tt.args.metrics)
 			}
 		})
 	}
 }
+
+func TestSender_Run(t *testing.T) {
+	const rateLimit = 2
+	var inFlight, maxInFlight, received int32
+	var mu sync.Mutex
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		mu.Lock()
+		if current > maxInFlight {
+			maxInFlight = current
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&received, 1)
+		atomic.AddInt32(&inFlight, -1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	jobs := make(chan []MetricInterface)
+	done := make(chan struct{})
+	sender, err := NewSender(SenderConfig{ServerURLs: []string{mockServer.URL}, RateLimit: rateLimit, BatchMode: true})
+	require.NoError(t, err)
+	go func() {
+		sender.Run(context.Background(), jobs)
+		close(done)
+	}()
+
+	for i := 0; i < 10; i++ {
+		jobs <- []MetricInterface{metrics.NewGauge("Alloc", float64(i))}
+	}
+	close(jobs)
+	<-done
+
+	assert.Equal(t, int32(10), atomic.LoadInt32(&received))
+	assert.LessOrEqual(t, maxInFlight, int32(rateLimit))
+}
+
+func TestNewSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SenderConfig
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			cfg:  SenderConfig{ServerURLs: []string{"http://localhost:8080"}},
+		},
+		{
+			name:    "no servers",
+			cfg:     SenderConfig{},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported mode",
+			cfg:     SenderConfig{ServerURLs: []string{"http://localhost:8080"}, Mode: "roundrobin"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, err := NewSender(tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, 1, sender.rateLimit)
+			assert.Equal(t, ModeFailover, sender.mode)
+			assert.NotNil(t, sender.client)
+		})
+	}
+}
+
+const testRetryCount = 3
+
+func newTestSender(t *testing.T, batchMode bool, serverURLs ...string) *Sender {
+	sender, err := NewSender(SenderConfig{
+		ServerURLs:    serverURLs,
+		BatchMode:     batchMode,
+		RetryCount:    testRetryCount,
+		RetryBaseWait: time.Millisecond,
+	})
+	require.NoError(t, err)
+	return sender
+}
+
+func newCountingServer(status int, counter *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			atomic.AddInt32(counter, 1)
+		}
+		w.WriteHeader(status)
+	}))
+}
+
+func TestSender_Failover(t *testing.T) {
+	logger.InitLogger()
+	var primaryHits, backupHits int32
+	primary := newCountingServer(http.StatusInternalServerError, &primaryHits)
+	defer primary.Close()
+	backup := newCountingServer(http.StatusOK, &backupHits)
+	defer backup.Close()
+
+	sender, err := NewSender(SenderConfig{ServerURLs: []string{primary.URL, backup.URL}, Mode: ModeFailover, BatchMode: true})
+	require.NoError(t, err)
+
+	batch := []MetricInterface{metrics.NewGauge("Alloc", 1)}
+	sender.SendBatchMetrics(context.Background(), batch)
+	sender.SendBatchMetrics(context.Background(), batch)
+
+	// the primary is skipped while its health check backoff has not expired
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primaryHits))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&backupHits))
+
+	selfMetrics := sender.SelfMetrics()
+	assert.Contains(t, selfMetrics, metrics.NewCounter("SendFailure_"+targetMetricName(primary.URL), 1))
+	assert.Contains(t, selfMetrics, metrics.NewCounter("SendSuccess_"+targetMetricName(backup.URL), 2))
+	assert.Empty(t, sender.SelfMetrics())
+}
+
+func TestSender_FailoverRecovery(t *testing.T) {
+	logger.InitLogger()
+	var primaryHits, backupHits int32
+	primary := newCountingServer(http.StatusOK, &primaryHits)
+	defer primary.Close()
+	backup := newCountingServer(http.StatusOK, &backupHits)
+	defer backup.Close()
+
+	sender, err := NewSender(SenderConfig{ServerURLs: []string{primary.URL, backup.URL}, BatchMode: true})
+	require.NoError(t, err)
+	sender.targets[0].markFailure(time.Now().Add(-time.Hour))
+
+	sender.SendBatchMetrics(context.Background(), []MetricInterface{metrics.NewGauge("Alloc", 1)})
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primaryHits))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&backupHits))
+}
+
+func TestSender_Fanout(t *testing.T) {
+	logger.InitLogger()
+	var firstHits, secondHits int32
+	first := newCountingServer(http.StatusOK, &firstHits)
+	defer first.Close()
+	second := newCountingServer(http.StatusOK, &secondHits)
+	defer second.Close()
+
+	sender, err := NewSender(SenderConfig{ServerURLs: []string{first.URL, second.URL}, Mode: ModeFanout})
+	require.NoError(t, err)
+
+	sender.SendMetrics(context.Background(), []MetricInterface{metrics.NewGauge("Alloc", 1), metrics.NewGauge("Sys", 2)})
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&firstHits))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secondHits))
+}
+
+func TestSender_RequestTimeout(t *testing.T) {
+	logger.InitLogger()
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	sender, err := NewSender(SenderConfig{ServerURLs: []string{hung.URL}, BatchMode: true, RequestTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	// the unresponsive server fails the request instead of holding the worker
+	start := time.Now()
+	sender.SendBatchMetrics(context.Background(), []MetricInterface{metrics.NewGauge("Alloc", 1)})
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Contains(t, sender.SelfMetrics(), metrics.NewCounter("SendFailure_"+targetMetricName(hung.URL), 1))
+}
+
+func TestSender_RetryAfter(t *testing.T) {
+	logger.InitLogger()
+	var attempts int32
+	var firstAttempt, secondAttempt time.Time
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			firstAttempt = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		secondAttempt = time.Now()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	sender := newTestSender(t, true, mockServer.URL)
+	sender.SendBatchMetrics(context.Background(), []MetricInterface{metrics.NewGauge("Alloc", 1)})
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	assert.GreaterOrEqual(t, secondAttempt.Sub(firstAttempt), time.Second)
+}
+
+func TestSender_CircuitBreaker(t *testing.T) {
+	logger.InitLogger()
+	var attempts int32
+	mockServer := newCountingServer(http.StatusServiceUnavailable, &attempts)
+	defer mockServer.Close()
+
+	sender, err := NewSender(SenderConfig{
+		ServerURLs:       []string{mockServer.URL},
+		BatchMode:        true,
+		RetryCount:       5,
+		RetryBaseWait:    time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerTimeout:   time.Minute,
+	})
+	require.NoError(t, err)
+
+	sender.SendBatchMetrics(context.Background(), []MetricInterface{metrics.NewGauge("Alloc", 1)})
+
+	// the breaker opens after two failures and stops the remaining retries
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
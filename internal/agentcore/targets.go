@@ -0,0 +1,109 @@
+package agentcore
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+const (
+	healthCheckBaseBackoff = 1 * time.Second
+	healthCheckMaxBackoff  = 1 * time.Minute
+)
+
+// target tracks the health and delivery statistics of a single metrics server.
+type target struct {
+	url       string
+	healthy   bool
+	failures  int
+	nextCheck time.Time
+	successes int64
+	errors    int64
+	mu        sync.Mutex
+}
+
+func newTarget(serverURL string) *target {
+	return &target{url: serverURL, healthy: true}
+}
+
+// available reports whether the target may be used now. An unhealthy target
+// becomes available again when its backoff expires and it needs a health check.
+func (t *target) available(now time.Time) (ok bool, needsCheck bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.healthy {
+		return true, false
+	}
+	return !now.Before(t.nextCheck), true
+}
+
+func (t *target) markSuccess() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthy = true
+	t.failures = 0
+	t.successes++
+}
+
+func (t *target) markFailure(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthy = false
+	t.failures++
+	t.errors++
+	t.nextCheck = now.Add(backoff(t.failures))
+}
+
+// markUnhealthy records a failed health check without counting a failed delivery.
+func (t *target) markUnhealthy(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthy = false
+	t.failures++
+	t.nextCheck = now.Add(backoff(t.failures))
+}
+
+// takeStats returns the number of successful and failed deliveries since the last call.
+func (t *target) takeStats() (successes, errors int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	successes, errors = t.successes, t.errors
+	t.successes, t.errors = 0, 0
+	return successes, errors
+}
+
+// selfMetrics returns the delivery counters of the target as agent metrics.
+func (t *target) selfMetrics() []MetricInterface {
+	successes, errors := t.takeStats()
+	name := targetMetricName(t.url)
+	var result []MetricInterface
+	if successes > 0 {
+		result = append(result, metrics.NewCounter("SendSuccess_"+name, successes))
+	}
+	if errors > 0 {
+		result = append(result, metrics.NewCounter("SendFailure_"+name, errors))
+	}
+	return result
+}
+
+func backoff(failures int) time.Duration {
+	wait := healthCheckBaseBackoff
+	for i := 1; i < failures && wait < healthCheckMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > healthCheckMaxBackoff {
+		wait = healthCheckMaxBackoff
+	}
+	return wait
+}
+
+func targetMetricName(serverURL string) string {
+	host := serverURL
+	if u, err := url.Parse(serverURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return strings.NewReplacer(":", "_", ".", "_").Replace(host)
+}
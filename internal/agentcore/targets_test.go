@@ -0,0 +1,52 @@
+package agentcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_backoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		want     time.Duration
+	}{
+		{name: "first failure", failures: 1, want: healthCheckBaseBackoff},
+		{name: "third failure", failures: 3, want: 4 * healthCheckBaseBackoff},
+		{name: "capped", failures: 100, want: healthCheckMaxBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, backoff(tt.failures))
+		})
+	}
+}
+
+func Test_target_available(t *testing.T) {
+	now := time.Now()
+	tr := newTarget("http://localhost:8080")
+
+	ok, needsCheck := tr.available(now)
+	assert.True(t, ok)
+	assert.False(t, needsCheck)
+
+	tr.markFailure(now)
+	ok, _ = tr.available(now)
+	assert.False(t, ok)
+
+	ok, needsCheck = tr.available(now.Add(healthCheckBaseBackoff))
+	assert.True(t, ok)
+	assert.True(t, needsCheck)
+
+	tr.markSuccess()
+	successes, errors := tr.takeStats()
+	assert.Equal(t, int64(1), successes)
+	assert.Equal(t, int64(1), errors)
+}
+
+func Test_targetMetricName(t *testing.T) {
+	assert.Equal(t, "localhost_8080", targetMetricName("http://localhost:8080"))
+	assert.Equal(t, "127_0_0_1_80", targetMetricName("https://127.0.0.1:80"))
+}
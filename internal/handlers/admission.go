@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+const (
+	// serviceTimeWeight is the weight of the latest request in the moving average of service time.
+	serviceTimeWeight  = 0.2
+	initialServiceTime = 10 * time.Millisecond
+)
+
+// AdmissionController limits the number of concurrently processed requests.
+// Requests above the limit wait in a queue for at most maxWait and are rejected
+// with 429 Too Many Requests afterwards.
+type AdmissionController struct {
+	slots       chan struct{}
+	maxWait     time.Duration
+	inFlight    atomic.Int64
+	queued      atomic.Int64
+	rejected    atomic.Int64
+	serviceTime time.Duration
+	mu          sync.Mutex
+}
+
+// NewAdmissionController creates a new AdmissionController that admits at most
+// maxInFlight concurrent requests.
+func NewAdmissionController(maxInFlight int, maxWait time.Duration) *AdmissionController {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return &AdmissionController{
+		slots:       make(chan struct{}, maxInFlight),
+		maxWait:     maxWait,
+		serviceTime: initialServiceTime,
+	}
+}
+
+// Middleware returns an HTTP middleware that applies admission control to the next handler.
+func (a *AdmissionController) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !a.acquire(req) {
+			a.rejected.Add(1)
+			res.Header().Set("Retry-After", strconv.Itoa(a.retryAfter()))
+			http.Error(res, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		defer a.release()
+
+		start := time.Now()
+		next.ServeHTTP(res, req)
+		a.observe(time.Since(start))
+	})
+}
+
+func (a *AdmissionController) acquire(req *http.Request) bool {
+	select {
+	case a.slots <- struct{}{}:
+		a.inFlight.Add(1)
+		return true
+	default:
+	}
+	if a.maxWait <= 0 {
+		return false
+	}
+
+	a.queued.Add(1)
+	defer a.queued.Add(-1)
+	timer := time.NewTimer(a.maxWait)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		a.inFlight.Add(1)
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (a *AdmissionController) release() {
+	a.inFlight.Add(-1)
+	<-a.slots
+}
+
+func (a *AdmissionController) observe(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.serviceTime = time.Duration(serviceTimeWeight*float64(d) + (1-serviceTimeWeight)*float64(a.serviceTime))
+}
+
+// retryAfter estimates in seconds how long it takes to drain the current queue.
+func (a *AdmissionController) retryAfter() int {
+	a.mu.Lock()
+	serviceTime := a.serviceTime
+	a.mu.Unlock()
+
+	pending := float64(a.queued.Load()+a.inFlight.Load()) + 1
+	drain := pending * serviceTime.Seconds() / float64(cap(a.slots))
+	return int(math.Max(1, math.Ceil(drain)))
+}
+
+// SelfMetrics returns the current load of the controller. Rejections are reported
+// as a counter of requests rejected since the last call.
+func (a *AdmissionController) SelfMetrics() []*metrics.Metrics {
+	inFlight := metrics.NewGauge("AdmissionInFlight", float64(a.inFlight.Load()))
+	queued := metrics.NewGauge("AdmissionQueued", float64(a.queued.Load()))
+	rejected := metrics.NewCounter("AdmissionRejected", a.rejected.Swap(0))
+	return []*metrics.Metrics{&inFlight, &queued, &rejected}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionController_Middleware(t *testing.T) {
+	ac := NewAdmissionController(1, 10*time.Millisecond)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := ac.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	first := httptest.NewRecorder()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handler.ServeHTTP(first, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	}()
+	<-started
+
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, second.Code)
+	assert.Equal(t, "1", second.Header().Get("Retry-After"))
+
+	selfMetrics := ac.SelfMetrics()
+	assert.Equal(t, 1.0, *selfMetrics[0].Value)
+	assert.Equal(t, int64(1), *selfMetrics[2].Delta)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, http.StatusOK, first.Code)
+
+	selfMetrics = ac.SelfMetrics()
+	assert.Equal(t, 0.0, *selfMetrics[0].Value)
+	assert.Equal(t, int64(0), *selfMetrics[2].Delta)
+}
+
+func TestAdmissionController_Queue(t *testing.T) {
+	ac := NewAdmissionController(1, time.Second)
+	handler := ac.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/update/", nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for _, code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+}
+
+func TestAdmissionController_retryAfter(t *testing.T) {
+	ac := NewAdmissionController(2, 0)
+	ac.serviceTime = 3 * time.Second
+	ac.queued.Store(3)
+
+	// four pending requests served by two slots take six seconds
+	assert.Equal(t, 6, ac.retryAfter())
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+// Statuses of the metrics of a batch update.
+const (
+	// batchUpdated is the status of a metric applied by the storage.
+	batchUpdated = "updated"
+	// batchAccepted is the status of a metric journaled until the storage is available.
+	batchAccepted = "accepted"
+	// batchInvalid is the status of a metric with no name, an unsupported type or no value.
+	batchInvalid = "invalid"
+	// batchConflict is the status of a metric whose name is used by another type.
+	batchConflict = "conflict"
+	// batchSkipped is the status of a valid metric of a rejected atomic batch.
+	batchSkipped = "skipped"
+)
+
+// batchResult is the result of a metric of a batch update. The results are listed in
+// the order of the batch.
+type batchResult struct {
+	ID     string `json:"id"`
+	MType  string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchUpdate holds the metrics of a batch update and their results.
+type batchUpdate struct {
+	batch   []*metrics.Metrics
+	results []batchResult
+	// valid holds the metrics that passed the validation.
+	valid   []*metrics.Metrics
+	invalid int
+}
+
+// newBatchUpdate validates the metrics of the batch.
+func newBatchUpdate(batch []*metrics.Metrics) *batchUpdate {
+	u := &batchUpdate{batch: batch, results: make([]batchResult, len(batch))}
+	for i, metric := range batch {
+		if metric != nil {
+			u.results[i].ID = metric.ID
+			u.results[i].MType = metric.MType
+		}
+		if err := storage.ValidateMetric(metric); err != nil {
+			u.results[i].Status = batchInvalid
+			u.results[i].Error = err.Error()
+			u.invalid++
+			continue
+		}
+		u.valid = append(u.valid, metric)
+	}
+	return u
+}
+
+// resolve sets the status of the valid metrics: the ones named by the metric errors
+// are conflicts, the others get the status.
+func (u *batchUpdate) resolve(metricErrs []*storage.MetricError, status string) int {
+	conflicts := make(map[string]string, len(metricErrs))
+	for _, metricErr := range metricErrs {
+		conflicts[storage.MetricKey(metricErr.MType, metricErr.ID)] = metricErr.Error()
+	}
+	for i, metric := range u.batch {
+		if u.results[i].Status == batchInvalid {
+			continue
+		}
+		if message, ok := conflicts[storage.MetricKey(metric.MType, metric.ID)]; ok {
+			u.results[i].Status = batchConflict
+			u.results[i].Error = message
+			continue
+		}
+		u.results[i].Status = status
+	}
+	return len(conflicts)
+}
+
+// write responds with the results of the batch.
+func (u *batchUpdate) write(res http.ResponseWriter, status int) {
+	jsonResponse, err := json.Marshal(u.results)
+	if err != nil {
+		http.Error(res, "Error marshaling JSON", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if _, err = res.Write(jsonResponse); err != nil {
+		logger.Sugar.Errorf("Error writing JSON response: %v", err)
+	}
+}
+
+// updateBatch applies the valid metrics of the batch and responds with 200 if every
+// metric is updated and 207 if only some are written, so the client does not send the
+// written ones again. If none is written, it responds with 400 if some are invalid and
+// 409 if some conflict with the stored ones.
+func updateBatch(ctx context.Context, res http.ResponseWriter, s Storage, u *batchUpdate) {
+	status := batchUpdated
+	var metricErrs []*storage.MetricError
+	if len(u.valid) > 0 {
+		var err error
+		metricErrs, err = storage.MetricErrors(s.UpdateMetrics(ctx, u.valid))
+		if err != nil && storageErrorStatus(err) != http.StatusAccepted {
+			writeStorageError(res, "Error updating metrics", err)
+			return
+		}
+		if err != nil {
+			status = batchAccepted
+		}
+	}
+	conflicts := u.resolve(metricErrs, status)
+	written := 0
+	for _, result := range u.results {
+		if result.Status == status {
+			written++
+		}
+	}
+
+	switch {
+	case written > 0 && (u.invalid > 0 || conflicts > 0):
+		u.write(res, http.StatusMultiStatus)
+	case u.invalid > 0:
+		u.write(res, http.StatusBadRequest)
+	case conflicts > 0:
+		u.write(res, http.StatusConflict)
+	case status == batchAccepted:
+		u.write(res, http.StatusAccepted)
+	default:
+		u.write(res, http.StatusOK)
+	}
+}
+
+// updateBatchAtomic applies every metric of the batch or none of them. It responds
+// with 422 if an invalid or conflicting metric rejects the batch.
+func updateBatchAtomic(ctx context.Context, res http.ResponseWriter, s Storage, u *batchUpdate) {
+	if u.invalid > 0 {
+		u.resolve(nil, batchSkipped)
+		u.write(res, http.StatusUnprocessableEntity)
+		return
+	}
+	updater, ok := s.(storage.AtomicUpdater)
+	if !ok {
+		writeStorageError(res, "Error updating metrics", fmt.Errorf("%w by the storage", storage.ErrAtomicUnsupported))
+		return
+	}
+	metricErrs, err := storage.MetricErrors(updater.UpdateMetricsAtomic(ctx, u.valid))
+	if err != nil {
+		writeStorageError(res, "Error updating metrics", err)
+		return
+	}
+	if len(metricErrs) > 0 {
+		u.resolve(metricErrs, batchSkipped)
+		u.write(res, http.StatusUnprocessableEntity)
+		return
+	}
+	u.resolve(nil, batchUpdated)
+	u.write(res, http.StatusOK)
+}
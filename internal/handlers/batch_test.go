@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+	"github.com/evgfitil/go-metrics-server.git/internal/mocks"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+func TestUpdateMetricsCollection_Results(t *testing.T) {
+	logger.InitLogger()
+	const batch = `[
+		{"id": "PollCount", "type": "counter", "delta": 1},
+		{"id": "Alloc", "type": "counter", "delta": 1},
+		{"id": "HeapAlloc", "type": "gauge"},
+		null,
+		{"id": "Sys", "type": "gauge", "value": 2.5}
+	]`
+
+	tests := []struct {
+		name        string
+		query       string
+		body        string
+		statusCode  int
+		wantResults []batchResult
+		// wantStored is the number of metrics stored after the request.
+		wantStored int
+	}{
+		{
+			name:       "the valid metrics are applied",
+			body:       batch,
+			statusCode: http.StatusMultiStatus,
+			wantResults: []batchResult{
+				{ID: "PollCount", MType: "counter", Status: batchUpdated},
+				{ID: "Alloc", MType: "counter", Status: batchConflict, Error: "metric type mismatch: Alloc is stored as gauge"},
+				{ID: "HeapAlloc", MType: "gauge", Status: batchInvalid, Error: "invalid metric: gauge HeapAlloc has no value"},
+				{Status: batchInvalid, Error: "invalid metric: missing metric name"},
+				{ID: "Sys", MType: "gauge", Status: batchUpdated},
+			},
+			wantStored: 3,
+		},
+		{
+			name:       "conflicts",
+			body:       `[{"id": "Alloc", "type": "counter", "delta": 1}, {"id": "Sys", "type": "gauge", "value": 2.5}]`,
+			statusCode: http.StatusMultiStatus,
+			wantResults: []batchResult{
+				{ID: "Alloc", MType: "counter", Status: batchConflict, Error: "metric type mismatch: Alloc is stored as gauge"},
+				{ID: "Sys", MType: "gauge", Status: batchUpdated},
+			},
+			wantStored: 2,
+		},
+		{
+			name:       "nothing written because of invalid metrics",
+			body:       `[{"id": "Alloc", "type": "counter", "delta": 1}, {"id": "HeapAlloc", "type": "gauge"}]`,
+			statusCode: http.StatusBadRequest,
+			wantResults: []batchResult{
+				{ID: "Alloc", MType: "counter", Status: batchConflict, Error: "metric type mismatch: Alloc is stored as gauge"},
+				{ID: "HeapAlloc", MType: "gauge", Status: batchInvalid, Error: "invalid metric: gauge HeapAlloc has no value"},
+			},
+			wantStored: 1,
+		},
+		{
+			name:       "nothing written because of conflicts",
+			body:       `[{"id": "Alloc", "type": "counter", "delta": 1}]`,
+			statusCode: http.StatusConflict,
+			wantResults: []batchResult{
+				{ID: "Alloc", MType: "counter", Status: batchConflict, Error: "metric type mismatch: Alloc is stored as gauge"},
+			},
+			wantStored: 1,
+		},
+		{
+			name:       "an invalid metric rejects an atomic batch",
+			query:      "?atomic=true",
+			body:       `[{"id": "PollCount", "type": "counter", "delta": 1}, {"id": "HeapAlloc", "type": "histogram", "value": 1}]`,
+			statusCode: http.StatusUnprocessableEntity,
+			wantResults: []batchResult{
+				{ID: "PollCount", MType: "counter", Status: batchSkipped},
+				{ID: "HeapAlloc", MType: "histogram", Status: batchInvalid, Error: `invalid metric: unsupported type "histogram" of metric HeapAlloc`},
+			},
+			wantStored: 1,
+		},
+		{
+			name:       "a conflict rejects an atomic batch",
+			query:      "?atomic=true",
+			body:       `[{"id": "PollCount", "type": "counter", "delta": 1}, {"id": "Alloc", "type": "counter", "delta": 1}]`,
+			statusCode: http.StatusUnprocessableEntity,
+			wantResults: []batchResult{
+				{ID: "PollCount", MType: "counter", Status: batchSkipped},
+				{ID: "Alloc", MType: "counter", Status: batchConflict, Error: "metric type mismatch: Alloc is stored as gauge"},
+			},
+			wantStored: 1,
+		},
+		{
+			name:       "atomic batch",
+			query:      "?atomic=1",
+			body:       `[{"id": "PollCount", "type": "counter", "delta": 1}, {"id": "Sys", "type": "gauge", "value": 2.5}]`,
+			statusCode: http.StatusOK,
+			wantResults: []batchResult{
+				{ID: "PollCount", MType: "counter", Status: batchUpdated},
+				{ID: "Sys", MType: "gauge", Status: batchUpdated},
+			},
+			wantStored: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storage.NewMemStorageWithKeyMode(storage.KeyModeStrict)
+			require.NoError(t, s.Update(context.Background(), &metrics.Metrics{ID: "Alloc", MType: "gauge", Value: Float64Ptr(1)}))
+
+			req := httptest.NewRequest(http.MethodPost, "/updates/"+tt.query, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			UpdateMetricsCollection(s).ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.statusCode, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			var results []batchResult
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &results))
+			assert.Equal(t, tt.wantResults, results)
+
+			allMetrics, err := s.GetAllMetrics(context.Background())
+			require.NoError(t, err)
+			assert.Len(t, allMetrics, tt.wantStored)
+		})
+	}
+}
+
+func TestUpdateMetricsCollection_StorageErrors(t *testing.T) {
+	logger.InitLogger()
+	const body = `[{"id": "PollCount", "type": "counter", "delta": 1}]`
+
+	tests := []struct {
+		name       string
+		query      string
+		storage    func(ctrl *gomock.Controller) Storage
+		statusCode int
+	}{
+		{
+			name:  "invalid atomic parameter",
+			query: "?atomic=maybe",
+			storage: func(ctrl *gomock.Controller) Storage {
+				return mocks.NewMockStorage(ctrl)
+			},
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:  "atomic batches unsupported",
+			query: "?atomic=true",
+			storage: func(ctrl *gomock.Controller) Storage {
+				return mocks.NewMockStorage(ctrl)
+			},
+			statusCode: http.StatusNotImplemented,
+		},
+		{
+			name: "journaled",
+			storage: func(ctrl *gomock.Controller) Storage {
+				mockStorage := mocks.NewMockStorage(ctrl)
+				mockStorage.EXPECT().UpdateMetrics(gomock.Any(), gomock.Any()).Return(storage.ErrJournaled)
+				return mockStorage
+			},
+			statusCode: http.StatusAccepted,
+		},
+		{
+			name:  "atomic batches unsupported by the wrapped storage",
+			query: "?atomic=true",
+			storage: func(ctrl *gomock.Controller) Storage {
+				return storage.NewWatchableStorage(mocks.NewMockStorage(ctrl), 0)
+			},
+			statusCode: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			req := httptest.NewRequest(http.MethodPost, "/updates/"+tt.query, strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			UpdateMetricsCollection(tt.storage(ctrl)).ServeHTTP(rec, req)
+			assert.Equal(t, tt.statusCode, rec.Code)
+		})
+	}
+}
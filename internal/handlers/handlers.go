@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -17,14 +18,16 @@ import (
 
 	"github.com/evgfitil/go-metrics-server.git/internal/logger"
 	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
 )
 
 // Storage defines the interface for a metrics storage system.
+// Its errors are expected to wrap the errors of the storage package.
 type Storage interface {
-	Get(ctx context.Context, metricName, metricType string) (*metrics.Metrics, bool)
-	GetAllMetrics(ctx context.Context) map[string]*metrics.Metrics
+	Get(ctx context.Context, metricName, metricType string) (*metrics.Metrics, error)
+	GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error)
 	Ping(ctx context.Context) error
-	Update(ctx context.Context, metric *metrics.Metrics)
+	Update(ctx context.Context, metric *metrics.Metrics) error
 	UpdateMetrics(ctx context.Context, metrics []*metrics.Metrics) error
 }
 
@@ -49,14 +52,45 @@ func decodeJSON(data []byte, v interface{}) error {
 
 func updateCounter(ctx context.Context, storage Storage, metricName string, metricValue int64) error {
 	metric := metrics.Metrics{ID: metricName, MType: "counter", Delta: &metricValue}
-	storage.Update(ctx, &metric)
-	return nil
+	return storage.Update(ctx, &metric)
 }
 
 func updateGauge(ctx context.Context, storage Storage, metricName string, metricValue float64) error {
 	metric := metrics.Metrics{ID: metricName, MType: "gauge", Value: &metricValue}
-	storage.Update(ctx, &metric)
-	return nil
+	return storage.Update(ctx, &metric)
+}
+
+// storageErrorStatus maps a storage error to the HTTP status code of the response.
+func storageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrTypeMismatch):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrInvalidMetric):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, storage.ErrJournaled):
+		return http.StatusAccepted
+	case errors.Is(err, storage.ErrAtomicUnsupported):
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+// writeStorageError responds with the status code matching the storage error.
+// A write journaled while the storage is unavailable is accepted with no body.
+func writeStorageError(res http.ResponseWriter, message string, err error) {
+	status := storageErrorStatus(err)
+	if status == http.StatusAccepted {
+		res.WriteHeader(status)
+		return
+	}
+	if status == http.StatusInternalServerError || status == http.StatusServiceUnavailable {
+		logger.Sugar.Errorf("%s: %v", message, err)
+	}
+	http.Error(res, message+": "+err.Error(), status)
 }
 
 // GetAllMetrics returns an HTTP handler that responds with all metrics in HTML format.
@@ -65,11 +99,15 @@ func GetAllMetrics(storage Storage) http.HandlerFunc {
 		requestContext, cancel := context.WithTimeout(req.Context(), requestTimeout)
 		defer cancel()
 
-		allMetrics := storage.GetAllMetrics(requestContext)
+		allMetrics, err := storage.GetAllMetrics(requestContext)
+		if err != nil {
+			writeStorageError(res, "Error retrieving metrics", err)
+			return
+		}
 
 		res.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-		_, err := fmt.Fprintf(res, "<html><body>\n")
+		_, err = fmt.Fprintf(res, "<html><body>\n")
 		if err != nil {
 			logger.Sugar.Errorf("Error writing initial response: %v", err)
 			http.Error(res, "Internal Server Error", http.StatusInternalServerError)
@@ -133,9 +171,9 @@ func GetMetricsJSON(storage Storage) http.HandlerFunc {
 			http.Error(res, "Unsupported metric type", http.StatusNotFound)
 			return
 		}
-		metric, ok := storage.Get(requestContext, metricName, metricType)
-		if !ok {
-			http.Error(res, "Metric not found", http.StatusNotFound)
+		metric, err := storage.Get(requestContext, metricName, metricType)
+		if err != nil {
+			writeStorageError(res, "Error retrieving metric", err)
 			return
 		}
 
@@ -168,9 +206,9 @@ func GetMetricsPlain(storage Storage) http.HandlerFunc {
 			http.Error(res, "Unsupported metric type", http.StatusNotFound)
 			return
 		}
-		metric, ok := storage.Get(requestContext, metricName, metricType)
-		if !ok {
-			http.Error(res, "Metric not found", http.StatusNotFound)
+		metric, err := storage.Get(requestContext, metricName, metricType)
+		if err != nil {
+			writeStorageError(res, "Error retrieving metric", err)
 			return
 		}
 		valueStr, err := metric.GetValueAsString()
@@ -222,7 +260,7 @@ func UpdateMetricsJSON(storage Storage) http.HandlerFunc {
 				return
 			}
 			if err := updateCounter(requestContext, storage, metricName, *metricValue); err != nil {
-				http.Error(res, "Error updating counter: "+err.Error(), http.StatusBadRequest)
+				writeStorageError(res, "Error updating counter", err)
 				return
 			}
 		case "gauge":
@@ -232,7 +270,7 @@ func UpdateMetricsJSON(storage Storage) http.HandlerFunc {
 				return
 			}
 			if err := updateGauge(requestContext, storage, metricName, *metricValue); err != nil {
-				http.Error(res, "Error updating gauge: "+err.Error(), http.StatusBadRequest)
+				writeStorageError(res, "Error updating gauge", err)
 				return
 			}
 		default:
@@ -240,9 +278,9 @@ func UpdateMetricsJSON(storage Storage) http.HandlerFunc {
 			return
 		}
 
-		updateMetric, ok := storage.Get(requestContext, metricName, metricType)
-		if !ok {
-			http.Error(res, "Error retrieving updated metric", http.StatusInternalServerError)
+		updateMetric, err := storage.Get(requestContext, metricName, metricType)
+		if err != nil {
+			writeStorageError(res, "Error retrieving updated metric", err)
 			return
 		}
 
@@ -263,11 +301,25 @@ func UpdateMetricsJSON(storage Storage) http.HandlerFunc {
 }
 
 // UpdateMetricsCollection returns an HTTP handler that updates multiple metrics with data from a JSON request body.
-func UpdateMetricsCollection(storage Storage) http.HandlerFunc {
+// It responds with the result of every metric: the valid ones are applied and the status
+// is 207 if some of the others are invalid or conflict with the stored metrics. If none
+// is written, it is 400 if some are invalid and 409 otherwise. With the
+// "atomic=true" query parameter a single invalid or conflicting metric rejects the whole
+// batch with 422 and nothing is written; the storage must implement storage.AtomicUpdater.
+func UpdateMetricsCollection(s Storage) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		requestContext, cancel := context.WithTimeout(req.Context(), requestTimeout)
 		defer cancel()
 
+		atomic := false
+		if value := req.URL.Query().Get("atomic"); value != "" {
+			var err error
+			if atomic, err = strconv.ParseBool(value); err != nil {
+				http.Error(res, "Invalid atomic parameter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
 		var incomingMetrics []*metrics.Metrics
 
 		if err := json.NewDecoder(req.Body).Decode(&incomingMetrics); err != nil {
@@ -279,8 +331,10 @@ func UpdateMetricsCollection(storage Storage) http.HandlerFunc {
 			http.Error(res, "empty input", http.StatusOK)
 			return
 		}
-		if err := storage.UpdateMetrics(requestContext, incomingMetrics); err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+		if atomic {
+			updateBatchAtomic(requestContext, res, s, newBatchUpdate(incomingMetrics))
+		} else {
+			updateBatch(requestContext, res, s, newBatchUpdate(incomingMetrics))
 		}
 	}
 }
@@ -303,7 +357,7 @@ func UpdateMetricsPlain(storage Storage) http.HandlerFunc {
 				return
 			}
 			if err := updateCounter(requestContext, storage, metricName, metricValue); err != nil {
-				http.Error(res, "Error updating counter: "+err.Error(), http.StatusBadRequest)
+				writeStorageError(res, "Error updating counter", err)
 				return
 			}
 		case "gauge":
@@ -313,7 +367,7 @@ func UpdateMetricsPlain(storage Storage) http.HandlerFunc {
 				return
 			}
 			if err := updateGauge(requestContext, storage, metricName, metricValue); err != nil {
-				http.Error(res, "Error updating gauge: "+err.Error(), http.StatusBadRequest)
+				writeStorageError(res, "Error updating gauge", err)
 				return
 			}
 		default:
@@ -323,14 +377,31 @@ func UpdateMetricsPlain(storage Storage) http.HandlerFunc {
 	}
 }
 
+// storageStatusHeader is the header of a successful ping response telling whether the
+// storage is "ok" or "degraded".
+const storageStatusHeader = "X-Storage-Status"
+
 // Ping returns an HTTP handler that checks the connectivity to the storage system.
-func Ping(storage Storage) http.HandlerFunc {
+// It sets the X-Storage-Status header to "ok", or to "degraded" with the "degraded"
+// body while the storage journals writes because its backend is unavailable. Both
+// respond with 200, so health checks keep passing.
+func Ping(s Storage) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		err := storage.Ping(req.Context())
+		err := s.Ping(req.Context())
+		if errors.Is(err, storage.ErrDegraded) {
+			res.Header().Set(storageStatusHeader, "degraded")
+			res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			res.WriteHeader(http.StatusOK)
+			if _, err = fmt.Fprintln(res, "degraded"); err != nil {
+				logger.Sugar.Errorf("error writing ping response: %v", err)
+			}
+			return
+		}
 		if err != nil {
 			http.Error(res, "database connection failed", http.StatusInternalServerError)
 			return
 		}
+		res.Header().Set(storageStatusHeader, "ok")
 		res.WriteHeader(http.StatusOK)
 	}
 }
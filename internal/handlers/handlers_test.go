@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -44,19 +45,22 @@ func Int64Ptr(i int64) *int64 {
 
 func createMockStorageWithMetrics(ctrl *gomock.Controller, mockMetrics map[string]*metrics.Metrics) *mocks.MockStorage {
 	mockStorage := mocks.NewMockStorage(ctrl)
-	mockStorage.EXPECT().GetAllMetrics(gomock.Any()).Return(mockMetrics)
+	mockStorage.EXPECT().GetAllMetrics(gomock.Any()).Return(mockMetrics, nil)
 	return mockStorage
 }
 
 func TestGetMetricsJsonHandler(t *testing.T) {
+	logger.InitLogger()
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockStorage := mocks.NewMockStorage(ctrl)
 	metricDelta := int64(100)
 	storedMetric := &metrics.Metrics{ID: "testCounter", MType: "counter", Delta: &metricDelta}
-	mockStorage.EXPECT().Get(gomock.Any(), "testCounter", "counter").Return(storedMetric, true).AnyTimes()
-	mockStorage.EXPECT().Get(gomock.Any(), "testTest", "counter").Return(nil, false).AnyTimes()
+	mockStorage.EXPECT().Get(gomock.Any(), "testCounter", "counter").Return(storedMetric, nil).AnyTimes()
+	mockStorage.EXPECT().Get(gomock.Any(), "testTest", "counter").Return(nil, storage.ErrNotFound).AnyTimes()
+	mockStorage.EXPECT().Get(gomock.Any(), "testGauge", "counter").Return(nil, storage.ErrTypeMismatch).AnyTimes()
+	mockStorage.EXPECT().Get(gomock.Any(), "testUnavailable", "counter").Return(nil, storage.ErrUnavailable).AnyTimes()
 
 	ts := httptest.NewServer(testMetricsRouter(mockStorage))
 	defer ts.Close()
@@ -108,6 +112,24 @@ func TestGetMetricsJsonHandler(t *testing.T) {
 				statusCode: http.StatusNotFound,
 			},
 		},
+		{
+			name:          "get metric with another type",
+			requestMethod: http.MethodPost,
+			requestPath:   "/value/",
+			requestBody:   metrics.Metrics{ID: "testGauge", MType: "counter"},
+			want: want{
+				statusCode: http.StatusConflict,
+			},
+		},
+		{
+			name:          "storage unavailable",
+			requestMethod: http.MethodPost,
+			requestPath:   "/value/",
+			requestBody:   metrics.Metrics{ID: "testUnavailable", MType: "counter"},
+			want: want{
+				statusCode: http.StatusServiceUnavailable,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -134,6 +156,7 @@ func TestGetMetricsJsonHandler(t *testing.T) {
 }
 
 func TestUpdateMetricsJsonHandler(t *testing.T) {
+	logger.InitLogger()
 	mockStorage := storage.NewMemStorage()
 
 	ts := httptest.NewServer(testMetricsRouter(mockStorage))
@@ -243,6 +266,7 @@ func TestUpdateMetricsJsonHandler(t *testing.T) {
 }
 
 func TestGetMetricsHandler(t *testing.T) {
+	logger.InitLogger()
 	mockStorage := storage.NewMemStorage()
 	mockMetricValue := int64(100)
 	mockMetric := metrics.Metrics{ID: "testCounter", MType: "counter", Delta: &mockMetricValue}
@@ -313,6 +337,7 @@ func TestGetMetricsHandler(t *testing.T) {
 }
 
 func TestUpdateMetricsHandler(t *testing.T) {
+	logger.InitLogger()
 	mockStorage := storage.NewMemStorage()
 
 	ts := httptest.NewServer(testMetricsRouter(mockStorage))
@@ -375,6 +400,22 @@ func TestUpdateMetricsHandler(t *testing.T) {
 				statusCode: http.StatusBadRequest,
 			},
 		},
+		{
+			name:          "NaN Gauge value",
+			requestMethod: http.MethodPost,
+			requestPath:   "/update/gauge/testGauge/NaN",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:          "infinite Gauge value",
+			requestMethod: http.MethodPost,
+			requestPath:   "/update/gauge/testGauge/+Inf",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -396,6 +437,7 @@ func TestUpdateMetricsHandler(t *testing.T) {
 }
 
 func TestGetAllMetrics(t *testing.T) {
+	logger.InitLogger()
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -445,18 +487,30 @@ func TestPing(t *testing.T) {
 	mockStorage := mocks.NewMockStorage(ctrl)
 
 	type want struct {
-		statusCode int
+		statusCode    int
+		storageStatus string
+		body          string
 	}
 	tests := []struct {
 		name           string
 		mockStorageErr error
 		want           want
 	}{
+		{
+			name:           "degraded",
+			mockStorageErr: storage.ErrDegraded,
+			want: want{
+				statusCode:    http.StatusOK,
+				storageStatus: "degraded",
+				body:          "degraded\n",
+			},
+		},
 		{
 			name:           "successful ping",
 			mockStorageErr: nil,
 			want: want{
-				statusCode: http.StatusOK,
+				statusCode:    http.StatusOK,
+				storageStatus: "ok",
 			},
 		},
 		{
@@ -480,11 +534,16 @@ func TestPing(t *testing.T) {
 			handler.ServeHTTP(rr, req)
 
 			assert.Equal(t, tt.want.statusCode, rr.Code)
+			assert.Equal(t, tt.want.storageStatus, rr.Header().Get("X-Storage-Status"))
+			if tt.want.body != "" {
+				assert.Equal(t, tt.want.body, rr.Body.String())
+			}
 		})
 	}
 }
 
 func TestUpdateMetricsCollection(t *testing.T) {
+	logger.InitLogger()
 	type want struct {
 		statusCode int
 	}
@@ -565,6 +624,25 @@ func TestUpdateMetricsCollection(t *testing.T) {
 				statusCode: http.StatusInternalServerError,
 			},
 		},
+		{
+			name: "storage unavailable",
+			storage: func(t *testing.T) Storage {
+				ctrl := gomock.NewController(t)
+				mockStorage := mocks.NewMockStorage(ctrl)
+				mockStorage.EXPECT().UpdateMetrics(gomock.Any(), gomock.Any()).Return(storage.ErrUnavailable).Times(1)
+				return mockStorage
+			},
+			body: func() []byte {
+				batchOfMetrics := []*metrics.Metrics{
+					{ID: "temp", MType: "gauge", Value: Float64Ptr(32.5)},
+				}
+				b, _ := json.Marshal(batchOfMetrics)
+				return b
+			}(),
+			want: want{
+				statusCode: http.StatusServiceUnavailable,
+			},
+		},
 		{
 			name: "empty input",
 			storage: func(t *testing.T) Storage {
@@ -580,9 +658,7 @@ func TestUpdateMetricsCollection(t *testing.T) {
 			name: "edge cases",
 			storage: func(t *testing.T) Storage {
 				ctrl := gomock.NewController(t)
-				mockStorage := mocks.NewMockStorage(ctrl)
-				mockStorage.EXPECT().UpdateMetrics(gomock.Any(), gomock.Any()).Return(nil).Times(1)
-				return mockStorage
+				return mocks.NewMockStorage(ctrl)
 			},
 			body: func() []byte {
 				batchOfMetrics := make([]*metrics.Metrics, 1000)
@@ -590,7 +666,7 @@ func TestUpdateMetricsCollection(t *testing.T) {
 				return b
 			}(),
 			want: want{
-				statusCode: http.StatusOK,
+				statusCode: http.StatusBadRequest,
 			},
 		},
 	}
@@ -609,3 +685,64 @@ func TestUpdateMetricsCollection(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateMetricsPlainStorageErrors(t *testing.T) {
+	logger.InitLogger()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	mockStorage.EXPECT().Update(gomock.Any(), &metrics.Metrics{ID: "conflict", MType: "counter", Delta: Int64Ptr(1)}).
+		Return(storage.ErrTypeMismatch)
+	mockStorage.EXPECT().Update(gomock.Any(), &metrics.Metrics{ID: "unavailable", MType: "gauge", Value: Float64Ptr(1)}).
+		Return(storage.ErrUnavailable)
+	mockStorage.EXPECT().Update(gomock.Any(), &metrics.Metrics{ID: "journaled", MType: "gauge", Value: Float64Ptr(1)}).
+		Return(storage.ErrJournaled)
+
+	ts := httptest.NewServer(testMetricsRouter(mockStorage))
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		requestPath string
+		statusCode  int
+	}{
+		{name: "type mismatch", requestPath: "/update/counter/conflict/1", statusCode: http.StatusConflict},
+		{name: "storage unavailable", requestPath: "/update/gauge/unavailable/1", statusCode: http.StatusServiceUnavailable},
+		{name: "journaled", requestPath: "/update/gauge/journaled/1", statusCode: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ts.Client().Post(ts.URL+tt.requestPath, "text/plain", nil)
+			require.NoError(t, err)
+			defer func() {
+				if err := resp.Body.Close(); err != nil {
+					logger.Sugar.Errorf("error closing response body: %v", err)
+				}
+			}()
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func Test_storageErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "not found", err: fmt.Errorf("%w: cpu", storage.ErrNotFound), want: http.StatusNotFound},
+		{name: "type mismatch", err: storage.ErrTypeMismatch, want: http.StatusConflict},
+		{name: "invalid metric", err: storage.ErrInvalidMetric, want: http.StatusBadRequest},
+		{name: "unavailable", err: errors.Join(storage.ErrUnavailable, errors.New("connection refused")), want: http.StatusServiceUnavailable},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: http.StatusServiceUnavailable},
+		{name: "journaled", err: storage.ErrJournaled, want: http.StatusAccepted},
+		{name: "journaled with invalid metrics", err: errors.Join(storage.ErrInvalidMetric, storage.ErrJournaled), want: http.StatusBadRequest},
+		{name: "unknown", err: errors.New("unknown"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, storageErrorStatus(tt.err))
+		})
+	}
+}
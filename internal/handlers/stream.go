@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+const (
+	// streamWriteTimeout is the time a stream client has to receive a message
+	// before it is disconnected.
+	streamWriteTimeout = 5 * time.Second
+	// streamHeartbeat is the interval of the keep-alive messages of an idle stream.
+	streamHeartbeat = 15 * time.Second
+)
+
+// Stream messages, their event names and the reasons a stream is closed by the server.
+const (
+	streamSnapshot = "snapshot"
+	streamUpdate   = "update"
+	streamClose    = "close"
+
+	closeSlowClient     = "client too slow"
+	closeStorageStopped = "storage closed"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// streamMessage is a message of a metric stream: the snapshot of the selected metrics,
+// the update of one of them or the reason the server closes the stream.
+type streamMessage struct {
+	Event   string              `json:"event"`
+	Metrics *[]*metrics.Metrics `json:"metrics,omitempty"`
+	Metric  *metrics.Metrics    `json:"metric,omitempty"`
+	Time    *time.Time          `json:"time,omitempty"`
+	Reason  string              `json:"reason,omitempty"`
+}
+
+// streamConn sends the messages of a stream over a transport.
+type streamConn interface {
+	send(message streamMessage) error
+	ping() error
+	close()
+}
+
+// sseConn sends the messages as Server-Sent Events named after the message event.
+type sseConn struct {
+	res http.ResponseWriter
+	rc  *http.ResponseController
+}
+
+func newSSEConn(res http.ResponseWriter) (*sseConn, error) {
+	c := &sseConn{res: res, rc: http.NewResponseController(res)}
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	return c, c.flush()
+}
+
+// flush sends the written data to the client within streamWriteTimeout.
+func (c *sseConn) flush() error {
+	err := c.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+func (c *sseConn) send(message streamMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(c.res, "event: %s\ndata: %s\n\n", message.Event, data); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+func (c *sseConn) ping() error {
+	if _, err := fmt.Fprint(c.res, ": ping\n\n"); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// close does nothing: the response ends when the handler returns.
+func (c *sseConn) close() {}
+
+// wsConn sends the messages as JSON text messages of a WebSocket connection.
+type wsConn struct {
+	conn *websocket.Conn
+	// reason is sent with the close frame.
+	reason string
+}
+
+func (c *wsConn) send(message streamMessage) error {
+	if message.Event == streamClose {
+		c.reason = message.Reason
+	}
+	if err := c.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return err
+	}
+	return c.conn.WriteJSON(message)
+}
+
+func (c *wsConn) ping() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+}
+
+func (c *wsConn) close() {
+	code := websocket.CloseNormalClosure
+	switch c.reason {
+	case closeSlowClient:
+		code = websocket.CloseTryAgainLater
+	case closeStorageStopped:
+		code = websocket.CloseGoingAway
+	}
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, c.reason), time.Now().Add(streamWriteTimeout))
+	c.conn.Close()
+}
+
+// snapshot returns the stored metrics selected by the filter, sorted by key.
+func snapshot(ctx context.Context, s Storage, filter storage.WatchFilter) ([]*metrics.Metrics, error) {
+	requestContext, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	allMetrics, err := s.GetAllMetrics(requestContext)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(allMetrics))
+	for key, metric := range allMetrics {
+		if filter.Match(metric) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	selected := make([]*metrics.Metrics, len(keys))
+	for i, key := range keys {
+		selected[i] = allMetrics[key]
+	}
+	return selected, nil
+}
+
+// Stream returns an HTTP handler that streams the metrics selected by the "name" glob
+// and the "type" query parameters: a snapshot first, then an update whenever one of
+// them changes. WebSocket upgrade requests receive JSON text messages, the others
+// Server-Sent Events. A client that cannot keep up with the updates is disconnected
+// and should reconnect to get a new snapshot. The storage must implement storage.Watcher.
+func Stream(s Storage) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		watcher, ok := s.(storage.Watcher)
+		if !ok {
+			http.Error(res, "metric streaming is not enabled", http.StatusNotImplemented)
+			return
+		}
+		query := req.URL.Query()
+		filter := storage.WatchFilter{Name: query.Get("name"), Type: query.Get("type")}
+		if err := filter.Validate(); err != nil {
+			http.Error(res, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		// the subscription starts before the snapshot is read, so no change is missed
+		sub, err := watcher.Watch(ctx, filter)
+		if err != nil {
+			writeStorageError(res, "Error watching metrics", err)
+			return
+		}
+		selected, err := snapshot(ctx, s, filter)
+		if err != nil {
+			writeStorageError(res, "Error retrieving metrics", err)
+			return
+		}
+
+		var conn streamConn
+		if websocket.IsWebSocketUpgrade(req) {
+			ws, err := upgrader.Upgrade(res, req, nil)
+			if err != nil {
+				// the upgrader has responded with the error
+				return
+			}
+			go func() {
+				// the client sends nothing, reading detects that it went away
+				defer cancel()
+				for {
+					if _, _, err := ws.NextReader(); err != nil {
+						return
+					}
+				}
+			}()
+			conn = &wsConn{conn: ws}
+		} else {
+			conn, err = newSSEConn(res)
+			if err != nil {
+				logger.Sugar.Errorf("error starting metric stream: %v", err)
+				return
+			}
+		}
+		defer conn.close()
+
+		if err = streamMetrics(ctx, conn, sub, selected); err != nil {
+			logger.Sugar.Infof("metric stream of %s ended: %v", req.RemoteAddr, err)
+		}
+	}
+}
+
+// streamMetrics sends the snapshot and the updates of the subscription until the
+// context is done, the client fails to receive a message or misses an update.
+func streamMetrics(ctx context.Context, conn streamConn, sub *storage.Subscription, selected []*metrics.Metrics) error {
+	if err := conn.send(streamMessage{Event: streamSnapshot, Metrics: &selected}); err != nil {
+		return err
+	}
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-sub.Events():
+			if !ok {
+				return conn.send(streamMessage{Event: streamClose, Reason: closeStorageStopped})
+			}
+			if dropped := sub.Dropped(); dropped > 0 {
+				if err := conn.send(streamMessage{Event: streamClose, Reason: closeSlowClient}); err != nil {
+					return err
+				}
+				return fmt.Errorf("%s, dropped %d updates", closeSlowClient, dropped)
+			}
+			if err := conn.send(streamMessage{Event: streamUpdate, Metric: event.New, Time: &event.Time}); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if err := conn.ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
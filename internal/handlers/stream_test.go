@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+	"github.com/evgfitil/go-metrics-server.git/internal/mocks"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+// readEvent reads the next Server-Sent Event, skipping the comments.
+func readEvent(t *testing.T, r *bufio.Reader) (string, streamMessage) {
+	t.Helper()
+	var event string
+	var message streamMessage
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &message))
+		case line == "" && event != "":
+			return event, message
+		}
+	}
+}
+
+func newTestStream(t *testing.T, bufferSize int) (*storage.WatchableStorage, *httptest.Server) {
+	logger.InitLogger()
+	s := storage.NewWatchableStorage(storage.NewMemStorage(), bufferSize)
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.UpdateMetrics(context.Background(), []*metrics.Metrics{
+		{ID: "HeapAlloc", MType: "gauge", Value: Float64Ptr(1)},
+		{ID: "HeapInuse", MType: "gauge", Value: Float64Ptr(2)},
+		{ID: "PollCount", MType: "counter", Delta: Int64Ptr(1)},
+	}))
+	ts := httptest.NewServer(Stream(s))
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func TestStream_Errors(t *testing.T) {
+	logger.InitLogger()
+	ctrl := gomock.NewController(t)
+	mockStorage := mocks.NewMockStorage(ctrl)
+
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	rec := httptest.NewRecorder()
+	Stream(mockStorage).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+
+	_, ts := newTestStream(t, 0)
+	for _, query := range []string{"?name=[a", "?type=histogram"} {
+		res, err := http.Get(ts.URL + query)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, query)
+	}
+}
+
+func TestStream_SSE(t *testing.T) {
+	s, ts := newTestStream(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"?name=Heap*&type=gauge", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	body := bufio.NewReader(res.Body)
+
+	event, message := readEvent(t, body)
+	assert.Equal(t, streamSnapshot, event)
+	require.NotNil(t, message.Metrics)
+	assert.Equal(t, []*metrics.Metrics{
+		{ID: "HeapAlloc", MType: "gauge", Value: Float64Ptr(1)},
+		{ID: "HeapInuse", MType: "gauge", Value: Float64Ptr(2)},
+	}, *message.Metrics)
+
+	require.NoError(t, s.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: Int64Ptr(1)},
+		{ID: "Alloc", MType: "gauge", Value: Float64Ptr(3)},
+		{ID: "HeapAlloc", MType: "gauge", Value: Float64Ptr(4)},
+	}))
+	event, message = readEvent(t, body)
+	assert.Equal(t, streamUpdate, event)
+	assert.Equal(t, &metrics.Metrics{ID: "HeapAlloc", MType: "gauge", Value: Float64Ptr(4)}, message.Metric)
+	assert.NotNil(t, message.Time)
+
+	// the stream ends when the storage is closed
+	require.NoError(t, s.Close())
+	event, message = readEvent(t, body)
+	assert.Equal(t, streamClose, event)
+	assert.Equal(t, closeStorageStopped, message.Reason)
+}
+
+func TestStream_WebSocket(t *testing.T) {
+	s, ts := newTestStream(t, 0)
+	ctx := context.Background()
+
+	conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"?type=counter", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+	var message streamMessage
+	require.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, streamSnapshot, message.Event)
+	require.NotNil(t, message.Metrics)
+	assert.Equal(t, []*metrics.Metrics{{ID: "PollCount", MType: "counter", Delta: Int64Ptr(1)}}, *message.Metrics)
+
+	require.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "PollCount", MType: "counter", Delta: Int64Ptr(2)}))
+	require.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, streamUpdate, message.Event)
+	assert.Equal(t, &metrics.Metrics{ID: "PollCount", MType: "counter", Delta: Int64Ptr(3)}, message.Metric)
+
+	require.NoError(t, s.Close())
+	require.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, streamClose, message.Event)
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.True(t, errors.As(err, &closeErr))
+	assert.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+}
+
+// recordingConn records the messages of a stream.
+type recordingConn struct {
+	messages []streamMessage
+}
+
+func (c *recordingConn) send(message streamMessage) error {
+	c.messages = append(c.messages, message)
+	return nil
+}
+
+func (c *recordingConn) ping() error { return nil }
+
+func (c *recordingConn) close() {}
+
+func Test_streamMetrics_SlowClient(t *testing.T) {
+	logger.InitLogger()
+	s := storage.NewWatchableStorage(storage.NewMemStorage(), 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	sub, err := s.Watch(ctx, storage.WatchFilter{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "PollCount", MType: "counter", Delta: Int64Ptr(1)}))
+	}
+
+	// the client missed updates, so it is disconnected instead of sent the next one
+	conn := &recordingConn{}
+	err = streamMetrics(ctx, conn, sub, nil)
+	assert.ErrorContains(t, err, "dropped 2 updates")
+	require.Len(t, conn.messages, 2)
+	assert.Equal(t, streamSnapshot, conn.messages[0].Event)
+	assert.Equal(t, streamMessage{Event: streamClose, Reason: closeSlowClient}, conn.messages[1])
+}
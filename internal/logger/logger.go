@@ -4,6 +4,9 @@
 package logger
 
 import (
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
 	"time"
 
@@ -35,6 +38,30 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 	r.responseData.status = statusCode
 }
 
+// Flush sends the buffered data to the client, as required by streaming responses.
+func (r *loggingResponseWriter) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection, as required by WebSocket upgrades.
+func (r *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("logger: http.Hijacker is unavailable on the writer")
+	}
+	if r.responseData.status == 0 {
+		r.responseData.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (r *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func InitLogger() {
 	logger, err := zap.NewDevelopment()
 	if err != nil {
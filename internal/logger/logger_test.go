@@ -162,6 +162,22 @@ func Test_loggingResponseWriter_WriteHeader(t *testing.T) {
 	}
 }
 
+func Test_loggingResponseWriter_Streaming(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := &loggingResponseWriter{ResponseWriter: rec, responseData: &responseData{}}
+
+	r.Flush()
+	if !rec.Flushed {
+		t.Errorf("Flush() did not flush the wrapped writer")
+	}
+	if _, _, err := r.Hijack(); err == nil {
+		t.Errorf("Hijack() error = nil, want an error for a writer that cannot be hijacked")
+	}
+	if http.NewResponseController(r).Flush() != nil {
+		t.Errorf("ResponseController cannot unwrap the writer")
+	}
+}
+
 func captureLogs(f func()) string {
 	var buf bytes.Buffer
 	writer := zapcore.AddSync(&buf)
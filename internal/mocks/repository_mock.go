@@ -56,11 +56,11 @@ func (mr *MockStorageMockRecorder) Close() *gomock.Call {
 }
 
 // Get mocks base method.
-func (m *MockStorage) Get(ctx context.Context, metricName, metricType string) (*metrics.Metrics, bool) {
+func (m *MockStorage) Get(ctx context.Context, metricName, metricType string) (*metrics.Metrics, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Get", ctx, metricName, metricType)
 	ret0, _ := ret[0].(*metrics.Metrics)
-	ret1, _ := ret[1].(bool)
+	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
@@ -71,11 +71,12 @@ func (mr *MockStorageMockRecorder) Get(ctx, metricName, metricType any) *gomock.
 }
 
 // GetAllMetrics mocks base method.
-func (m *MockStorage) GetAllMetrics(ctx context.Context) map[string]*metrics.Metrics {
+func (m *MockStorage) GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetAllMetrics", ctx)
 	ret0, _ := ret[0].(map[string]*metrics.Metrics)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // GetAllMetrics indicates an expected call of GetAllMetrics.
@@ -113,9 +114,11 @@ func (mr *MockStorageMockRecorder) SaveMetrics(ctx any) *gomock.Call {
 }
 
 // Update mocks base method.
-func (m *MockStorage) Update(ctx context.Context, metric *metrics.Metrics) {
+func (m *MockStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Update", ctx, metric)
+	ret := m.ctrl.Call(m, "Update", ctx, metric)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // Update indicates an expected call of Update.
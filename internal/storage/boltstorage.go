@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+const (
+	// defaultBoltTimeout is how long opening waits for the file lock held by another process.
+	defaultBoltTimeout = time.Second
+	// compactTxMaxSize is the number of bytes copied in one transaction during compaction.
+	compactTxMaxSize = 1 << 20
+)
+
+// boltBuckets holds the name of the bucket of every metric type.
+var boltBuckets = map[string][]byte{
+	"counter": []byte("counter"),
+	"gauge":   []byte("gauge"),
+}
+
+func init() {
+	Register("bolt", openBoltStorage)
+}
+
+// openBoltStorage opens a BoltStorage from a URL of the form
+// "bolt:///path/to/metrics.db?timeout=1s". The timeout limits waiting for
+// the lock of a file opened by another process.
+func openBoltStorage(u *url.URL, opts Options) (Storage, error) {
+	if err := checkParams(u, "timeout"); err != nil {
+		return nil, err
+	}
+	path := u.Host + u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, errors.New("bolt storage requires a path")
+	}
+	timeout := defaultBoltTimeout
+	if value := u.Query().Get("timeout"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout %q of bolt storage", value)
+		}
+	}
+	return NewBoltStorage(path, timeout, opts.KeyMode)
+}
+
+// BoltStorage stores metrics in an embedded bbolt database with a bucket per metric type.
+// Every update is a single crash-safe transaction.
+type BoltStorage struct {
+	db      *bolt.DB
+	keyMode KeyMode
+}
+
+// NewBoltStorage opens the database file at path, creating it and the buckets if needed.
+func NewBoltStorage(path string, timeout time.Duration, keyMode KeyMode) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("error opening bolt database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if closeErr := db.Close(); closeErr != nil {
+			logger.Sugar.Errorf("error closing bolt database: %v", closeErr)
+		}
+		return nil, fmt.Errorf("error creating bolt buckets: %w", err)
+	}
+	return &BoltStorage{db: db, keyMode: keyMode}, nil
+}
+
+// CompactBolt rewrites the bbolt database file at path without the free pages and
+// returns the file sizes before and after. The database must not be open. A compacted
+// copy left by an interrupted run is removed first.
+func CompactBolt(path string, timeout time.Duration) (int64, int64, error) {
+	before, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	src, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout, ReadOnly: true})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error opening bolt database: %w", err)
+	}
+	defer src.Close()
+
+	tmpPath := path + ".compact"
+	if err = os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, 0, fmt.Errorf("error removing stale compacted database: %w", err)
+	}
+	dst, err := bolt.Open(tmpPath, before.Mode(), &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error creating compacted database: %w", err)
+	}
+	if err = bolt.Compact(dst, src, compactTxMaxSize); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return 0, 0, fmt.Errorf("error compacting bolt database: %w", err)
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return 0, 0, err
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return before.Size(), after.Size(), nil
+}
+
+// classifyBoltError wraps bbolt errors into the storage errors.
+func classifyBoltError(err error) error {
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) || errors.Is(err, bolt.ErrTimeout) || errors.Is(err, bolt.ErrTxClosed) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
+
+func encodeCounter(delta int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(delta))
+}
+
+func encodeGauge(value float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(value))
+}
+
+// decodeMetric decodes a stored value of the metric type.
+func decodeMetric(metricType string, name, value []byte) (*metrics.Metrics, error) {
+	if len(value) != 8 {
+		return nil, fmt.Errorf("corrupted %s %s: value of %d bytes", metricType, name, len(value))
+	}
+	metric := &metrics.Metrics{ID: string(name), MType: metricType}
+	bits := binary.BigEndian.Uint64(value)
+	if metricType == "counter" {
+		delta := int64(bits)
+		metric.Delta = &delta
+	} else {
+		v := math.Float64frombits(bits)
+		metric.Value = &v
+	}
+	return metric, nil
+}
+
+// update applies a metric within a write transaction.
+func (b *BoltStorage) update(tx *bolt.Tx, metric *metrics.Metrics) error {
+	if err := ValidateMetric(metric); err != nil {
+		return err
+	}
+	if err := b.conflict(tx, metric.ID, metric.MType); err != nil {
+		return err
+	}
+
+	bucket := tx.Bucket(boltBuckets[metric.MType])
+	key := []byte(metric.ID)
+	if metric.MType == "gauge" {
+		return bucket.Put(key, encodeGauge(*metric.Value))
+	}
+	delta := *metric.Delta
+	if stored := bucket.Get(key); stored != nil {
+		old, err := decodeMetric(metric.MType, key, stored)
+		if err != nil {
+			return err
+		}
+		delta += *old.Delta
+	}
+	return bucket.Put(key, encodeCounter(delta))
+}
+
+// conflict returns ErrTypeMismatch if the key mode is strict and the name is used
+// by a metric of another type.
+func (b *BoltStorage) conflict(tx *bolt.Tx, metricName, metricType string) error {
+	if b.keyMode != KeyModeStrict {
+		return nil
+	}
+	if tx.Bucket(boltBuckets[otherType(metricType)]).Get([]byte(metricName)) != nil {
+		return typeMismatch(metricName, metricType)
+	}
+	return nil
+}
+
+func (b *BoltStorage) Update(_ context.Context, metric *metrics.Metrics) error {
+	var updateErr error
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		updateErr = b.update(tx, metric)
+		if errors.Is(updateErr, ErrInvalidMetric) || errors.Is(updateErr, ErrTypeMismatch) {
+			return nil
+		}
+		return updateErr
+	})
+	if err != nil {
+		logger.Sugar.Errorf("error updating metric: %v", err)
+		return classifyBoltError(err)
+	}
+	return updateErr
+}
+
+func (b *BoltStorage) Get(_ context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	if err := validateType(metricType); err != nil {
+		return nil, err
+	}
+	var metric *metrics.Metrics
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltBuckets[metricType]).Get([]byte(metricName))
+		if value == nil {
+			if err := b.conflict(tx, metricName, metricType); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %s %s", ErrNotFound, metricType, metricName)
+		}
+		var err error
+		metric, err = decodeMetric(metricType, []byte(metricName), value)
+		return err
+	})
+	if err != nil {
+		return nil, classifyBoltError(err)
+	}
+	return metric, nil
+}
+
+func (b *BoltStorage) GetAllMetrics(_ context.Context) (map[string]*metrics.Metrics, error) {
+	allMetrics := make(map[string]*metrics.Metrics)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for metricType, name := range boltBuckets {
+			err := tx.Bucket(name).ForEach(func(k, v []byte) error {
+				metric, err := decodeMetric(metricType, k, v)
+				if err != nil {
+					return err
+				}
+				allMetrics[MetricKey(metricType, metric.ID)] = metric
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, classifyBoltError(err)
+	}
+	return allMetrics, nil
+}
+
+// UpdateMetrics applies every valid metric of the batch in a single transaction and
+// returns the joined errors of the invalid and conflicting metrics.
+func (b *BoltStorage) UpdateMetrics(_ context.Context, batchOfMetrics []*metrics.Metrics) error {
+	var invalid []error
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		invalid = invalid[:0]
+		for _, metric := range batchOfMetrics {
+			err := b.update(tx, metric)
+			if errors.Is(err, ErrInvalidMetric) || errors.Is(err, ErrTypeMismatch) {
+				invalid = append(invalid, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Sugar.Errorf("error updating metrics: %v", err)
+		return classifyBoltError(err)
+	}
+	return errors.Join(invalid...)
+}
+
+// UpdateMetricsAtomic applies every metric of the batch in a single transaction, or none
+// of them if any is invalid or conflicting.
+func (b *BoltStorage) UpdateMetricsAtomic(_ context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := validateBatch(batchOfMetrics, b.keyMode); err != nil {
+		return err
+	}
+	var rejected error
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var conflicts []error
+		for _, metric := range batchOfMetrics {
+			if err := b.conflict(tx, metric.ID, metric.MType); err != nil {
+				conflicts = append(conflicts, err)
+			}
+		}
+		if rejected = errors.Join(conflicts...); rejected != nil {
+			// rolls the transaction back
+			return rejected
+		}
+		for _, metric := range batchOfMetrics {
+			if err := b.update(tx, metric); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if rejected != nil {
+		return rejected
+	}
+	if err != nil {
+		logger.Sugar.Errorf("error updating metrics: %v", err)
+		return classifyBoltError(err)
+	}
+	return nil
+}
+
+// Ping checks that the database is open and holds the metric buckets.
+func (b *BoltStorage) Ping(_ context.Context) error {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for metricType, name := range boltBuckets {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket of %s metrics is missing", metricType)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Sugar.Errorf("error checking bolt database: %v", err)
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return nil
+}
+
+// SaveMetrics is a no-op, every transaction is synced to the file on commit.
+func (b *BoltStorage) SaveMetrics(_ context.Context) error {
+	return nil
+}
+
+func (b *BoltStorage) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+func newTestBoltStorage(t *testing.T, path string, keyMode KeyMode) *BoltStorage {
+	logger.InitLogger()
+	s, err := NewBoltStorage(path, time.Second, keyMode)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBoltStorage_Update(t *testing.T) {
+	ctx := context.Background()
+	s := newTestBoltStorage(t, filepath.Join(t.TempDir(), "metrics.bolt"), KeyModeTyped)
+
+	assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(2)}))
+	assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(-5)}))
+	assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "gauge", Value: float64Ptr(1.5)}))
+	assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "gauge", Value: float64Ptr(-2.5)}))
+	assert.ErrorIs(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "gauge"}), ErrInvalidMetric)
+
+	counter, err := s.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(-3)}, counter)
+	gauge, err := s.Get(ctx, "X", "gauge")
+	require.NoError(t, err)
+	assert.Equal(t, &metrics.Metrics{ID: "X", MType: "gauge", Value: float64Ptr(-2.5)}, gauge)
+
+	_, err = s.Get(ctx, "Y", "gauge")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.Get(ctx, "X", "histogram")
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		"counter:X": {ID: "X", MType: "counter", Delta: int64Ptr(-3)},
+		"gauge:X":   {ID: "X", MType: "gauge", Value: float64Ptr(-2.5)},
+	}, allMetrics)
+}
+
+func TestBoltStorage_UpdateMetrics(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.bolt")
+	s := newTestBoltStorage(t, path, KeyModeStrict)
+
+	err := s.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "X", MType: "gauge", Value: float64Ptr(1.5)},
+		{ID: "Y", MType: "counter"},
+		{ID: "Z", MType: "gauge", Value: float64Ptr(0.5)},
+	})
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+
+	_, err = s.Get(ctx, "X", "gauge")
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	assert.ErrorIs(t, s.Update(ctx, &metrics.Metrics{ID: "Z", MType: "counter", Delta: int64Ptr(1)}), ErrTypeMismatch)
+	require.NoError(t, s.Close())
+
+	// the metrics survive reopening the database
+	s = newTestBoltStorage(t, path, KeyModeStrict)
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		"counter:X": {ID: "X", MType: "counter", Delta: int64Ptr(2)},
+		"gauge:Z":   {ID: "Z", MType: "gauge", Value: float64Ptr(0.5)},
+	}, allMetrics)
+}
+
+func TestBoltStorage_UpdateConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := newTestBoltStorage(t, filepath.Join(t.TempDir(), "metrics.bolt"), KeyModeTyped)
+
+	var testWG sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		testWG.Add(1)
+		go func() {
+			defer testWG.Done()
+			assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+		}()
+	}
+	testWG.Wait()
+
+	counter, err := s.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), *counter.Delta)
+}
+
+func TestBoltStorage_Ping(t *testing.T) {
+	s := newTestBoltStorage(t, filepath.Join(t.TempDir(), "metrics.bolt"), KeyModeTyped)
+
+	assert.NoError(t, s.Ping(context.Background()))
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Ping(context.Background()), ErrUnavailable)
+}
+
+func TestCompactBolt(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.bolt")
+	s := newTestBoltStorage(t, path, KeyModeTyped)
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "metric" + strconv.Itoa(i), MType: "gauge", Value: float64Ptr(float64(i))}))
+	}
+	require.NoError(t, s.db.Update(func(tx *bolt.Tx) error {
+		for i := 1; i < 1000; i++ {
+			if err := tx.Bucket(boltBuckets["gauge"]).Delete([]byte("metric" + strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// the database is locked while the storage is open
+	_, _, err := CompactBolt(path, 10*time.Millisecond)
+	assert.Error(t, err)
+
+	// a copy left by an interrupted compaction is not merged into the result
+	stale := newTestBoltStorage(t, path+".compact", KeyModeTyped)
+	require.NoError(t, stale.Update(ctx, &metrics.Metrics{ID: "stale", MType: "gauge", Value: float64Ptr(1)}))
+	require.NoError(t, stale.Close())
+
+	require.NoError(t, s.Close())
+	before, after, err := CompactBolt(path, time.Second)
+	require.NoError(t, err)
+	assert.Less(t, after, before)
+
+	s = newTestBoltStorage(t, path, KeyModeTyped)
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		"gauge:metric0": {ID: "metric0", MType: "gauge", Value: float64Ptr(0)},
+	}, allMetrics)
+}
@@ -0,0 +1,124 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage/storagetest"
+)
+
+// openURL returns a harness function opening the storage URL, which it derives
+// from a temporary directory of the test.
+func openURL(rawURL func(dir string) string) func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error) {
+	return func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error) {
+		u := rawURL(t.TempDir())
+		return func() (storage.Storage, error) {
+			return storage.Open(u, storage.Options{KeyMode: keyMode})
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	logger.InitLogger()
+	harnesses := map[string]storagetest.Harness{
+		"memory": {
+			New: openURL(func(string) string { return "memory://" }),
+		},
+		"sharded memory": {
+			New: openURL(func(string) string { return "memory://?shards=4" }),
+		},
+		"file": {
+			New: openURL(func(dir string) string {
+				return "file://" + filepath.Join(dir, "metrics.json") + "?interval=0&restore=true"
+			}),
+			Persistent: true,
+		},
+		"file with write-ahead log": {
+			New: openURL(func(dir string) string {
+				return "file://" + filepath.Join(dir, "metrics.json") + "?interval=300&restore=true&wal=true"
+			}),
+			Persistent: true,
+		},
+		"bolt": {
+			New:        openURL(func(dir string) string { return "bolt://" + filepath.Join(dir, "metrics.bolt") }),
+			Persistent: true,
+		},
+		"sqlite": {
+			New:        openURL(func(dir string) string { return "sqlite://" + filepath.Join(dir, "metrics.db") }),
+			Persistent: true,
+		},
+		"write-behind": {
+			New: func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error) {
+				return func() (storage.Storage, error) {
+					return storage.NewWriteBehindStorage(storage.NewMemStorageWithKeyMode(keyMode), time.Millisecond, 0, 0, keyMode), nil
+				}
+			},
+		},
+		"journaled": {
+			New: func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error) {
+				return func() (storage.Storage, error) {
+					return storage.NewResilientStorage(storage.NewMemStorageWithKeyMode(keyMode), 100, 0), nil
+				}
+			},
+		},
+		"watched": {
+			New: func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error) {
+				return func() (storage.Storage, error) {
+					w := storage.NewWatchableStorage(storage.NewMemStorageWithKeyMode(keyMode), 0)
+					_, err := w.Watch(context.Background(), storage.WatchFilter{})
+					return w, err
+				}
+			},
+		},
+		"tiered": {
+			New: func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error) {
+				path := filepath.Join(t.TempDir(), "metrics.db")
+				return func() (storage.Storage, error) {
+					cold, err := storage.NewSQLiteStorage(path, keyMode)
+					if err != nil {
+						return nil, err
+					}
+					return storage.NewTieredStorage(cold, keyMode, time.Millisecond, time.Minute)
+				}
+			},
+			Persistent: true,
+		},
+	}
+	if dsn := os.Getenv("TEST_DATABASE_DSN"); dsn != "" {
+		harnesses["postgres"] = storagetest.Harness{New: postgresHarness(dsn), Persistent: true}
+	}
+
+	for name, harness := range harnesses {
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, harness)
+		})
+	}
+}
+
+// postgresHarness opens the database of the DSN with its tables emptied for every test.
+func postgresHarness(dsn string) func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error) {
+	return func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error) {
+		opts := storage.Options{KeyMode: keyMode, AutoMigrate: true}
+		s, err := storage.Open(dsn, opts)
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+
+		db, err := sql.Open("pgx", dsn)
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.ExecContext(context.Background(), "TRUNCATE counter, gauge")
+		require.NoError(t, err)
+
+		return func() (storage.Storage, error) {
+			return storage.Open(dsn, opts)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// notifyChannel is the channel the triggers of the metric tables notify about changes.
+const notifyChannel = "metric_changes"
+
+// The listener reconnects after a wait doubling from listenRetryMin to listenRetryMax.
+const (
+	listenRetryMin = time.Second
+	listenRetryMax = 30 * time.Second
+)
+
+// errCacheMiss is returned by the cache lookups it cannot answer.
+var errCacheMiss = errors.New("cache miss")
+
+// versionedMetric is a metric with the version of its row, which is incremented
+// by every write, so newer states of a metric are recognized.
+type versionedMetric struct {
+	metric  *metrics.Metrics
+	version int64
+}
+
+// dbCache is a read-through cache of the metrics of a DBStorage. It is kept up to date
+// by the notifications the triggers of the metric tables send on every change, so the
+// writes of other servers sharing the database are seen too. A state of a metric is
+// stored only if it is newer than the cached one, so the notifications, the results of
+// the reads and of the own writes may arrive in any order.
+//
+// The cache serves reads only while it listens for notifications. It is cleared when
+// the listener loses its connection, since the notifications sent meanwhile are lost,
+// and when rows are deleted.
+type dbCache struct {
+	keyMode KeyMode
+
+	mu      sync.RWMutex
+	entries map[string]versionedMetric
+	// complete is set when entries hold all stored metrics.
+	complete bool
+	serving  bool
+	// epoch is incremented when the cache is cleared. A state read before that may be
+	// older than a change whose notification was lost, so it is not stored.
+	epoch uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+func newDBCache(keyMode KeyMode) *dbCache {
+	return &dbCache{keyMode: keyMode, entries: make(map[string]versionedMetric)}
+}
+
+// start listens for the notifications of the database in the background until stop.
+func (c *dbCache) start(dsn string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.stopped = make(chan struct{})
+	go c.listen(ctx, dsn)
+}
+
+// stop stops the listener and disables the cache.
+func (c *dbCache) stop() {
+	if c == nil || c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.stopped
+}
+
+// listen keeps a connection listening for notifications and reconnects when it is lost.
+func (c *dbCache) listen(ctx context.Context, dsn string) {
+	defer close(c.stopped)
+	wait := listenRetryMin
+	for {
+		listened, err := c.listenOnce(ctx, dsn)
+		c.reset(false)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Sugar.Errorf("error listening for metric changes, the cache is disabled: %v", err)
+		if listened {
+			wait = listenRetryMin
+		}
+		if !sleep(ctx, wait) {
+			return
+		}
+		wait = min(2*wait, listenRetryMax)
+	}
+}
+
+// listenOnce connects to the database and applies the notifications until the
+// connection fails. It reports whether the cache was enabled.
+func (c *dbCache) listenOnce(ctx context.Context, dsn string) (bool, error) {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := conn.Close(context.Background()); err != nil {
+			logger.Sugar.Errorf("error closing the listener connection: %v", err)
+		}
+	}()
+
+	if _, err = conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		return false, err
+	}
+	c.reset(true)
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		c.apply(notification.Payload)
+	}
+}
+
+// reset clears the cache and enables or disables it.
+func (c *dbCache) reset(serving bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]versionedMetric)
+	c.complete = false
+	c.serving = serving
+	c.epoch++
+}
+
+// changeNotification is the payload of a notification sent by the triggers.
+type changeNotification struct {
+	// Op is "set" for a new state of a metric and "reset" if the cache must be cleared.
+	Op      string `json:"op"`
+	MType   string `json:"type"`
+	ID      string `json:"id"`
+	Delta   *int64 `json:"delta"`
+	Value   string `json:"value"`
+	Version int64  `json:"version"`
+}
+
+// apply stores the state of the metric sent in the notification payload. A payload it
+// cannot decode clears the cache.
+func (c *dbCache) apply(payload string) {
+	change, err := decodeChange(payload)
+	if err != nil {
+		logger.Sugar.Errorf("error decoding metric change, clearing the cache: %v", err)
+	}
+	if change == nil {
+		c.reset(true)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(*change)
+}
+
+// decodeChange decodes the payload of a notification. It returns nil for a reset.
+func decodeChange(payload string) (*versionedMetric, error) {
+	var change changeNotification
+	if err := json.Unmarshal([]byte(payload), &change); err != nil {
+		return nil, err
+	}
+	if change.Op == "reset" {
+		return nil, nil
+	}
+	metric := &metrics.Metrics{ID: change.ID, MType: change.MType, Delta: change.Delta}
+	if change.MType == "gauge" {
+		value, err := strconv.ParseFloat(change.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gauge value %q: %w", change.Value, err)
+		}
+		metric.Value = &value
+	}
+	if change.Op != "set" || validateStored(metric) != nil {
+		return nil, fmt.Errorf("invalid metric change %q", payload)
+	}
+	return &versionedMetric{metric: metric, version: change.Version}, nil
+}
+
+// store stores a copy of the metric state unless the cached one is newer. The caller
+// must hold the write lock.
+func (c *dbCache) store(state versionedMetric) {
+	key := MetricKey(state.metric.MType, state.metric.ID)
+	if cached, ok := c.entries[key]; ok && cached.version >= state.version {
+		return
+	}
+	c.entries[key] = versionedMetric{metric: copyMetric(state.metric), version: state.version}
+}
+
+// currentEpoch returns the epoch to pass to fill for a state about to be read.
+func (c *dbCache) currentEpoch() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.epoch
+}
+
+// fill stores the states read or written in the epoch, unless the cache was cleared since.
+func (c *dbCache) fill(epoch uint64, states ...versionedMetric) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.serving || c.epoch != epoch {
+		return
+	}
+	for _, state := range states {
+		c.store(state)
+	}
+}
+
+// fillAll stores the states of all stored metrics read in the epoch and marks the cache complete.
+func (c *dbCache) fillAll(epoch uint64, states []versionedMetric) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.serving || c.epoch != epoch {
+		return
+	}
+	for _, state := range states {
+		c.store(state)
+	}
+	c.complete = true
+}
+
+// lookup returns a copy of the cached metric. If the cache holds all metrics, it returns
+// the errors of a missing metric as the storage would. Otherwise it returns errCacheMiss.
+func (c *dbCache) lookup(metricName, metricType string) (*metrics.Metrics, error) {
+	if c == nil {
+		return nil, errCacheMiss
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.serving {
+		return nil, errCacheMiss
+	}
+	if state, ok := c.entries[MetricKey(metricType, metricName)]; ok {
+		c.hits.Add(1)
+		return copyMetric(state.metric), nil
+	}
+	if !c.complete {
+		c.misses.Add(1)
+		return nil, errCacheMiss
+	}
+	c.hits.Add(1)
+	if _, ok := c.entries[MetricKey(otherType(metricType), metricName)]; ok && c.keyMode == KeyModeStrict {
+		return nil, typeMismatch(metricName, metricType)
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrNotFound, metricType, metricName)
+}
+
+// all returns copies of all metrics if the cache holds them.
+func (c *dbCache) all() (map[string]*metrics.Metrics, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.serving {
+		return nil, false
+	}
+	if !c.complete {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	allMetrics := make(map[string]*metrics.Metrics, len(c.entries))
+	for key, state := range c.entries {
+		allMetrics[key] = copyMetric(state.metric)
+	}
+	return allMetrics, true
+}
+
+// selfMetrics returns the reads served and not served by the cache since the last call.
+func (c *dbCache) selfMetrics() []*metrics.Metrics {
+	hits := metrics.NewCounter("DBCacheHits", c.hits.Swap(0))
+	misses := metrics.NewCounter("DBCacheMisses", c.misses.Swap(0))
+	return []*metrics.Metrics{&hits, &misses}
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// newServingCache returns a cache that serves reads as if it were listening.
+func newServingCache(keyMode KeyMode) *dbCache {
+	c := newDBCache(keyMode)
+	c.reset(true)
+	return c
+}
+
+func Test_decodeChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    *versionedMetric
+		wantErr bool
+	}{
+		{
+			name:    "counter",
+			payload: `{"op":"set","type":"counter","id":"C","delta":42,"version":3}`,
+			want:    &versionedMetric{metric: &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(42)}, version: 3},
+		},
+		{
+			name:    "gauge",
+			payload: `{"op":"set","type":"gauge","id":"G","value":"0.1","version":0}`,
+			want:    &versionedMetric{metric: &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(0.1)}, version: 0},
+		},
+		{
+			name:    "gauge infinity",
+			payload: `{"op":"set","type":"gauge","id":"G","value":"-Infinity","version":1}`,
+			want:    &versionedMetric{metric: &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(math.Inf(-1))}, version: 1},
+		},
+		{name: "reset", payload: `{"op":"reset"}`},
+		{name: "malformed", payload: `{"op":`, wantErr: true},
+		{name: "unknown op", payload: `{"op":"delete","type":"counter","id":"C","delta":1}`, wantErr: true},
+		{name: "counter without delta", payload: `{"op":"set","type":"counter","id":"C"}`, wantErr: true},
+		{name: "invalid gauge value", payload: `{"op":"set","type":"gauge","id":"G","value":"x"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeChange(tt.payload)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_dbCache_apply(t *testing.T) {
+	logger.InitLogger()
+	c := newServingCache(KeyModeTyped)
+
+	c.apply(`{"op":"set","type":"counter","id":"C","delta":5,"version":2}`)
+	metric, err := c.lookup("C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *metric.Delta)
+
+	// an older state arriving late is ignored
+	c.apply(`{"op":"set","type":"counter","id":"C","delta":3,"version":1}`)
+	metric, err = c.lookup("C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *metric.Delta)
+
+	// a reset clears the cache and keeps it serving
+	epoch := c.currentEpoch()
+	c.apply(`{"op":"reset"}`)
+	_, err = c.lookup("C", "counter")
+	assert.ErrorIs(t, err, errCacheMiss)
+	assert.NotEqual(t, epoch, c.currentEpoch())
+
+	// so does a payload it cannot decode
+	c.apply(`{"op":"set","type":"gauge","id":"G","value":"1","version":1}`)
+	c.apply(`not json`)
+	_, err = c.lookup("G", "gauge")
+	assert.ErrorIs(t, err, errCacheMiss)
+	assert.True(t, c.serving)
+}
+
+func Test_dbCache_fill(t *testing.T) {
+	c := newServingCache(KeyModeStrict)
+
+	// a state read before the cache was cleared may have missed a change
+	epoch := c.currentEpoch()
+	c.reset(true)
+	c.fill(epoch, versionedMetric{metric: &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}})
+	_, err := c.lookup("C", "counter")
+	assert.ErrorIs(t, err, errCacheMiss)
+
+	// the cache stores copies
+	epoch = c.currentEpoch()
+	stored := &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}
+	c.fill(epoch, versionedMetric{metric: stored})
+	*stored.Delta = 10
+	metric, err := c.lookup("C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *metric.Delta)
+
+	// an incomplete cache cannot tell a missing metric
+	_, err = c.lookup("G", "gauge")
+	assert.ErrorIs(t, err, errCacheMiss)
+	_, ok := c.all()
+	assert.False(t, ok)
+
+	c.fillAll(epoch, []versionedMetric{
+		{metric: &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1.5)}},
+		{metric: &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(7)}},
+	})
+	_, err = c.lookup("X", "gauge")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = c.lookup("C", "gauge")
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	allMetrics, ok := c.all()
+	require.True(t, ok)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		"counter:C": {ID: "C", MType: "counter", Delta: int64Ptr(1)},
+		"gauge:G":   {ID: "G", MType: "gauge", Value: float64Ptr(1.5)},
+	}, allMetrics)
+
+	// a cache that is not listening serves nothing
+	c.reset(false)
+	c.fillAll(c.currentEpoch(), nil)
+	_, ok = c.all()
+	assert.False(t, ok)
+	assert.Equal(t, []*metrics.Metrics{
+		{ID: "DBCacheHits", MType: "counter", Delta: int64Ptr(4)},
+		{ID: "DBCacheMisses", MType: "counter", Delta: int64Ptr(3)},
+	}, c.selfMetrics())
+}
+
+func TestDBStorage_Cache(t *testing.T) {
+	logger.InitLogger()
+	storage, mock := setupMockDB(t)
+	defer storage.connPool.Close()
+	storage.cache = newServingCache(KeyModeTyped)
+	ctx := context.Background()
+
+	// a miss reads through the cache
+	mock.ExpectQuery("SELECT id, delta, version FROM counter WHERE id = \\$1").WithArgs("C").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "delta", "version"}).AddRow("C", 5, 1))
+	metric, err := storage.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *metric.Delta)
+	metric, err = storage.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *metric.Delta)
+
+	// the own writes are seen without a notification
+	mock.ExpectQuery("INSERT INTO counter").WithArgs("C", int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"delta", "version"}).AddRow(7, 2))
+	require.NoError(t, storage.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(2)}))
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO gauge").WithArgs([]string{"G"}, []float64{1.5}).WillReturnRows(gaugeRows("G", 1.5))
+	mock.ExpectCommit()
+	require.NoError(t, storage.UpdateMetrics(ctx, []*metrics.Metrics{{ID: "G", MType: "gauge", Value: float64Ptr(1.5)}}))
+
+	metric, err = storage.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), *metric.Delta)
+	metric, err = storage.Get(ctx, "G", "gauge")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *metric.Value)
+
+	// the changes of other servers are applied from the notifications
+	storage.cache.apply(`{"op":"set","type":"counter","id":"C","delta":10,"version":3}`)
+	metric, err = storage.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), *metric.Delta)
+
+	// all metrics are read once, the counters and the gauges concurrently
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery("SELECT id, delta, version FROM counter").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "delta", "version"}).AddRow("C", 10, 3))
+	mock.ExpectQuery("SELECT id, value, version FROM gauge").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "version"}).AddRow("G", 1.5, 1).AddRow("H", 2.5, 0))
+	want := map[string]*metrics.Metrics{
+		"counter:C": {ID: "C", MType: "counter", Delta: int64Ptr(10)},
+		"gauge:G":   {ID: "G", MType: "gauge", Value: float64Ptr(1.5)},
+		"gauge:H":   {ID: "H", MType: "gauge", Value: float64Ptr(2.5)},
+	}
+	for i := 0; i < 2; i++ {
+		allMetrics, err := storage.GetAllMetrics(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, want, allMetrics)
+	}
+	_, err = storage.Get(ctx, "X", "counter")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDBStorage_GetAllMetricsConcurrent(t *testing.T) {
+	logger.InitLogger()
+	storage, mock := setupMockDB(t)
+	defer storage.connPool.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	const readers = 10
+	for i := 0; i < readers; i++ {
+		mock.ExpectQuery("SELECT id, delta, version FROM counter").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "delta", "version"}).AddRow("C", 1, 0))
+		mock.ExpectQuery("SELECT id, value, version FROM gauge").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "value", "version"}).AddRow("G", 1.5, 0))
+	}
+
+	var testWG sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		testWG.Add(1)
+		go func() {
+			defer testWG.Done()
+			allMetrics, err := storage.GetAllMetrics(context.Background())
+			if assert.NoError(t, err) {
+				assert.Len(t, allMetrics, 2)
+			}
+		}()
+	}
+	testWG.Wait()
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -3,13 +3,17 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -18,59 +22,159 @@ import (
 	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
 )
 
-const (
-	driverName    = "pgx"
-	migrationPath = "db/migrations"
-)
-
-var (
-	wg sync.WaitGroup
-)
+const driverName = "pgx"
 
+// metricsCache collects the metrics read by concurrent queries with the versions of their rows.
 type metricsCache struct {
-	cache map[string]*metrics.Metrics
-	mu    sync.Mutex
+	cache    map[string]*metrics.Metrics
+	versions map[string]int64
+	mu       sync.Mutex
 }
 
 func newMetricsCache() *metricsCache {
 	return &metricsCache{
-		cache: make(map[string]*metrics.Metrics),
-		mu:    sync.Mutex{},
+		cache:    make(map[string]*metrics.Metrics),
+		versions: make(map[string]int64),
+		mu:       sync.Mutex{},
 	}
 }
 
-type DBStorage struct {
-	connPool *sql.DB
+// states returns the collected metrics with their versions.
+func (mc *metricsCache) states() []versionedMetric {
+	states := make([]versionedMetric, 0, len(mc.cache))
+	for key, metric := range mc.cache {
+		states = append(states, versionedMetric{metric: metric, version: mc.versions[key]})
+	}
+	return states
 }
 
-func NewDBStorage(databaseDSN string) (*DBStorage, error) {
-	var db DBStorage
-	conn, err := sql.Open(driverName, databaseDSN)
+const (
+	// The upserts increment the version of the row and return its new state.
+	upsertCounterQuery = "INSERT INTO counter (id, delta) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET delta = counter.delta + EXCLUDED.delta, version = counter.version + 1 RETURNING delta, version"
+	upsertGaugeQuery   = "INSERT INTO gauge (id, value) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET value = $2, version = gauge.version + 1 RETURNING value, version"
+	// The batch queries take arrays, which pgx encodes natively, and write all rows
+	// of a type in one statement. The arrays must not contain duplicate IDs.
+	upsertCountersQuery = "INSERT INTO counter (id, delta) SELECT * FROM unnest($1::text[], $2::bigint[]) ON CONFLICT (id) DO UPDATE SET delta = counter.delta + EXCLUDED.delta, version = counter.version + 1 RETURNING id, delta, version"
+	upsertGaugesQuery   = "INSERT INTO gauge (id, value) SELECT * FROM unnest($1::text[], $2::double precision[]) ON CONFLICT (id) DO UPDATE SET value = EXCLUDED.value, version = gauge.version + 1 RETURNING id, value, version"
+	lockNamesQuery      = "SELECT pg_advisory_xact_lock(hashtext(id)) FROM unnest($1::text[]) AS id"
+)
+
+func init() {
+	Register("postgres", openDBStorage)
+	Register("postgresql", openDBStorage)
+}
+
+// openDBStorage opens a DBStorage from a PostgreSQL connection URL. The retry_backoff
+// parameter sets the waits before the retries of failed operations, e.g.
+// "retry_backoff=100ms,300ms,1s" or "retry_backoff=none", and "cache=false" disables
+// the cache. The other query parameters are passed to the driver.
+func openDBStorage(u *url.URL, opts Options) (Storage, error) {
+	backoff := defaultRetryBackoff
+	query := u.Query()
+	if value := query.Get("retry_backoff"); value != "" {
+		var err error
+		if backoff, err = parseRetryBackoff(value); err != nil {
+			return nil, err
+		}
+	}
+	cache := true
+	if value := query.Get("cache"); value != "" {
+		var err error
+		if cache, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid cache option %q: %w", value, err)
+		}
+	}
+	query.Del("retry_backoff")
+	query.Del("cache")
+	dsn := *u
+	dsn.RawQuery = query.Encode()
 
+	db, err := NewDBStorage(dsn.String(), opts)
 	if err != nil {
-		logger.Sugar.Fatalf("unable to connect to database: %v", err)
 		return nil, err
 	}
-	m, err := migrate.New(fmt.Sprintf("file://%s", migrationPath), databaseDSN)
-	if err != nil {
-		logger.Sugar.Fatalf("error: %v", err)
+	db.SetRetryBackoff(backoff)
+	if cache {
+		db.EnableCache()
 	}
-	err = m.Up()
+	return db, nil
+}
+
+// existsQueries check whether a metric of the given type exists.
+var existsQueries = map[string]string{
+	"counter": "SELECT EXISTS (SELECT 1 FROM counter WHERE id = $1)",
+	"gauge":   "SELECT EXISTS (SELECT 1 FROM gauge WHERE id = $1)",
+}
+
+// storedIDsQueries select the IDs of an array that are stored as metrics of the given type.
+var storedIDsQueries = map[string]string{
+	"counter": "SELECT id FROM counter WHERE id = ANY($1::text[])",
+	"gauge":   "SELECT id FROM gauge WHERE id = ANY($1::text[])",
+}
+
+// queryExecer is implemented by both *sql.DB and *sql.Tx.
+type queryExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// DBStorage stores metrics in PostgreSQL. Operations failing with retriable errors,
+// such as a lost connection or a deadlock, are retried. With the cache enabled, reads
+// are served from memory kept up to date by the change notifications of the database.
+type DBStorage struct {
+	connPool *sql.DB
+	dsn      string
+	keyMode  KeyMode
+	retry    retryer
+	cache    *dbCache
+}
+
+// NewDBStorage connects to the database and creates a DBStorage with the default
+// retry backoff. It refuses a schema without the embedded migrations, unless
+// opts.AutoMigrate is set and the pending migrations are applied.
+func NewDBStorage(databaseDSN string, opts Options) (*DBStorage, error) {
+	if err := prepareSchema(databaseDSN, opts.AutoMigrate); err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open(driverName, databaseDSN)
 	if err != nil {
-		if errors.Is(err, migrate.ErrNoChange) {
-			logger.Sugar.Infoln("skipping migrations, no changes")
-		} else {
-			logger.Sugar.Fatalf("error applying migrations: %v", err)
-			return nil, err
-		}
-	} else {
-		logger.Sugar.Infoln("migrations applied successfully")
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
 	}
-	db = DBStorage{connPool: conn}
-	return &db, nil
+	db := &DBStorage{connPool: conn, dsn: databaseDSN, keyMode: opts.KeyMode}
+	db.SetRetryBackoff(defaultRetryBackoff)
+	return db, nil
+}
+
+// EnableCache starts caching the metrics. The cache listens for the changes made by
+// every server sharing the database on a connection of its own and serves reads only
+// while it is connected.
+func (db *DBStorage) EnableCache() {
+	if db.cache != nil {
+		return
+	}
+	db.cache = newDBCache(db.keyMode)
+	db.cache.start(db.dsn)
+}
+
+// SetRetryBackoff sets the waits before the retries of a failed operation,
+// an empty backoff disables retries.
+func (db *DBStorage) SetRetryBackoff(backoff []time.Duration) {
+	db.retry.backoff = backoff
+}
+
+// SelfMetrics returns the number of retries of database operations, of the operations
+// that failed after the retries and of the reads served and missed by the cache since
+// the last call.
+func (db *DBStorage) SelfMetrics() []*metrics.Metrics {
+	selfMetrics := db.retry.selfMetrics()
+	if db.cache != nil {
+		selfMetrics = append(selfMetrics, db.cache.selfMetrics()...)
+	}
+	return selfMetrics
 }
 
 func (db *DBStorage) Close() error {
+	db.cache.stop()
 	return db.connPool.Close()
 }
 
@@ -78,99 +182,174 @@ func (db *DBStorage) Ping(ctx context.Context) error {
 	err := db.connPool.PingContext(ctx)
 	if err != nil {
 		logger.Sugar.Errorf("error connecting to database: %v", err)
-		return err
+		return classifyError(err)
 	}
 	return nil
 }
 
-func (db *DBStorage) Update(ctx context.Context, metric *metrics.Metrics) {
-	switch metric.MType {
-	case "counter":
-		err := db.updateCounter(ctx, metric)
-		if err != nil {
-			logger.Sugar.Errorf("error updating counter metric: %v", err)
-		}
-	case "gauge":
-		err := db.updateGauge(ctx, metric)
-		if err != nil {
-			logger.Sugar.Errorf("error updating gauge metric: %v", err)
+// classifyError wraps database errors into the storage errors.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if pgerrcode.IsConnectionException(pgErr.Code) || pgErr.Code == pgerrcode.CannotConnectNow ||
+			pgErr.Code == pgerrcode.AdminShutdown || pgErr.Code == pgerrcode.TooManyConnections {
+			return unavailableError(err)
 		}
+		return err
 	}
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	if errors.As(err, &connectErr) || errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return unavailableError(err)
+	}
+	return err
 }
 
-func (db *DBStorage) updateCounter(ctx context.Context, metric *metrics.Metrics) error {
-	_, err := db.connPool.ExecContext(ctx,
-		"INSERT INTO counter (id, delta) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET delta = counter.delta + EXCLUDED.delta", metric.ID, *metric.Delta)
-	return err
+// unavailableError wraps ErrUnavailable around err, and ErrOutcomeUnknown if the
+// connection was lost during a commit, which may have been applied.
+func unavailableError(err error) error {
+	var commitErr *commitError
+	var pgErr *pgconn.PgError
+	if errors.As(err, &commitErr) || (errors.As(err, &pgErr) && pgErr.Code == pgerrcode.TransactionResolutionUnknown) {
+		return fmt.Errorf("%w: %w: %v", ErrUnavailable, ErrOutcomeUnknown, err)
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
 }
 
-func (db *DBStorage) updateGauge(ctx context.Context, metric *metrics.Metrics) error {
-	_, err := db.connPool.ExecContext(ctx,
-		"INSERT INTO gauge (id, value) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET value = $2", metric.ID, metric.Value)
-	return err
+func (db *DBStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	if err := ValidateMetric(metric); err != nil {
+		return err
+	}
+	if db.keyMode == KeyModeStrict {
+		// the name check and the upsert must see the same state
+		return db.UpdateMetrics(ctx, []*metrics.Metrics{metric})
+	}
+	epoch := db.cache.currentEpoch()
+	var stored versionedMetric
+	err := db.retry.do(ctx, func() error {
+		var err error
+		stored, err = db.upsert(ctx, db.connPool, metric)
+		return err
+	})
+	if err != nil {
+		logger.Sugar.Errorf("error updating %s metric: %v", metric.MType, err)
+		return classifyError(err)
+	}
+	db.cache.fill(epoch, stored)
+	return nil
 }
 
-func (db *DBStorage) Get(ctx context.Context, metricName string, metricType string) (*metrics.Metrics, bool) {
-	var metric metrics.Metrics
-	var err error
+// upsert writes a valid metric, adding the delta of a counter to the stored one,
+// and returns the stored state.
+func (db *DBStorage) upsert(ctx context.Context, q queryExecer, metric *metrics.Metrics) (versionedMetric, error) {
+	stored := versionedMetric{metric: &metrics.Metrics{ID: metric.ID, MType: metric.MType}}
+	if metric.MType == "counter" {
+		row := q.QueryRowContext(ctx, upsertCounterQuery, metric.ID, *metric.Delta)
+		return stored, row.Scan(&stored.metric.Delta, &stored.version)
+	}
+	row := q.QueryRowContext(ctx, upsertGaugeQuery, metric.ID, *metric.Value)
+	return stored, row.Scan(&stored.metric.Value, &stored.version)
+}
 
-	switch metricType {
-	case "counter":
-		metric.MType = "counter"
-		row := db.connPool.QueryRowContext(ctx, "SELECT id, delta FROM counter WHERE id = $1", metricName)
-		err = row.Scan(&metric.ID, &metric.Delta)
-	case "gauge":
-		metric.MType = "gauge"
-		row := db.connPool.QueryRowContext(ctx, "SELECT id, value FROM gauge WHERE id = $1", metricName)
-		err = row.Scan(&metric.ID, &metric.Value)
+// conflict returns ErrTypeMismatch if the key mode is strict and the name is used
+// by a metric of another type.
+func (db *DBStorage) conflict(ctx context.Context, q queryExecer, metricName, metricType string) error {
+	if db.keyMode != KeyModeStrict {
+		return nil
+	}
+	var exists bool
+	if err := q.QueryRowContext(ctx, existsQueries[otherType(metricType)], metricName).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return typeMismatch(metricName, metricType)
+	}
+	return nil
+}
+
+func (db *DBStorage) Get(ctx context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	if err := validateType(metricType); err != nil {
+		return nil, err
+	}
+	if metric, err := db.cache.lookup(metricName, metricType); !errors.Is(err, errCacheMiss) {
+		return metric, err
 	}
 
+	epoch := db.cache.currentEpoch()
+	metric := metrics.Metrics{MType: metricType}
+	var version int64
+	err := db.retry.do(ctx, func() error {
+		if metricType == "counter" {
+			row := db.connPool.QueryRowContext(ctx, "SELECT id, delta, version FROM counter WHERE id = $1", metricName)
+			return row.Scan(&metric.ID, &metric.Delta, &version)
+		}
+		row := db.connPool.QueryRowContext(ctx, "SELECT id, value, version FROM gauge WHERE id = $1", metricName)
+		return row.Scan(&metric.ID, &metric.Value, &version)
+	})
+
+	if errors.Is(err, sql.ErrNoRows) {
+		conflictErr := db.retry.do(ctx, func() error {
+			return db.conflict(ctx, db.connPool, metricName, metricType)
+		})
+		if conflictErr != nil {
+			return nil, classifyError(conflictErr)
+		}
+	}
 	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			if pgErr.Code == pgerrcode.ConnectionException {
-				logger.Sugar.Errorf("error retrieving metric due to connection exception: %v", err)
-				return nil, false
-			} else {
-				logger.Sugar.Errorf("error retrieving metric: %v", err)
-				return nil, false
-			}
-		} else if errors.Is(err, sql.ErrNoRows) {
-			return nil, false
-		} else {
+		if !errors.Is(err, sql.ErrNoRows) {
 			logger.Sugar.Errorf("error retrieving metric: %v", err)
-			return nil, false
 		}
+		return nil, classifyError(err)
 	}
 
-	return &metric, true
+	db.cache.fill(epoch, versionedMetric{metric: &metric, version: version})
+	return &metric, nil
 }
 
-func (db *DBStorage) GetAllMetrics(ctx context.Context) map[string]*metrics.Metrics {
-	allMetrics := newMetricsCache()
-
-	wg.Add(1)
-	go func() {
-		db.fetchCounterMetrics(ctx, allMetrics)
-	}()
-
-	wg.Add(1)
-	go func() {
-		db.fetchGaugeMetrics(ctx, allMetrics)
-	}()
-	wg.Wait()
+// GetAllMetrics reads the counters and the gauges concurrently.
+func (db *DBStorage) GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error) {
+	if allMetrics, ok := db.cache.all(); ok {
+		return allMetrics, nil
+	}
 
-	return allMetrics.cache
+	epoch := db.cache.currentEpoch()
+	var allMetrics *metricsCache
+	err := db.retry.do(ctx, func() error {
+		allMetrics = newMetricsCache()
+		var counterErr, gaugeErr error
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			counterErr = db.fetchCounterMetrics(ctx, allMetrics)
+		}()
+		go func() {
+			defer wg.Done()
+			gaugeErr = db.fetchGaugeMetrics(ctx, allMetrics)
+		}()
+		wg.Wait()
+		return errors.Join(counterErr, gaugeErr)
+	})
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	db.cache.fillAll(epoch, allMetrics.states())
+	return allMetrics.cache, nil
 }
 
-func (db *DBStorage) fetchCounterMetrics(ctx context.Context, metricsCache *metricsCache) {
-	defer wg.Done()
-
-	rows, err := db.connPool.QueryContext(ctx, "SELECT id, delta FROM counter")
+func (db *DBStorage) fetchCounterMetrics(ctx context.Context, metricsCache *metricsCache) error {
+	rows, err := db.connPool.QueryContext(ctx, "SELECT id, delta, version FROM counter")
 	if err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			logger.Sugar.Errorf("error retrieving metrics: %v", err)
-		}
+		logger.Sugar.Errorf("error retrieving metrics: %v", err)
+		return err
 	}
 	defer func(rows *sql.Rows) {
 		err = rows.Close()
@@ -184,26 +363,27 @@ func (db *DBStorage) fetchCounterMetrics(ctx context.Context, metricsCache *metr
 
 	for rows.Next() {
 		var m metrics.Metrics
+		var version int64
 		m.MType = "counter"
-		err = rows.Scan(&m.ID, &m.Delta)
-		if err != nil {
+		if err = rows.Scan(&m.ID, &m.Delta, &version); err != nil {
 			logger.Sugar.Errorf("error retrieving metric: %v", err)
+			return err
 		}
-		metricsCache.cache[m.ID] = &m
+		metricsCache.cache[MetricKey(m.MType, m.ID)] = &m
+		metricsCache.versions[MetricKey(m.MType, m.ID)] = version
 	}
 	if err = rows.Err(); err != nil {
 		logger.Sugar.Errorf("error after row iteration: %v", err)
+		return err
 	}
+	return nil
 }
 
-func (db *DBStorage) fetchGaugeMetrics(ctx context.Context, metricsCache *metricsCache) {
-	defer wg.Done()
-
-	rows, err := db.connPool.QueryContext(ctx, "SELECT id, value FROM gauge")
+func (db *DBStorage) fetchGaugeMetrics(ctx context.Context, metricsCache *metricsCache) error {
+	rows, err := db.connPool.QueryContext(ctx, "SELECT id, value, version FROM gauge")
 	if err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			logger.Sugar.Errorf("error retrieving metrics: %v", err)
-		}
+		logger.Sugar.Errorf("error retrieving metrics: %v", err)
+		return err
 	}
 	defer func(rows *sql.Rows) {
 		err = rows.Close()
@@ -217,49 +397,291 @@ func (db *DBStorage) fetchGaugeMetrics(ctx context.Context, metricsCache *metric
 
 	for rows.Next() {
 		var m metrics.Metrics
+		var version int64
 		m.MType = "gauge"
-		err = rows.Scan(&m.ID, &m.Value)
-		if err != nil {
+		if err = rows.Scan(&m.ID, &m.Value, &version); err != nil {
 			logger.Sugar.Errorf("error retrieving metrics: %v", err)
+			return err
 		}
-		metricsCache.cache[m.ID] = &m
+		metricsCache.cache[MetricKey(m.MType, m.ID)] = &m
+		metricsCache.versions[MetricKey(m.MType, m.ID)] = version
 	}
 	if err = rows.Err(); err != nil {
 		logger.Sugar.Errorf("error after row iteration: %v", err)
+		return err
+	}
+	return nil
+}
+
+// metricBatch holds the valid metrics of a batch aggregated by ID: the deltas
+// of a counter are summed and the last value of a gauge wins.
+type metricBatch struct {
+	counters map[string]int64
+	gauges   map[string]float64
+}
+
+// aggregateMetrics validates the metrics and aggregates the valid ones. In the strict
+// key mode the first type of a name in the batch wins and the others are mismatches.
+func aggregateMetrics(batchOfMetrics []*metrics.Metrics, keyMode KeyMode) (metricBatch, []error) {
+	batch := metricBatch{counters: make(map[string]int64), gauges: make(map[string]float64)}
+	var invalid []error
+	for _, metric := range batchOfMetrics {
+		if err := ValidateMetric(metric); err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		if keyMode == KeyModeStrict && batch.has(otherType(metric.MType), metric.ID) {
+			invalid = append(invalid, typeMismatch(metric.ID, metric.MType))
+			continue
+		}
+		if metric.MType == "counter" {
+			batch.counters[metric.ID] += *metric.Delta
+		} else {
+			batch.gauges[metric.ID] = *metric.Value
+		}
+	}
+	return batch, invalid
+}
+
+func (b metricBatch) has(metricType, id string) bool {
+	if metricType == "counter" {
+		_, ok := b.counters[id]
+		return ok
+	}
+	_, ok := b.gauges[id]
+	return ok
+}
+
+func (b metricBatch) remove(metricType, id string) {
+	if metricType == "counter" {
+		delete(b.counters, id)
+	} else {
+		delete(b.gauges, id)
 	}
 }
 
-func (db *DBStorage) UpdateMetrics(ctx context.Context, metrics []*metrics.Metrics) error {
-	tx, err := db.connPool.Begin()
+func (b metricBatch) clone() metricBatch {
+	return metricBatch{counters: maps.Clone(b.counters), gauges: maps.Clone(b.gauges)}
+}
+
+func (b metricBatch) empty() bool {
+	return len(b.counters) == 0 && len(b.gauges) == 0
+}
+
+// ids returns the sorted IDs of the metrics of the type. Sorting makes concurrent
+// batches lock the rows in the same order, so they do not deadlock.
+func (b metricBatch) ids(metricType string) []string {
+	if metricType == "counter" {
+		return sortedKeys(b.counters)
+	}
+	return sortedKeys(b.gauges)
+}
+
+// names returns the sorted IDs of the metrics of both types.
+func (b metricBatch) names() []string {
+	names := b.ids("counter")
+	for id := range b.gauges {
+		if _, ok := b.counters[id]; !ok {
+			names = append(names, id)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UpdateMetrics aggregates the valid metrics of the batch and writes them in a single
+// transaction with one upsert per type, which is retried as a whole. It returns the
+// joined errors of the invalid and conflicting metrics.
+func (db *DBStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	batch, invalid := aggregateMetrics(batchOfMetrics, db.keyMode)
+	if batch.empty() {
+		return errors.Join(invalid...)
+	}
+
+	epoch := db.cache.currentEpoch()
+	var mismatches []error
+	var stored []versionedMetric
+	err := db.retry.do(ctx, func() error {
+		var err error
+		mismatches, stored, err = db.writeBatch(ctx, batch.clone(), false)
+		return err
+	})
 	if err != nil {
-		logger.Sugar.Errorln("error starting transaction: %v", err)
+		logger.Sugar.Errorf("error updating metrics: %v", err)
+		return classifyError(err)
+	}
+	db.cache.fill(epoch, stored...)
+	return errors.Join(append(invalid, mismatches...)...)
+}
+
+// UpdateMetricsAtomic writes every metric of the batch in a single transaction, or none
+// of them if any is invalid or conflicting.
+func (db *DBStorage) UpdateMetricsAtomic(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := validateBatch(batchOfMetrics, db.keyMode); err != nil {
+		return err
+	}
+	batch, _ := aggregateMetrics(batchOfMetrics, db.keyMode)
+	if batch.empty() {
+		return nil
+	}
+
+	epoch := db.cache.currentEpoch()
+	var stored []versionedMetric
+	err := db.retry.do(ctx, func() error {
+		var err error
+		_, stored, err = db.writeBatch(ctx, batch.clone(), true)
+		return err
+	})
+	if errors.Is(err, ErrTypeMismatch) {
+		return err
+	}
+	if err != nil {
+		logger.Sugar.Errorf("error updating metrics: %v", err)
+		return classifyError(err)
+	}
+	db.cache.fill(epoch, stored...)
+	return nil
+}
+
+// writeBatch writes the batch in a transaction and returns the ErrTypeMismatch
+// errors of the metrics it skipped in the strict key mode and the stored states
+// of the written metrics. If atomic is set, the transaction is rolled back instead
+// and the joined ErrTypeMismatch errors are returned as the error.
+func (db *DBStorage) writeBatch(ctx context.Context, batch metricBatch, atomic bool) ([]error, []versionedMetric, error) {
+	tx, err := db.connPool.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer func(tx *sql.Tx) {
-		err = tx.Rollback()
-		if err != nil {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
 			logger.Sugar.Errorf("error rolling back the transaction: %v", err)
 		}
 	}(tx)
 
-	for _, metric := range metrics {
-		switch metric.MType {
-		case "counter":
-			_, err = tx.ExecContext(ctx,
-				"INSERT INTO counter (id, delta) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET delta = counter.delta + EXCLUDED.delta",
-				metric.ID, *metric.Delta)
-			if err != nil {
-				return err
-			}
-		case "gauge":
-			_, err = tx.ExecContext(ctx,
-				"INSERT INTO gauge (id, value) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET value = $2",
-				metric.ID, *metric.Value)
-			if err != nil {
-				return err
-			}
+	var mismatches []error
+	if db.keyMode == KeyModeStrict {
+		if mismatches, err = db.removeConflicts(ctx, tx, batch); err != nil {
+			return nil, nil, err
+		}
+		if atomic && len(mismatches) > 0 {
+			return nil, nil, errors.Join(mismatches...)
+		}
+	}
+	stored, err := db.upsertBatch(ctx, tx, batch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, nil, &commitError{err: err}
+	}
+	return mismatches, stored, nil
+}
+
+// removeConflicts locks the names of the batch, so concurrent writers of the same
+// names are serialized, and removes the metrics whose names are stored with another
+// type. It returns ErrTypeMismatch errors for the removed metrics.
+func (db *DBStorage) removeConflicts(ctx context.Context, tx *sql.Tx, batch metricBatch) ([]error, error) {
+	if _, err := tx.ExecContext(ctx, lockNamesQuery, batch.names()); err != nil {
+		return nil, err
+	}
+	var mismatches []error
+	for _, metricType := range []string{"counter", "gauge"} {
+		ids := batch.ids(metricType)
+		if len(ids) == 0 {
+			continue
+		}
+		stored, err := queryIDs(ctx, tx, storedIDsQueries[otherType(metricType)], ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range stored {
+			batch.remove(metricType, id)
+			mismatches = append(mismatches, typeMismatch(id, metricType))
+		}
+	}
+	return mismatches, nil
+}
+
+// queryIDs returns the IDs selected by the query.
+func queryIDs(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logger.Sugar.Errorf("error closing the SQL rows: %v", err)
+		}
+	}(rows)
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// upsertBatch writes the counters and the gauges of the batch with one statement each
+// and returns the stored states of the written metrics.
+func (db *DBStorage) upsertBatch(ctx context.Context, tx *sql.Tx, batch metricBatch) ([]versionedMetric, error) {
+	var stored []versionedMetric
+	if ids := batch.ids("counter"); len(ids) > 0 {
+		deltas := make([]int64, len(ids))
+		for i, id := range ids {
+			deltas[i] = batch.counters[id]
+		}
+		states, err := queryStates(ctx, tx, "counter", upsertCountersQuery, ids, deltas)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, states...)
+	}
+	if ids := batch.ids("gauge"); len(ids) > 0 {
+		values := make([]float64, len(ids))
+		for i, id := range ids {
+			values[i] = batch.gauges[id]
+		}
+		states, err := queryStates(ctx, tx, "gauge", upsertGaugesQuery, ids, values)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, states...)
+	}
+	return stored, nil
+}
+
+// queryStates returns the metrics of the type with their versions selected by the query
+// as rows of ID, delta or value and version.
+func queryStates(ctx context.Context, tx *sql.Tx, metricType, query string, args ...any) ([]versionedMetric, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logger.Sugar.Errorf("error closing the SQL rows: %v", err)
+		}
+	}(rows)
+
+	var states []versionedMetric
+	for rows.Next() {
+		state := versionedMetric{metric: &metrics.Metrics{MType: metricType}}
+		if metricType == "counter" {
+			err = rows.Scan(&state.metric.ID, &state.metric.Delta, &state.version)
+		} else {
+			err = rows.Scan(&state.metric.ID, &state.metric.Value, &state.version)
+		}
+		if err != nil {
+			return nil, err
 		}
+		states = append(states, state)
 	}
-	return tx.Commit()
+	return states, rows.Err()
 }
 
 func (db *DBStorage) SaveMetrics(_ context.Context) error {
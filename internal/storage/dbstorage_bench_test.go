@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// benchRoundTrip is the simulated latency of a statement sent to the database.
+const benchRoundTrip = 50 * time.Microsecond
+
+// benchBatch returns a batch of counters and gauges where every metric is sent twice.
+func benchBatch(size int) []*metrics.Metrics {
+	metricDelta := int64(1)
+	metricValue := 0.5
+	batch := make([]*metrics.Metrics, 0, size)
+	for i := 0; len(batch) < size; i++ {
+		id := "metric_" + strconv.Itoa(i/4)
+		if i%2 == 0 {
+			batch = append(batch, &metrics.Metrics{ID: id, MType: "counter", Delta: &metricDelta})
+		} else {
+			batch = append(batch, &metrics.Metrics{ID: id, MType: "gauge", Value: &metricValue})
+		}
+	}
+	return batch
+}
+
+// BenchmarkDBStorage_UpdateMetrics compares the batch upsert with writing the
+// metrics one by one, as UpdateMetrics did before.
+func BenchmarkDBStorage_UpdateMetrics(b *testing.B) {
+	logger.InitLogger()
+	for _, size := range []int{10, 100} {
+		batch := benchBatch(size)
+
+		b.Run("batch/"+strconv.Itoa(size), func(b *testing.B) {
+			storage, mock := setupMockDB(b)
+			defer storage.connPool.Close()
+			for i := 0; i < b.N; i++ {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO counter").WillDelayFor(benchRoundTrip).WillReturnRows(counterRows())
+				mock.ExpectQuery("INSERT INTO gauge").WillDelayFor(benchRoundTrip).WillReturnRows(gaugeRows())
+				mock.ExpectCommit()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := storage.UpdateMetrics(context.Background(), batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run("one by one/"+strconv.Itoa(size), func(b *testing.B) {
+			storage, mock := setupMockDB(b)
+			defer storage.connPool.Close()
+			for i := 0; i < b.N; i++ {
+				for _, metric := range batch {
+					mock.ExpectQuery("INSERT INTO " + metric.MType).WillDelayFor(benchRoundTrip).
+						WillReturnRows(sqlmock.NewRows([]string{"value", "version"}).AddRow(1, 1))
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, metric := range batch {
+					if err := storage.Update(context.Background(), metric); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func Benchmark_aggregateMetrics(b *testing.B) {
+	batch := benchBatch(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aggregateMetrics(batch, KeyModeTyped)
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"sync"
 	"testing"
@@ -17,14 +18,44 @@ import (
 	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
 )
 
+// arrayConverter passes the array arguments of the batch queries through to sqlmock,
+// as pgx encodes them natively.
+type arrayConverter struct{}
+
+func (arrayConverter) ConvertValue(v any) (driver.Value, error) {
+	switch v.(type) {
+	case []string, []int64, []float64:
+		return v, nil
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
 // setupMockDB sets up a mock database and logger for testing
-func setupMockDB(t *testing.T) (*DBStorage, sqlmock.Sqlmock) {
-	db, mock, err := sqlmock.New()
+func setupMockDB(t testing.TB) (*DBStorage, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(arrayConverter{}))
 	assert.NoError(t, err)
 
 	return &DBStorage{connPool: db}, mock
 }
 
+// counterRows returns the rows of the counter upsert for pairs of ID and delta at version 1.
+func counterRows(idsAndDeltas ...any) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "delta", "version"})
+	for i := 0; i < len(idsAndDeltas); i += 2 {
+		rows.AddRow(idsAndDeltas[i], idsAndDeltas[i+1], 1)
+	}
+	return rows
+}
+
+// gaugeRows returns the rows of the gauge upsert for pairs of ID and value at version 1.
+func gaugeRows(idsAndValues ...any) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "value", "version"})
+	for i := 0; i < len(idsAndValues); i += 2 {
+		rows.AddRow(idsAndValues[i], idsAndValues[i+1], 1)
+	}
+	return rows
+}
+
 func TestDBStorage_Close(t *testing.T) {
 	storage, mock := setupMockDB(t)
 	defer storage.connPool.Close()
@@ -62,11 +93,56 @@ func TestDBStorage_Update(t *testing.T) {
 		Value: func() *float64 { v := 42.42; return &v }(),
 	}
 
-	mock.ExpectExec("INSERT INTO counter").WithArgs(counterMetric.ID, *counterMetric.Delta).WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec("INSERT INTO gauge").WithArgs(gaugeMetric.ID, gaugeMetric.Value).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("INSERT INTO counter").WithArgs(counterMetric.ID, *counterMetric.Delta).
+		WillReturnRows(sqlmock.NewRows([]string{"delta", "version"}).AddRow(*counterMetric.Delta, 0))
+	mock.ExpectQuery("INSERT INTO gauge").WithArgs(gaugeMetric.ID, *gaugeMetric.Value).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "version"}).AddRow(*gaugeMetric.Value, 0))
+
+	assert.NoError(t, storage.Update(context.Background(), counterMetric))
+	assert.NoError(t, storage.Update(context.Background(), gaugeMetric))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDBStorage_UpdateStrict(t *testing.T) {
+	logger.InitLogger()
+	storage, mock := setupMockDB(t)
+	defer storage.connPool.Close()
+	storage.keyMode = KeyModeStrict
+
+	gaugeMetric := &metrics.Metrics{
+		ID:    "test_metric",
+		MType: "gauge",
+		Value: func() *float64 { v := 42.42; return &v }(),
+	}
+
+	// the name is free
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WithArgs([]string{gaugeMetric.ID}).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT id FROM counter WHERE id = ANY").WithArgs([]string{gaugeMetric.ID}).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("INSERT INTO gauge").WithArgs([]string{gaugeMetric.ID}, []float64{*gaugeMetric.Value}).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "version"}).AddRow(gaugeMetric.ID, *gaugeMetric.Value, 0))
+	mock.ExpectCommit()
+
+	assert.NoError(t, storage.Update(context.Background(), gaugeMetric))
+
+	// the name is used by a counter
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WithArgs([]string{gaugeMetric.ID}).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT id FROM counter WHERE id = ANY").WithArgs([]string{gaugeMetric.ID}).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(gaugeMetric.ID))
+	mock.ExpectCommit()
+
+	assert.ErrorIs(t, storage.Update(context.Background(), gaugeMetric), ErrTypeMismatch)
+
+	// reading the name as a counter is a mismatch too
+	mock.ExpectQuery("SELECT id, value, version FROM gauge WHERE id = \\$1").WithArgs("test_counter").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM counter").WithArgs("test_counter").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
 
-	storage.Update(context.Background(), counterMetric)
-	storage.Update(context.Background(), gaugeMetric)
+	_, err := storage.Get(context.Background(), "test_counter", "gauge")
+	assert.ErrorIs(t, err, ErrTypeMismatch)
 
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
@@ -87,49 +163,50 @@ func TestDBStorage_Get(t *testing.T) {
 		Value: func() *float64 { v := 42.42; return &v }(),
 	}
 
-	mock.ExpectQuery("SELECT id, delta FROM counter WHERE id = \\$1").
+	mock.ExpectQuery("SELECT id, delta, version FROM counter WHERE id = \\$1").
 		WithArgs(counterMetric.ID).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "delta"}).AddRow(counterMetric.ID, *counterMetric.Delta))
+		WillReturnRows(sqlmock.NewRows([]string{"id", "delta", "version"}).AddRow(counterMetric.ID, *counterMetric.Delta, 0))
 
-	mock.ExpectQuery("SELECT id, value FROM gauge WHERE id = \\$1").
+	mock.ExpectQuery("SELECT id, value, version FROM gauge WHERE id = \\$1").
 		WithArgs(gaugeMetric.ID).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "value"}).AddRow(gaugeMetric.ID, *gaugeMetric.Value))
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "version"}).AddRow(gaugeMetric.ID, *gaugeMetric.Value, 0))
 
 	// Successful counter metric retrieval
-	m, found := storage.Get(context.Background(), counterMetric.ID, "counter")
-	assert.True(t, found)
+	m, err := storage.Get(context.Background(), counterMetric.ID, "counter")
+	assert.NoError(t, err)
 	assert.Equal(t, counterMetric, m)
 
 	// Successful gauge metric retrieval
-	m, found = storage.Get(context.Background(), gaugeMetric.ID, "gauge")
-	assert.True(t, found)
+	m, err = storage.Get(context.Background(), gaugeMetric.ID, "gauge")
+	assert.NoError(t, err)
 	assert.Equal(t, gaugeMetric, m)
 
 	// Test for no rows found
-	mock.ExpectQuery("SELECT id, delta FROM counter WHERE id = \\$1").
+	mock.ExpectQuery("SELECT id, delta, version FROM counter WHERE id = \\$1").
 		WithArgs("non_existent").
 		WillReturnError(sql.ErrNoRows)
 
-	m, found = storage.Get(context.Background(), "non_existent", "counter")
-	assert.False(t, found)
+	m, err = storage.Get(context.Background(), "non_existent", "counter")
+	assert.ErrorIs(t, err, ErrNotFound)
 	assert.Nil(t, m)
 
 	// Test for connection error
-	mock.ExpectQuery("SELECT id, delta FROM counter WHERE id = \\$1").
+	mock.ExpectQuery("SELECT id, delta, version FROM counter WHERE id = \\$1").
 		WithArgs("conn_error").
 		WillReturnError(&pgconn.PgError{Code: pgerrcode.ConnectionException})
 
-	m, found = storage.Get(context.Background(), "conn_error", "counter")
-	assert.False(t, found)
+	m, err = storage.Get(context.Background(), "conn_error", "counter")
+	assert.ErrorIs(t, err, ErrUnavailable)
 	assert.Nil(t, m)
 
 	// Test for other query error
-	mock.ExpectQuery("SELECT id, delta FROM counter WHERE id = \\$1").
+	mock.ExpectQuery("SELECT id, delta, version FROM counter WHERE id = \\$1").
 		WithArgs("other_error").
 		WillReturnError(errors.New("some other error"))
 
-	m, found = storage.Get(context.Background(), "other_error", "counter")
-	assert.False(t, found)
+	m, err = storage.Get(context.Background(), "other_error", "counter")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrNotFound)
 	assert.Nil(t, m)
 
 	assert.NoError(t, mock.ExpectationsWereMet())
@@ -155,3 +232,263 @@ func Test_newMetricsCache(t *testing.T) {
 		t.Errorf("expected default initialized sync.Mutex")
 	}
 }
+
+func Test_aggregateMetrics(t *testing.T) {
+	tests := []struct {
+		name        string
+		keyMode     KeyMode
+		batch       []*metrics.Metrics
+		want        metricBatch
+		wantInvalid []error
+	}{
+		{
+			name: "duplicate counters are summed",
+			batch: []*metrics.Metrics{
+				{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "X", MType: "counter", Delta: int64Ptr(2)},
+				{ID: "Y", MType: "counter", Delta: int64Ptr(-4)},
+			},
+			want: metricBatch{counters: map[string]int64{"X": 3, "Y": -4}, gauges: map[string]float64{}},
+		},
+		{
+			name: "last gauge wins",
+			batch: []*metrics.Metrics{
+				{ID: "X", MType: "gauge", Value: float64Ptr(1.5)},
+				{ID: "X", MType: "gauge", Value: float64Ptr(2.5)},
+			},
+			want: metricBatch{counters: map[string]int64{}, gauges: map[string]float64{"X": 2.5}},
+		},
+		{
+			name: "malformed metrics are skipped",
+			batch: []*metrics.Metrics{
+				nil,
+				{ID: "X", MType: "counter"},
+				{ID: "Y", MType: "gauge"},
+				{ID: "", MType: "gauge", Value: float64Ptr(1)},
+				{ID: "Z", MType: "histogram", Value: float64Ptr(1)},
+				{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+			},
+			want:        metricBatch{counters: map[string]int64{"X": 1}, gauges: map[string]float64{}},
+			wantInvalid: []error{ErrInvalidMetric, ErrInvalidMetric, ErrInvalidMetric, ErrInvalidMetric, ErrInvalidMetric},
+		},
+		{
+			name: "both types of a name in typed mode",
+			batch: []*metrics.Metrics{
+				{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "X", MType: "gauge", Value: float64Ptr(1.5)},
+			},
+			want: metricBatch{counters: map[string]int64{"X": 1}, gauges: map[string]float64{"X": 1.5}},
+		},
+		{
+			name:    "first type of a name wins in strict mode",
+			keyMode: KeyModeStrict,
+			batch: []*metrics.Metrics{
+				{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "X", MType: "gauge", Value: float64Ptr(1.5)},
+			},
+			want:        metricBatch{counters: map[string]int64{"X": 1}, gauges: map[string]float64{}},
+			wantInvalid: []error{ErrTypeMismatch},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, invalid := aggregateMetrics(tt.batch, tt.keyMode)
+			assert.Equal(t, tt.want, got)
+			assert.Len(t, invalid, len(tt.wantInvalid))
+			for i, err := range invalid {
+				assert.ErrorIs(t, err, tt.wantInvalid[i])
+			}
+		})
+	}
+}
+
+func TestDBStorage_UpdateMetrics(t *testing.T) {
+	logger.InitLogger()
+	tests := []struct {
+		name    string
+		keyMode KeyMode
+		batch   []*metrics.Metrics
+		expect  func(mock sqlmock.Sqlmock)
+		wantErr error
+	}{
+		{
+			name: "one upsert per type",
+			batch: []*metrics.Metrics{
+				{ID: "b", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "a", MType: "counter", Delta: int64Ptr(2)},
+				{ID: "b", MType: "counter", Delta: int64Ptr(3)},
+				{ID: "g", MType: "gauge", Value: float64Ptr(1.5)},
+			},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO counter .* unnest").WithArgs([]string{"a", "b"}, []int64{2, 4}).
+					WillReturnRows(counterRows("a", 2, "b", 4))
+				mock.ExpectQuery("INSERT INTO gauge .* unnest").WithArgs([]string{"g"}, []float64{1.5}).
+					WillReturnRows(gaugeRows("g", 1.5))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "invalid metrics are reported after the valid ones are written",
+			batch: []*metrics.Metrics{
+				{ID: "g", MType: "gauge", Value: float64Ptr(1.5)},
+				{ID: "c", MType: "counter"},
+			},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO gauge").WithArgs([]string{"g"}, []float64{1.5}).
+					WillReturnRows(gaugeRows("g", 1.5))
+				mock.ExpectCommit()
+			},
+			wantErr: ErrInvalidMetric,
+		},
+		{
+			name:    "only invalid metrics",
+			batch:   []*metrics.Metrics{nil, {ID: "c", MType: "counter"}},
+			expect:  func(mock sqlmock.Sqlmock) {},
+			wantErr: ErrInvalidMetric,
+		},
+		{
+			name:    "conflicting names are skipped in strict mode",
+			keyMode: KeyModeStrict,
+			batch: []*metrics.Metrics{
+				{ID: "x", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "y", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "z", MType: "gauge", Value: float64Ptr(1.5)},
+			},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").WithArgs([]string{"x", "y", "z"}).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT id FROM gauge WHERE id = ANY").WithArgs([]string{"x", "y"}).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("y"))
+				mock.ExpectQuery("SELECT id FROM counter WHERE id = ANY").WithArgs([]string{"z"}).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectQuery("INSERT INTO counter").WithArgs([]string{"x"}, []int64{1}).
+					WillReturnRows(counterRows("x", 1))
+				mock.ExpectQuery("INSERT INTO gauge").WithArgs([]string{"z"}, []float64{1.5}).
+					WillReturnRows(gaugeRows("z", 1.5))
+				mock.ExpectCommit()
+			},
+			wantErr: ErrTypeMismatch,
+		},
+		{
+			name:  "connection lost",
+			batch: []*metrics.Metrics{{ID: "c", MType: "counter", Delta: int64Ptr(1)}},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO counter").WillReturnError(&pgconn.PgError{Code: pgerrcode.ConnectionFailure})
+				mock.ExpectRollback()
+			},
+			wantErr: ErrUnavailable,
+		},
+		{
+			name:  "connection lost during the commit",
+			batch: []*metrics.Metrics{{ID: "c", MType: "counter", Delta: int64Ptr(1)}},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO counter").WillReturnRows(counterRows("c", 1))
+				mock.ExpectCommit().WillReturnError(&pgconn.PgError{Code: pgerrcode.ConnectionFailure})
+			},
+			wantErr: ErrOutcomeUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage, mock := setupMockDB(t)
+			defer storage.connPool.Close()
+			storage.keyMode = tt.keyMode
+			tt.expect(mock)
+
+			err := storage.UpdateMetrics(context.Background(), tt.batch)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDBStorage_UpdateMetricsAtomic(t *testing.T) {
+	logger.InitLogger()
+	tests := []struct {
+		name    string
+		batch   []*metrics.Metrics
+		expect  func(mock sqlmock.Sqlmock)
+		wantErr error
+	}{
+		{
+			name: "every metric is written",
+			batch: []*metrics.Metrics{
+				{ID: "x", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "z", MType: "gauge", Value: float64Ptr(1.5)},
+			},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").WithArgs([]string{"x", "z"}).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT id FROM gauge WHERE id = ANY").WithArgs([]string{"x"}).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectQuery("SELECT id FROM counter WHERE id = ANY").WithArgs([]string{"z"}).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectQuery("INSERT INTO counter").WithArgs([]string{"x"}, []int64{1}).
+					WillReturnRows(counterRows("x", 1))
+				mock.ExpectQuery("INSERT INTO gauge").WithArgs([]string{"z"}, []float64{1.5}).
+					WillReturnRows(gaugeRows("z", 1.5))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "an invalid metric rejects the batch before the transaction",
+			batch: []*metrics.Metrics{
+				{ID: "x", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "z", MType: "gauge"},
+			},
+			expect:  func(mock sqlmock.Sqlmock) {},
+			wantErr: ErrInvalidMetric,
+		},
+		{
+			name: "both types of a name in the batch",
+			batch: []*metrics.Metrics{
+				{ID: "x", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "x", MType: "gauge", Value: float64Ptr(1.5)},
+			},
+			expect:  func(mock sqlmock.Sqlmock) {},
+			wantErr: ErrTypeMismatch,
+		},
+		{
+			name: "a stored conflict rolls the transaction back",
+			batch: []*metrics.Metrics{
+				{ID: "x", MType: "counter", Delta: int64Ptr(1)},
+				{ID: "y", MType: "counter", Delta: int64Ptr(1)},
+			},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").WithArgs([]string{"x", "y"}).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT id FROM gauge WHERE id = ANY").WithArgs([]string{"x", "y"}).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("y"))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrTypeMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage, mock := setupMockDB(t)
+			defer storage.connPool.Close()
+			storage.keyMode = KeyModeStrict
+			tt.expect(mock)
+
+			err := storage.UpdateMetricsAtomic(context.Background(), tt.batch)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -3,121 +3,487 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/evgfitil/go-metrics-server.git/internal/logger"
 	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
 )
 
+const (
+	defaultStoreInterval = 300
+	defaultRestore       = true
+	// defaultWALMaxSize is the size of the write-ahead log in bytes that triggers a snapshot.
+	defaultWALMaxSize = 4 << 20
+)
+
+func init() {
+	Register("file", openFileStorage)
+}
+
+// openFileStorage opens a FileStorage from a URL of the form
+// "file:///path/to/metrics.json?interval=300&restore=true&wal=true&wal_max_size=4194304&keep=3&compress=true".
+// The interval is the period of saving in seconds, 0 saves on every update. With restore,
+// previously saved metrics are loaded. With wal, updates are appended to a write-ahead log
+// and the file is rewritten every interval or when the log outgrows wal_max_size bytes.
+// Keep is the number of snapshots kept, including the current one, and compress
+// enables gzip compression of the snapshots.
+func openFileStorage(u *url.URL, opts Options) (Storage, error) {
+	if err := checkParams(u, "interval", "restore", "wal", "wal_max_size", "keep", "compress"); err != nil {
+		return nil, err
+	}
+	path := u.Host + u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, errors.New("file storage requires a path")
+	}
+
+	query := u.Query()
+	storeInterval := defaultStoreInterval
+	if value := query.Get("interval"); value != "" {
+		var err error
+		storeInterval, err = strconv.Atoi(value)
+		if err != nil || storeInterval < 0 {
+			return nil, fmt.Errorf("invalid interval %q of file storage: must be a non-negative number of seconds", value)
+		}
+	}
+	restore := defaultRestore
+	if value := query.Get("restore"); value != "" {
+		var err error
+		restore, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid restore %q of file storage: %w", value, err)
+		}
+	}
+	var wal bool
+	if value := query.Get("wal"); value != "" {
+		var err error
+		wal, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wal %q of file storage: %w", value, err)
+		}
+	}
+	walMaxSize := int64(defaultWALMaxSize)
+	if value := query.Get("wal_max_size"); value != "" {
+		var err error
+		walMaxSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || walMaxSize <= 0 {
+			return nil, fmt.Errorf("invalid wal_max_size %q of file storage: must be a positive number of bytes", value)
+		}
+	}
+	keep := defaultKeepSnapshots
+	if value := query.Get("keep"); value != "" {
+		var err error
+		keep, err = strconv.Atoi(value)
+		if err != nil || keep < 1 {
+			return nil, fmt.Errorf("invalid keep %q of file storage: must be a positive number of snapshots", value)
+		}
+	}
+	var compress bool
+	if value := query.Get("compress"); value != "" {
+		var err error
+		compress, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compress %q of file storage: %w", value, err)
+		}
+	}
+
+	f, err := NewFileStorage(path, storeInterval, opts.KeyMode)
+	if err != nil {
+		return nil, err
+	}
+	f.SetSnapshotOptions(keep, compress)
+	if wal {
+		if err = f.EnableWAL(walMaxSize); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if restore {
+		logger.Sugar.Infoln("starting restore metrics")
+		if err = f.LoadMetrics(); err != nil {
+			logger.Sugar.Errorf("error loading metrics: %v", err)
+			// the files are left as they are, closing would replace them with the
+			// metrics restored so far
+			if errors.Is(err, errWALGap) {
+				if f.wal != nil {
+					f.wal.close()
+				}
+				return nil, err
+			}
+		}
+	}
+	if storeInterval > 0 {
+		f.AsyncSave()
+	}
+	return f, nil
+}
+
+// fileFormatVersion is the version of the file format written by SaveMetrics.
+// Version 1 files hold a JSON object of metrics keyed by name.
+const fileFormatVersion = 2
+
+// fileContent is the content of a storage file. Sequence is the sequence number
+// of the last write-ahead log record contained in the file.
+type fileContent struct {
+	Version  int                `json:"version"`
+	Sequence uint64             `json:"sequence,omitempty"`
+	Metrics  []*metrics.Metrics `json:"metrics"`
+}
+
+// FileStorage keeps metrics in memory and persists them to snapshot files.
+// Snapshots are replaced atomically and the previous ones are kept as backups.
+// In WAL mode every update is also appended to a write-ahead log next to the file,
+// and the file is a periodic snapshot the log is replayed on top of.
 type FileStorage struct {
 	MemStorage
-	file          *os.File
+	path          string
+	closed        bool
 	storeInterval int
+	keepSnapshots int
+	compress      bool
+	wal           *writeAheadLog
+	walMaxSize    int64
+	// seq is the sequence number of the last update, guarded by mu.
+	seq uint64
+	// saveMu serializes writing the file.
+	saveMu sync.Mutex
 }
 
-func NewFileStorage(filename string, storeInterval int) (*FileStorage, error) {
+// NewFileStorage creates a FileStorage backed by filename with the given key mode.
+func NewFileStorage(filename string, storeInterval int, keyMode KeyMode) (*FileStorage, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		logger.Sugar.Fatalf("error open file: %v", err)
 		return nil, err
 	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
 
 	fs := &FileStorage{
 		MemStorage: MemStorage{
 			metrics: make(map[string]*metrics.Metrics),
+			keyMode: keyMode,
 		},
-		file:          file,
+		path:          filename,
 		storeInterval: storeInterval,
+		keepSnapshots: defaultKeepSnapshots,
 	}
 	return fs, nil
 }
 
-func (f *FileStorage) LoadMetrics() error {
-	data, err := os.ReadFile(f.file.Name())
+// SetSnapshotOptions sets the number of snapshots kept, including the current one,
+// and whether they are gzip-compressed.
+func (f *FileStorage) SetSnapshotOptions(keep int, compress bool) {
+	f.keepSnapshots = max(keep, 1)
+	f.compress = compress
+}
+
+// walPath returns the path of the write-ahead log of the file.
+func (f *FileStorage) walPath() string {
+	return f.path + ".wal"
+}
+
+// EnableWAL switches the storage to WAL mode. A snapshot is taken whenever the log
+// grows beyond maxSize bytes. It must be called before LoadMetrics.
+func (f *FileStorage) EnableWAL(maxSize int64) error {
+	wal, err := openWAL(f.walPath())
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+		return fmt.Errorf("error opening write-ahead log: %w", err)
 	}
+	f.wal = wal
+	f.walMaxSize = maxSize
+	return nil
+}
 
-	if len(data) == 0 {
+// LoadMetrics loads the newest valid snapshot, falling back to older ones if it is
+// corrupted, and replays the write-ahead log on top of it. If the log does not
+// continue the loaded snapshot, as after falling back to a snapshot older than the
+// one the log was emptied after, nothing is restored and errWALGap is returned.
+func (f *FileStorage) LoadMetrics() error {
+	removeTempSnapshots(f.path)
+	content, generation, err := readSnapshot(f.path)
+	switch {
+	case err != nil:
+		logger.Sugar.Errorf("error reading metrics from file: %v", err)
+		return err
+	case generation < 0:
 		logger.Sugar.Infoln("empty file, continue without loading saved data")
-		return nil
+	case generation > 0:
+		logger.Sugar.Warnf("current snapshot is corrupted, loaded the snapshot %s", snapshotPath(f.path, generation))
 	}
 
-	var loadedMetrics map[string]*metrics.Metrics
-	if err = json.Unmarshal(data, &loadedMetrics); err != nil {
-		logger.Sugar.Errorf("error reading metrics from file: %v", err)
+	records, validSize, err := readWAL(f.walPath())
+	if err != nil {
+		logger.Sugar.Errorf("error reading write-ahead log: %v", err)
 		return err
 	}
+	seq := content.Sequence
+	for _, record := range records {
+		if record.Seq <= seq {
+			continue
+		}
+		if record.Seq != seq+1 {
+			err = fmt.Errorf("%w: the snapshot ends at record %d, the log continues at record %d",
+				errWALGap, seq, record.Seq)
+			logger.Sugar.Errorf("error restoring metrics: %v", err)
+			return err
+		}
+		seq = record.Seq
+	}
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	for id, metric := range loadedMetrics {
-		f.metrics[id] = metric
+	var errs []error
+	for _, metric := range content.Metrics {
+		if err = f.update(metric); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return nil
+	f.seq = content.Sequence
+	replayed := 0
+	for _, record := range records {
+		if record.Seq <= f.seq {
+			continue
+		}
+		for _, metric := range record.updates() {
+			if err = f.update(metric); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		f.seq = record.Seq
+		replayed++
+	}
+	if replayed > 0 {
+		logger.Sugar.Infof("replayed %d records of the write-ahead log", replayed)
+	}
+
+	if f.wal != nil && validSize < f.wal.size {
+		logger.Sugar.Warnf("dropping torn write-ahead log record at offset %d", validSize)
+		if err = f.wal.truncate(validSize); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (f *FileStorage) Update(ctx context.Context, metric *metrics.Metrics) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	switch metric.MType {
-	case "counter":
-		if oldMetric, ok := f.metrics[metric.ID]; ok {
-			if oldDelta := oldMetric.Delta; oldDelta != nil {
-				newDelta := *metric.Delta + *oldDelta
-				newMetric := &metrics.Metrics{
-					ID:    metric.ID,
-					MType: metric.MType,
-					Delta: &newDelta,
-				}
-				f.metrics[metric.ID] = newMetric
-			}
-		} else {
-			f.metrics[metric.ID] = metric
+// decodeFile decodes the content of a storage file, migrating files of version 1.
+func decodeFile(data []byte) (fileContent, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return fileContent{}, err
+	}
+	if _, ok := probe["version"]; !ok {
+		var legacyMetrics map[string]*metrics.Metrics
+		if err := json.Unmarshal(data, &legacyMetrics); err != nil {
+			return fileContent{}, err
+		}
+		logger.Sugar.Infoln("migrating metrics file from version 1")
+		content := fileContent{Version: fileFormatVersion, Metrics: make([]*metrics.Metrics, 0, len(legacyMetrics))}
+		for _, key := range sortedKeys(legacyMetrics) {
+			content.Metrics = append(content.Metrics, legacyMetrics[key])
 		}
-	case "gauge":
-		f.metrics[metric.ID] = metric
+		return content, nil
+	}
+
+	var content fileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return fileContent{}, err
+	}
+	if content.Version != fileFormatVersion {
+		return fileContent{}, fmt.Errorf("unsupported file format version %d", content.Version)
 	}
+	return content, nil
+}
 
+func (f *FileStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	if f.wal != nil {
+		return f.appendMetrics(ctx, []*metrics.Metrics{metric})
+	}
 	if f.storeInterval == 0 {
+		return f.saveUpdate(func() ([]*metrics.Metrics, error) {
+			admitted, errs := f.admit([]*metrics.Metrics{metric})
+			return admitted, errors.Join(errs...)
+		})
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.update(metric)
+}
+
+// saveUpdate applies the metrics returned by admit, which is called with the lock held,
+// and saves the file, as every write does with a zero store interval. If the file cannot
+// be written, the metrics are rolled back, so the write fails with ErrUnavailable without
+// changing anything. The error returned by admit is joined with the result.
+func (f *FileStorage) saveUpdate(admit func() ([]*metrics.Metrics, error)) error {
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+
+	f.mu.Lock()
+	admitted, rejected := admit()
+	if len(admitted) == 0 {
 		f.mu.Unlock()
-		err := f.SaveMetrics(ctx)
-		if err != nil {
-			logger.Sugar.Error("error write data")
-		}
+		return rejected
+	}
+	previous := f.applyAll(admitted)
+	content := f.snapshot()
+	f.mu.Unlock()
+
+	if err := f.writeFile(content); err != nil {
+		// the writes are serialized by saveMu, so no other one is rolled back
 		f.mu.Lock()
+		f.restore(previous)
+		f.mu.Unlock()
+		return errors.Join(rejected, fmt.Errorf("%w: %v", ErrUnavailable, err))
+	}
+	return rejected
+}
+
+// appendMetrics appends the valid metrics of the batch to the write-ahead log with a
+// single write and applies them once they are logged. It takes a snapshot if the log
+// has grown too large.
+func (f *FileStorage) appendMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	f.mu.Lock()
+	admitted, errs := f.admit(batchOfMetrics)
+	records := make([]walRecord, len(admitted))
+	for i, metric := range admitted {
+		records[i] = walRecord{Seq: f.seq + uint64(i) + 1, Metric: metric}
+	}
+	// the metrics are applied once they are logged, so a failed append changes nothing
+	err := f.wal.append(records)
+	if err == nil {
+		for _, metric := range admitted {
+			f.apply(metric)
+		}
+		f.seq += uint64(len(admitted))
+	}
+	compact := err == nil && f.wal.size > f.walMaxSize
+	f.mu.Unlock()
+
+	if err != nil {
+		logger.Sugar.Errorf("error appending to write-ahead log: %v", err)
+		return errors.Join(append(errs, walError(err))...)
+	}
+	if compact {
+		if err = f.SaveMetrics(ctx); err != nil {
+			logger.Sugar.Errorf("error compacting write-ahead log: %v", err)
+		}
 	}
+	return errors.Join(errs...)
 }
 
-func (f *FileStorage) SaveMetrics(ctx context.Context) error {
-	if err := f.file.Truncate(0); err != nil {
+func (f *FileStorage) UpdateMetricsAtomic(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if f.wal != nil {
+		return f.appendMetricsAtomic(ctx, batchOfMetrics)
+	}
+	if f.storeInterval > 0 {
+		return f.MemStorage.UpdateMetricsAtomic(ctx, batchOfMetrics)
+	}
+	if err := validateBatch(batchOfMetrics, f.keyMode); err != nil {
 		return err
 	}
+	return f.saveUpdate(func() ([]*metrics.Metrics, error) {
+		if err := f.conflicts(batchOfMetrics); err != nil {
+			return nil, err
+		}
+		return batchOfMetrics, nil
+	})
+}
 
-	if _, err := f.file.Seek(0, 0); err != nil {
+// appendMetricsAtomic appends the valid batch to the write-ahead log as a single record
+// and applies it once it is written. It takes a snapshot if the log has grown too large.
+func (f *FileStorage) appendMetricsAtomic(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := validateBatch(batchOfMetrics, f.keyMode); err != nil || len(batchOfMetrics) == 0 {
+		return err
+	}
+	f.mu.Lock()
+	if err := f.conflicts(batchOfMetrics); err != nil {
+		f.mu.Unlock()
 		return err
 	}
+	err := f.wal.append([]walRecord{{Seq: f.seq + 1, Batch: batchOfMetrics}})
+	if err == nil {
+		for _, metric := range batchOfMetrics {
+			f.apply(metric)
+		}
+		f.seq++
+	}
+	compact := err == nil && f.wal.size > f.walMaxSize
+	f.mu.Unlock()
 
-	metricsMap := f.GetAllMetrics(ctx)
-	data, err := json.Marshal(metricsMap)
 	if err != nil {
-		logger.Sugar.Errorf("error marshaling: %v", err)
+		logger.Sugar.Errorf("error appending to write-ahead log: %v", err)
+		return walError(err)
+	}
+	if compact {
+		if err = f.SaveMetrics(ctx); err != nil {
+			logger.Sugar.Errorf("error compacting write-ahead log: %v", err)
+		}
+	}
+	return nil
+}
+
+// walError wraps ErrUnavailable around the error of a failed append, and ErrOutcomeUnknown
+// if the append could not be undone, so its records may be replayed on restart.
+func walError(err error) error {
+	if errors.Is(err, errWALTorn) {
+		return fmt.Errorf("%w: %w: %v", ErrUnavailable, ErrOutcomeUnknown, err)
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
+
+// SaveMetrics writes all metrics to the file. In WAL mode it also empties the log,
+// blocking updates until the log is compacted.
+func (f *FileStorage) SaveMetrics(_ context.Context) error {
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+
+	f.mu.Lock()
+	content := f.snapshot()
+	if f.wal == nil {
+		f.mu.Unlock()
+		return f.writeFile(content)
+	}
+	defer f.mu.Unlock()
+
+	if err := f.writeFile(content); err != nil {
 		return err
 	}
+	// records up to content.Sequence are skipped on replay, so a crash before
+	// the log is emptied does not apply them twice
+	return f.wal.truncate(0)
+}
 
-	if _, err := f.file.Write(data); err != nil {
-		logger.Sugar.Errorf("error writing data to a file: %v", err)
+// snapshot returns the file content of the current metrics. The caller must hold the lock.
+func (f *FileStorage) snapshot() fileContent {
+	content := fileContent{Version: fileFormatVersion, Sequence: f.seq, Metrics: make([]*metrics.Metrics, 0, len(f.metrics))}
+	for _, key := range sortedKeys(f.metrics) {
+		metricCopy := *f.metrics[key]
+		content.Metrics = append(content.Metrics, &metricCopy)
+	}
+	return content
+}
+
+func (f *FileStorage) writeFile(content fileContent) error {
+	data, err := encodeSnapshot(content, f.compress)
+	if err != nil {
+		logger.Sugar.Errorf("error marshaling: %v", err)
 		return err
 	}
-	if err := f.file.Sync(); err != nil {
-		logger.Sugar.Errorf("error syncing file: %v", err)
+	if err = writeSnapshot(f.path, data, f.keepSnapshots); err != nil {
+		logger.Sugar.Errorf("error writing data to a file: %v", err)
 		return err
 	}
-
 	return nil
 }
 
@@ -136,19 +502,19 @@ func (f *FileStorage) AsyncSave() {
 }
 
 func (f *FileStorage) Close() error {
-	if f.file != nil {
-		if err := f.SaveMetrics(context.TODO()); err != nil {
-			logger.Sugar.Errorf("error writing when closing: %v", err)
-			err = f.file.Close()
-			if err != nil {
-				logger.Sugar.Errorf("error with closing file: %v", err)
-				return err
+	if f.path != "" && !f.closed {
+		saveErr := f.SaveMetrics(context.TODO())
+		if saveErr != nil {
+			logger.Sugar.Errorf("error writing when closing: %v", saveErr)
+		}
+		var walErr error
+		if f.wal != nil {
+			if walErr = f.wal.close(); walErr != nil {
+				logger.Sugar.Errorf("error with closing file: %v", walErr)
 			}
-			return err
 		}
-		err := f.file.Close()
-		f.file = nil
-		return err
+		f.closed = true
+		return errors.Join(saveErr, walErr)
 	}
 
 	return nil
@@ -158,9 +524,26 @@ func (f *FileStorage) Ping(_ context.Context) error {
 	return nil
 }
 
-func (f *FileStorage) UpdateMetrics(ctx context.Context, metrics []*metrics.Metrics) error {
-	for _, metric := range metrics {
-		f.Update(ctx, metric)
+// UpdateMetrics applies every valid metric of the batch. It appends them to the
+// write-ahead log in WAL mode, otherwise it saves the file once if periodic saving is disabled.
+func (f *FileStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if f.wal != nil {
+		return f.appendMetrics(ctx, batchOfMetrics)
 	}
-	return nil
+	if f.storeInterval > 0 {
+		return f.MemStorage.UpdateMetrics(ctx, batchOfMetrics)
+	}
+	return f.saveUpdate(func() ([]*metrics.Metrics, error) {
+		admitted, errs := f.admit(batchOfMetrics)
+		return admitted, errors.Join(errs...)
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/evgfitil/go-metrics-server.git/internal/logger"
 	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
@@ -17,7 +19,7 @@ func TestNewFileStorage(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(file.Name())
 
-	fs, err := NewFileStorage(file.Name(), 10)
+	fs, err := NewFileStorage(file.Name(), 10, KeyModeTyped)
 	assert.NoError(t, err)
 	assert.NotNil(t, fs)
 }
@@ -27,7 +29,7 @@ func TestSaveMetrics(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(file.Name())
 
-	fs, err := NewFileStorage(file.Name(), 10)
+	fs, err := NewFileStorage(file.Name(), 10, KeyModeTyped)
 	assert.NoError(t, err)
 	assert.NotNil(t, fs)
 
@@ -40,7 +42,7 @@ func TestClose(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(file.Name())
 
-	fs, err := NewFileStorage(file.Name(), 10)
+	fs, err := NewFileStorage(file.Name(), 10, KeyModeTyped)
 	assert.NoError(t, err)
 	assert.NotNil(t, fs)
 
@@ -73,12 +75,12 @@ func TestLoadMetrics(t *testing.T) {
 		defer os.Remove(tmpfile.Name())
 
 		metricValue := 1.1
-		expectedMetrics := map[string]*metrics.Metrics{
-			"metric1": {ID: "metric1", Value: &metricValue},
-			"metric2": {ID: "metric2", Value: &metricValue},
+		metricDelta := int64(3)
+		expectedMetrics := []*metrics.Metrics{
+			{ID: "metric1", MType: "gauge", Value: &metricValue},
+			{ID: "metric1", MType: "counter", Delta: &metricDelta},
 		}
-
-		data, err := json.Marshal(expectedMetrics)
+		data, err := json.Marshal(fileContent{Version: fileFormatVersion, Metrics: expectedMetrics})
 		assert.NoError(t, err)
 
 		_, err = tmpfile.Write(data)
@@ -87,26 +89,78 @@ func TestLoadMetrics(t *testing.T) {
 		err = tmpfile.Close()
 		assert.NoError(t, err)
 
-		fs, err := NewFileStorage(tmpfile.Name(), 0)
+		fs, err := NewFileStorage(tmpfile.Name(), 0, KeyModeTyped)
 		assert.NoError(t, err)
 
 		err = fs.LoadMetrics()
 		assert.NoError(t, err)
 
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
-
-		for id, expectedMetric := range expectedMetrics {
-			actualMetric, exists := fs.metrics[id]
-			assert.True(t, exists, "Metric %s not found", id)
-			assert.Equal(t, expectedMetric.ID, actualMetric.ID)
-			assert.Equal(t, expectedMetric.Value, actualMetric.Value)
+		for _, expectedMetric := range expectedMetrics {
+			actualMetric, err := fs.Get(context.Background(), expectedMetric.ID, expectedMetric.MType)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedMetric, actualMetric)
 		}
 	})
 
+	// File in the format of version 1, keyed by metric name
+	t.Run("LegacyFormat", func(t *testing.T) {
+		tmpfile, err := os.CreateTemp("", "metrics*.json")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		legacyJSON := []byte(`{"metric1": {"id": "metric1", "type": "gauge", "value": 1.1}, "metric2": {"id": "metric2", "type": "counter", "delta": 5}}`)
+		_, err = tmpfile.Write(legacyJSON)
+		assert.NoError(t, err)
+
+		err = tmpfile.Close()
+		assert.NoError(t, err)
+
+		fs, err := NewFileStorage(tmpfile.Name(), 0, KeyModeTyped)
+		assert.NoError(t, err)
+
+		err = fs.LoadMetrics()
+		assert.NoError(t, err)
+
+		gauge, err := fs.Get(context.Background(), "metric1", "gauge")
+		assert.NoError(t, err)
+		assert.Equal(t, 1.1, *gauge.Value)
+		counter, err := fs.Get(context.Background(), "metric2", "counter")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), *counter.Delta)
+
+		// the next save migrates the file to the current format
+		err = fs.SaveMetrics(context.Background())
+		assert.NoError(t, err)
+		data, err := os.ReadFile(tmpfile.Name())
+		assert.NoError(t, err)
+		content, err := decodeSnapshot(data)
+		assert.NoError(t, err)
+		assert.Equal(t, fileFormatVersion, content.Version)
+		assert.Len(t, content.Metrics, 2)
+	})
+
+	// Unknown format version
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		tmpfile, err := os.CreateTemp("", "metrics*.json")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(`{"version": 99, "metrics": []}`))
+		assert.NoError(t, err)
+
+		err = tmpfile.Close()
+		assert.NoError(t, err)
+
+		fs, err := NewFileStorage(tmpfile.Name(), 0, KeyModeTyped)
+		assert.NoError(t, err)
+
+		err = fs.LoadMetrics()
+		assert.Error(t, err)
+	})
+
 	// File does not exist
 	t.Run("FileDoesNotExist", func(t *testing.T) {
-		fs, err := NewFileStorage("nonexistent_file.json", 0)
+		fs, err := NewFileStorage(filepath.Join(t.TempDir(), "nonexistent_file.json"), 0, KeyModeTyped)
 		assert.NoError(t, err)
 
 		err = fs.LoadMetrics()
@@ -119,7 +173,7 @@ func TestLoadMetrics(t *testing.T) {
 		assert.NoError(t, err)
 		defer os.Remove(tmpfile.Name())
 
-		fs, err := NewFileStorage(tmpfile.Name(), 0)
+		fs, err := NewFileStorage(tmpfile.Name(), 0, KeyModeTyped)
 		assert.NoError(t, err)
 
 		err = fs.LoadMetrics()
@@ -139,10 +193,199 @@ func TestLoadMetrics(t *testing.T) {
 		err = tmpfile.Close()
 		assert.NoError(t, err)
 
-		fs, err := NewFileStorage(tmpfile.Name(), 0)
+		fs, err := NewFileStorage(tmpfile.Name(), 0, KeyModeTyped)
 		assert.NoError(t, err)
 
 		err = fs.LoadMetrics()
 		assert.Error(t, err)
 	})
 }
+
+func newTestWALStorage(t *testing.T, path string, maxSize int64) *FileStorage {
+	fs, err := NewFileStorage(path, 0, KeyModeTyped)
+	require.NoError(t, err)
+	require.NoError(t, fs.EnableWAL(maxSize))
+	require.NoError(t, fs.LoadMetrics())
+	return fs
+}
+
+func TestFileStorage_WAL(t *testing.T) {
+	logger.InitLogger()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := newTestWALStorage(t, path, defaultWALMaxSize)
+	require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(2)}))
+	require.NoError(t, fs.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "X", MType: "counter", Delta: int64Ptr(3)},
+		{ID: "Y", MType: "gauge", Value: float64Ptr(1.5)},
+	}))
+	assert.ErrorIs(t, fs.Update(ctx, &metrics.Metrics{ID: "Z", MType: "gauge"}), ErrInvalidMetric)
+
+	// updates are only appended to the log
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	// a crash leaves a torn record at the end of the log
+	walFile, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = walFile.Write([]byte{0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, walFile.Close())
+
+	restored := newTestWALStorage(t, path, defaultWALMaxSize)
+	counter, err := restored.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *counter.Delta)
+	gauge, err := restored.Get(ctx, "Y", "gauge")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *gauge.Value)
+
+	// the torn record is dropped, so new records follow the valid ones
+	require.NoError(t, restored.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+	require.NoError(t, restored.Close())
+
+	// closing takes a snapshot and empties the log
+	info, err = os.Stat(path + ".wal")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	restored = newTestWALStorage(t, path, defaultWALMaxSize)
+	counter, err = restored.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *counter.Delta)
+	require.NoError(t, restored.Close())
+}
+
+func TestFileStorage_WALAppendFailure(t *testing.T) {
+	logger.InitLogger()
+	ctx := context.Background()
+	fs := newTestWALStorage(t, filepath.Join(t.TempDir(), "metrics.json"), defaultWALMaxSize)
+	require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(2)}))
+
+	// a metric is applied only once it is logged
+	require.NoError(t, fs.wal.file.Close())
+	err := fs.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "X", MType: "counter", Delta: int64Ptr(3)},
+		{ID: "Y", MType: "gauge", Value: float64Ptr(1.5)},
+	})
+	assert.ErrorIs(t, err, ErrUnavailable)
+	counter, err := fs.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *counter.Delta)
+	_, err = fs.Get(ctx, "Y", "gauge")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFileStorage_SaveFailure(t *testing.T) {
+	logger.InitLogger()
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	fs, err := NewFileStorage(filepath.Join(dir, "metrics.json"), 0, KeyModeStrict)
+	require.NoError(t, err)
+	require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(2)}))
+
+	// a write that cannot be saved is rolled back
+	require.NoError(t, os.RemoveAll(dir))
+	err = fs.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "X", MType: "counter", Delta: int64Ptr(3)},
+		{ID: "Y", MType: "gauge", Value: float64Ptr(1.5)},
+		{ID: "X", MType: "gauge", Value: float64Ptr(1)},
+	})
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	assert.NotErrorIs(t, err, ErrOutcomeUnknown)
+	assert.ErrorIs(t, fs.UpdateMetricsAtomic(ctx, []*metrics.Metrics{{ID: "Y", MType: "gauge", Value: float64Ptr(1.5)}}), ErrUnavailable)
+	assert.ErrorIs(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(3)}), ErrUnavailable)
+	counter, err := fs.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *counter.Delta)
+	_, err = fs.Get(ctx, "Y", "gauge")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// and applied once the file can be written again
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(3)}))
+	counter, err = fs.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *counter.Delta)
+}
+
+func TestFileStorage_WALCompaction(t *testing.T) {
+	logger.InitLogger()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := newTestWALStorage(t, path, 512)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+	}
+	assert.LessOrEqual(t, fs.wal.size, int64(512))
+
+	// the snapshot and the records after it hold every update
+	restored := newTestWALStorage(t, path, 512)
+	counter, err := restored.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), *counter.Delta)
+}
+
+func TestFileStorage_WALSnapshotBeforeTruncate(t *testing.T) {
+	logger.InitLogger()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := newTestWALStorage(t, path, defaultWALMaxSize)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+	}
+	// a crash after writing the snapshot but before emptying the log
+	fs.mu.Lock()
+	require.NoError(t, fs.writeFile(fs.snapshot()))
+	fs.mu.Unlock()
+	require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+
+	restored := newTestWALStorage(t, path, defaultWALMaxSize)
+	counter, err := restored.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *counter.Delta)
+}
+
+func TestFileStorage_WALGap(t *testing.T) {
+	logger.InitLogger()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := newTestWALStorage(t, path, defaultWALMaxSize)
+	fs.SetSnapshotOptions(2, false)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+		require.NoError(t, fs.SaveMetrics(ctx))
+	}
+	require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+	require.NoError(t, fs.wal.close())
+
+	// the older snapshot misses the record the log was emptied after
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	corrupted := data[:len(data)/2]
+	require.NoError(t, os.WriteFile(path, corrupted, 0644))
+
+	restored, err := NewFileStorage(path, 0, KeyModeTyped)
+	require.NoError(t, err)
+	require.NoError(t, restored.EnableWAL(defaultWALMaxSize))
+	assert.ErrorIs(t, restored.LoadMetrics(), errWALGap)
+	_, err = restored.Get(ctx, "X", "counter")
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, restored.wal.close())
+
+	// opening fails and leaves the files as they are
+	_, err = Open("file://"+path+"?interval=0&wal=true", Options{KeyMode: KeyModeTyped})
+	assert.ErrorIs(t, err, errWALGap)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, corrupted, data)
+	info, err := os.Stat(path + ".wal")
+	require.NoError(t, err)
+	assert.NotZero(t, info.Size())
+}
@@ -2,64 +2,204 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
 	"sync"
 
 	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
 )
 
+func init() {
+	Register("memory", openMemStorage)
+}
+
+// openMemStorage opens a MemStorage from a URL of the form "memory://", or
+// a ShardedMemStorage from "memory://?shards=32".
+func openMemStorage(u *url.URL, opts Options) (Storage, error) {
+	if err := checkParams(u, "shards"); err != nil {
+		return nil, err
+	}
+	if value := u.Query().Get("shards"); value != "" {
+		shards, err := strconv.Atoi(value)
+		if err != nil || shards < 1 {
+			return nil, fmt.Errorf("invalid shards %q of memory storage: must be a positive number", value)
+		}
+		return NewShardedMemStorage(shards, opts.KeyMode), nil
+	}
+	return NewMemStorageWithKeyMode(opts.KeyMode), nil
+}
+
+// MemStorage keeps metrics in memory, keyed by MetricKey.
 type MemStorage struct {
 	metrics map[string]*metrics.Metrics
+	keyMode KeyMode
 	mu      sync.RWMutex
 }
 
+// NewMemStorage creates an empty MemStorage in KeyModeTyped.
 func NewMemStorage() *MemStorage {
+	return NewMemStorageWithKeyMode(KeyModeTyped)
+}
+
+// NewMemStorageWithKeyMode creates an empty MemStorage with the given key mode.
+func NewMemStorageWithKeyMode(keyMode KeyMode) *MemStorage {
 	return &MemStorage{
 		metrics: make(map[string]*metrics.Metrics),
+		keyMode: keyMode,
 	}
 }
 
-func (m *MemStorage) Update(_ context.Context, metric *metrics.Metrics) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// conflict returns ErrTypeMismatch if the key mode is strict and the name is used
+// by a metric of another type. The caller must hold the lock.
+func (m *MemStorage) conflict(metricName, metricType string) error {
+	if m.keyMode != KeyModeStrict {
+		return nil
+	}
+	if _, ok := m.metrics[MetricKey(otherType(metricType), metricName)]; ok {
+		return typeMismatch(metricName, metricType)
+	}
+	return nil
+}
 
-	switch metric.MType {
-	case "counter":
-		if oldMetric, ok := m.metrics[metric.ID]; ok {
-			if oldDelta := oldMetric.Delta; oldDelta != nil {
-				newDelta := *metric.Delta + *oldDelta
-				newMetric := &metrics.Metrics{
-					ID:    metric.ID,
-					MType: metric.MType,
-					Delta: &newDelta,
-				}
-				m.metrics[metric.ID] = newMetric
+// update applies the metric to the storage. The caller must hold the write lock.
+func (m *MemStorage) update(metric *metrics.Metrics) error {
+	if err := ValidateMetric(metric); err != nil {
+		return err
+	}
+	if err := m.conflict(metric.ID, metric.MType); err != nil {
+		return err
+	}
+	m.apply(metric)
+	return nil
+}
+
+// conflicts returns the joined ErrTypeMismatch errors of the metrics of the batch.
+// The caller must hold the lock.
+func (m *MemStorage) conflicts(batchOfMetrics []*metrics.Metrics) error {
+	var errs []error
+	for _, metric := range batchOfMetrics {
+		if err := m.conflict(metric.ID, metric.MType); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// admit returns the metrics of the batch that update would apply and the errors of
+// the others, without changing the storage. In the strict key mode the first type of a
+// name in the batch wins. The caller must hold the lock.
+func (m *MemStorage) admit(batchOfMetrics []*metrics.Metrics) ([]*metrics.Metrics, []error) {
+	var errs []error
+	admitted := make([]*metrics.Metrics, 0, len(batchOfMetrics))
+	types := make(map[string]string)
+	for _, metric := range batchOfMetrics {
+		if err := ValidateMetric(metric); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		first, ok := types[metric.ID]
+		if ok && m.keyMode == KeyModeStrict && first != metric.MType {
+			errs = append(errs, typeMismatch(metric.ID, metric.MType))
+			continue
+		}
+		if !ok {
+			if err := m.conflict(metric.ID, metric.MType); err != nil {
+				errs = append(errs, err)
+				continue
 			}
+			types[metric.ID] = metric.MType
+		}
+		admitted = append(admitted, metric)
+	}
+	return admitted, errs
+}
+
+// applyAll applies the valid metrics and returns the previous metrics of their keys,
+// nil for the new ones, which restore puts back. The caller must hold the write lock.
+func (m *MemStorage) applyAll(batchOfMetrics []*metrics.Metrics) map[string]*metrics.Metrics {
+	previous := make(map[string]*metrics.Metrics, len(batchOfMetrics))
+	for _, metric := range batchOfMetrics {
+		key := MetricKey(metric.MType, metric.ID)
+		if _, ok := previous[key]; !ok {
+			previous[key] = m.metrics[key]
+		}
+		m.apply(metric)
+	}
+	return previous
+}
+
+// restore puts back the metrics returned by applyAll. The caller must hold the write lock.
+func (m *MemStorage) restore(previous map[string]*metrics.Metrics) {
+	for key, metric := range previous {
+		if metric == nil {
+			delete(m.metrics, key)
 		} else {
-			m.metrics[metric.ID] = metric
+			m.metrics[key] = metric
+		}
+	}
+}
+
+// apply applies the valid metric to the storage. The caller must hold the write lock.
+func (m *MemStorage) apply(metric *metrics.Metrics) {
+	key := MetricKey(metric.MType, metric.ID)
+	oldMetric, ok := m.metrics[key]
+
+	switch metric.MType {
+	case "counter":
+		newDelta := *metric.Delta
+		if ok {
+			newDelta += *oldMetric.Delta
+		}
+		m.metrics[key] = &metrics.Metrics{
+			ID:    metric.ID,
+			MType: metric.MType,
+			Delta: &newDelta,
 		}
 	case "gauge":
-		m.metrics[metric.ID] = metric
+		newValue := *metric.Value
+		m.metrics[key] = &metrics.Metrics{
+			ID:    metric.ID,
+			MType: metric.MType,
+			Value: &newValue,
+		}
 	}
 }
 
-func (m *MemStorage) Get(_ context.Context, metricName string, _ string) (*metrics.Metrics, bool) {
+func (m *MemStorage) Update(_ context.Context, metric *metrics.Metrics) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.update(metric)
+}
+
+func (m *MemStorage) Get(_ context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	if err := validateType(metricType); err != nil {
+		return nil, err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	metric, ok := m.metrics[metricName]
-	return metric, ok
+	metric, ok := m.metrics[MetricKey(metricType, metricName)]
+	if !ok {
+		if err := m.conflict(metricName, metricType); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s %s", ErrNotFound, metricType, metricName)
+	}
+	return copyMetric(metric), nil
 }
 
-func (m *MemStorage) GetAllMetrics(_ context.Context) map[string]*metrics.Metrics {
+func (m *MemStorage) GetAllMetrics(_ context.Context) (map[string]*metrics.Metrics, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	result := make(map[string]*metrics.Metrics)
 	for key, value := range m.metrics {
-		metricCopy := *value
-		result[key] = &metricCopy
+		result[key] = copyMetric(value)
 	}
-	return result
+	return result, nil
 }
 
 func (m *MemStorage) SaveMetrics(_ context.Context) error {
@@ -70,44 +210,35 @@ func (m *MemStorage) Ping(_ context.Context) error {
 	return nil
 }
 
-func (m *MemStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+// UpdateMetrics applies every valid metric of the batch and returns the joined
+// errors of the metrics it could not apply.
+func (m *MemStorage) UpdateMetrics(_ context.Context, batchOfMetrics []*metrics.Metrics) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	var errs []error
 	for _, metric := range batchOfMetrics {
-		if metric == nil || metric.MType == "" || metric.ID == "" {
-			continue
+		if err := m.update(metric); err != nil {
+			errs = append(errs, err)
 		}
+	}
+	return errors.Join(errs...)
+}
 
-		switch metric.MType {
-		case "counter":
-			if metric.Delta == nil {
-				continue
-			}
-			oldMetric, ok := m.metrics[metric.ID]
-			if !ok {
-				m.metrics[metric.ID] = metric
-			} else if oldMetric.Delta != nil {
-				newDelta := *metric.Delta + *oldMetric.Delta
-				m.metrics[metric.ID] = &metrics.Metrics{
-					ID:    metric.ID,
-					MType: metric.MType,
-					Delta: &newDelta,
-				}
-			}
-		case "gauge":
-			if metric.Value == nil {
-				continue
-			}
-			oldMetric, ok := m.metrics[metric.ID]
-			if !ok || *oldMetric.Value != *metric.Value {
-				m.metrics[metric.ID] = metric
-			}
-		default:
-			continue
-		}
+// UpdateMetricsAtomic applies every metric of the batch or none of them.
+func (m *MemStorage) UpdateMetricsAtomic(_ context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := validateBatch(batchOfMetrics, m.keyMode); err != nil {
+		return err
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	if err := m.conflicts(batchOfMetrics); err != nil {
+		return err
+	}
+	for _, metric := range batchOfMetrics {
+		m.apply(metric)
+	}
 	return nil
 }
 
@@ -41,7 +41,7 @@ func BenchmarkGetAllMetrics(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = storage.GetAllMetrics(context.Background())
+		_, _ = storage.GetAllMetrics(context.Background())
 	}
 }
 
@@ -60,3 +60,62 @@ func BenchmarkUpdateMetrics(b *testing.B) {
 		}
 	})
 }
+
+// parallelStorages are the in-memory storages compared under parallel load.
+var parallelStorages = []struct {
+	name    string
+	storage func() Storage
+}{
+	{name: "MemStorage", storage: func() Storage { return NewMemStorage() }},
+	{name: "ShardedMemStorage", storage: func() Storage { return NewShardedMemStorage(0, KeyModeTyped) }},
+}
+
+func BenchmarkParallelUpdate(b *testing.B) {
+	metricDelta := int64(1)
+	metricsSlice := make([]*metrics.Metrics, 1000)
+	for i := range metricsSlice {
+		metricsSlice[i] = &metrics.Metrics{ID: "metric_" + strconv.Itoa(i), MType: "counter", Delta: &metricDelta}
+	}
+
+	for _, bb := range parallelStorages {
+		b.Run(bb.name, func(b *testing.B) {
+			storage := bb.storage()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					_ = storage.Update(context.Background(), metricsSlice[i%len(metricsSlice)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkParallelUpdateWithReads(b *testing.B) {
+	metricValue := 0.5
+	metricsSlice := make([]*metrics.Metrics, 1000)
+	for i := range metricsSlice {
+		metricsSlice[i] = &metrics.Metrics{ID: "metric_" + strconv.Itoa(i), MType: "gauge", Value: &metricValue}
+	}
+
+	for _, bb := range parallelStorages {
+		b.Run(bb.name, func(b *testing.B) {
+			storage := bb.storage()
+			_ = storage.UpdateMetrics(context.Background(), metricsSlice)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					// every hundredth operation lists all metrics, as the index page does
+					if i%100 == 0 {
+						_, _ = storage.GetAllMetrics(context.Background())
+					} else {
+						_ = storage.Update(context.Background(), metricsSlice[i%len(metricsSlice)])
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -30,6 +30,7 @@ func TestNewMemStorage(t *testing.T) {
 func TestMemStorage_Get(t *testing.T) {
 	type fields struct {
 		metrics map[string]*metrics.Metrics
+		keyMode KeyMode
 	}
 	type args struct {
 		in0        context.Context
@@ -37,52 +38,90 @@ func TestMemStorage_Get(t *testing.T) {
 		in2        string
 	}
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   *metrics.Metrics
-		want1  bool
+		name    string
+		fields  fields
+		args    args
+		want    *metrics.Metrics
+		wantErr error
 	}{
 		{
 			name: "get existing metric",
 			fields: fields{metrics: map[string]*metrics.Metrics{
-				"testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(10)},
+				"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(10)},
 			}},
 			args: args{
 				in0:        context.Background(),
 				metricName: "testCounter",
+				in2:        "counter",
 			},
-			want:  &metrics.Metrics{ID: "testCounter", MType: "counter", Delta: int64Ptr(10)},
-			want1: true,
+			want: &metrics.Metrics{ID: "testCounter", MType: "counter", Delta: int64Ptr(10)},
 		},
 		{
-			name:   "get non-existing metric",
-			fields: fields{},
-			args:   args{in0: context.Background(), metricName: "testCounter"},
-			want:   nil,
-			want1:  false,
+			name:    "get non-existing metric",
+			fields:  fields{},
+			args:    args{in0: context.Background(), metricName: "testCounter", in2: "counter"},
+			want:    nil,
+			wantErr: ErrNotFound,
 		},
 		{
 			name: "get with empty metric name",
 			fields: fields{metrics: map[string]*metrics.Metrics{
-				"testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(10)},
+				"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(10)},
 			}},
 			args: args{
 				in0:        context.Background(),
 				metricName: "",
+				in2:        "counter",
+			},
+			want:    nil,
+			wantErr: ErrNotFound,
+		},
+		{
+			name: "get metric with another type",
+			fields: fields{metrics: map[string]*metrics.Metrics{
+				"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(10)},
+			}},
+			args: args{
+				in0:        context.Background(),
+				metricName: "testCounter",
+				in2:        "gauge",
 			},
-			want:  nil,
-			want1: false,
+			want:    nil,
+			wantErr: ErrNotFound,
+		},
+		{
+			name: "get metric with another type in strict mode",
+			fields: fields{
+				metrics: map[string]*metrics.Metrics{
+					"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(10)},
+				},
+				keyMode: KeyModeStrict,
+			},
+			args: args{
+				in0:        context.Background(),
+				metricName: "testCounter",
+				in2:        "gauge",
+			},
+			want:    nil,
+			wantErr: ErrTypeMismatch,
+		},
+		{
+			name:    "get metric of unsupported type",
+			fields:  fields{},
+			args:    args{in0: context.Background(), metricName: "testCounter", in2: "histogram"},
+			want:    nil,
+			wantErr: ErrInvalidMetric,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &MemStorage{
 				metrics: tt.fields.metrics,
+				keyMode: tt.fields.keyMode,
 			}
-			got, got1 := m.Get(tt.args.in0, tt.args.metricName, tt.args.in2)
+			got, err := m.Get(tt.args.in0, tt.args.metricName, tt.args.in2)
 			assert.Equalf(t, tt.want, got, "Get(%v, %v, %v)", tt.args.in0, tt.args.metricName, tt.args.in2)
-			assert.Equalf(t, tt.want1, got1, "Get(%v, %v, %v)", tt.args.in0, tt.args.metricName, tt.args.in2)
+			assert.ErrorIsf(t, err, tt.wantErr, "Get(%v, %v, %v)", tt.args.in0, tt.args.metricName, tt.args.in2)
 		})
 	}
 }
@@ -121,7 +160,7 @@ func TestMemStorage_Update(t *testing.T) {
 		},
 		{
 			name:   "successful update existing counter",
-			fields: fields{metrics: map[string]*metrics.Metrics{"testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(2)}}},
+			fields: fields{metrics: map[string]*metrics.Metrics{"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(2)}}},
 			args: args{
 				in0:    context.Background(),
 				metric: &metrics.Metrics{ID: "testCounter", MType: "counter", Delta: int64Ptr(1)},
@@ -131,7 +170,7 @@ func TestMemStorage_Update(t *testing.T) {
 		{
 			name: "successful update existing gauge",
 			fields: fields{metrics: map[string]*metrics.Metrics{
-				"testGauge": {ID: "testGauge", MType: "gauge", Value: float64Ptr(46.6)}}},
+				"gauge:testGauge": {ID: "testGauge", MType: "gauge", Value: float64Ptr(46.6)}}},
 			args: args{
 				in0:    context.Background(),
 				metric: &metrics.Metrics{ID: "testGauge", MType: "gauge", Value: float64Ptr(24.6)},
@@ -145,17 +184,73 @@ func TestMemStorage_Update(t *testing.T) {
 			m := &MemStorage{
 				metrics: tt.fields.metrics,
 			}
-			m.Update(tt.args.in0, tt.args.metric)
-			storedMetric, exists := m.metrics[tt.args.metric.ID]
+			err := m.Update(tt.args.in0, tt.args.metric)
+			assert.NoError(t, err)
+			storedMetric, exists := m.metrics[MetricKey(tt.args.metric.MType, tt.args.metric.ID)]
 			assert.True(t, exists)
 			assert.Equal(t, tt.expectedMetric, storedMetric)
 		})
 	}
 }
 
+func TestMemStorage_UpdateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  *metrics.Metrics
+		wantErr error
+	}{
+		{
+			name:    "gauge over counter",
+			metric:  &metrics.Metrics{ID: "testCounter", MType: "gauge", Value: float64Ptr(1.5)},
+			wantErr: ErrTypeMismatch,
+		},
+		{
+			name:    "counter without delta",
+			metric:  &metrics.Metrics{ID: "testCounter", MType: "counter"},
+			wantErr: ErrInvalidMetric,
+		},
+		{
+			name:    "unsupported type",
+			metric:  &metrics.Metrics{ID: "testHistogram", MType: "histogram", Value: float64Ptr(1.5)},
+			wantErr: ErrInvalidMetric,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MemStorage{
+				metrics: map[string]*metrics.Metrics{"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(2)}},
+				keyMode: KeyModeStrict,
+			}
+			err := m.Update(context.Background(), tt.metric)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Len(t, m.metrics, 1)
+			assert.Equal(t, int64(2), *m.metrics["counter:testCounter"].Delta)
+		})
+	}
+}
+
+func TestMemStorage_UpdateTyped(t *testing.T) {
+	m := NewMemStorage()
+	ctx := context.Background()
+
+	assert.NoError(t, m.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(2)}))
+	assert.NoError(t, m.Update(ctx, &metrics.Metrics{ID: "X", MType: "gauge", Value: float64Ptr(1.5)}))
+
+	counter, err := m.Get(ctx, "X", "counter")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), *counter.Delta)
+	gauge, err := m.Get(ctx, "X", "gauge")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, *gauge.Value)
+
+	allMetrics, err := m.GetAllMetrics(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, allMetrics, 2)
+}
+
 func TestMemStorage_UpdateConcurrent(t *testing.T) {
 	m := &MemStorage{
-		metrics: map[string]*metrics.Metrics{"testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(0)}},
+		metrics: map[string]*metrics.Metrics{"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(0)}},
 		mu:      sync.RWMutex{},
 	}
 
@@ -170,7 +265,7 @@ func TestMemStorage_UpdateConcurrent(t *testing.T) {
 	}
 	testWG.Wait()
 
-	storedMetric, exists := m.metrics["testCounter"]
+	storedMetric, exists := m.metrics["counter:testCounter"]
 	assert.True(t, exists)
 	assert.Equal(t, *storedMetric.Delta, *int64Ptr(100))
 }
@@ -204,12 +299,12 @@ func TestMemStorage_GetAllMetrics(t *testing.T) {
 			name: "mixed metric types",
 			fields: fields{
 				metrics: map[string]*metrics.Metrics{
-					"gaugeMetric": {
+					"gauge:gaugeMetric": {
 						ID:    "gaugeMetric",
 						MType: "gauge",
 						Value: float64Ptr(123.456),
 					},
-					"counterMetric": {
+					"counter:counterMetric": {
 						ID:    "counterMetric",
 						MType: "counter",
 						Delta: int64Ptr(789),
@@ -221,12 +316,12 @@ func TestMemStorage_GetAllMetrics(t *testing.T) {
 				in0: context.Background(),
 			},
 			want: map[string]*metrics.Metrics{
-				"gaugeMetric": {
+				"gauge:gaugeMetric": {
 					ID:    "gaugeMetric",
 					MType: "gauge",
 					Value: float64Ptr(123.456),
 				},
-				"counterMetric": {
+				"counter:counterMetric": {
 					ID:    "counterMetric",
 					MType: "counter",
 					Delta: int64Ptr(789),
@@ -237,7 +332,7 @@ func TestMemStorage_GetAllMetrics(t *testing.T) {
 			name: "concurrent access",
 			fields: fields{
 				metrics: map[string]*metrics.Metrics{
-					"counterMetric": {
+					"counter:counterMetric": {
 						ID:    "counterMetric",
 						MType: "counter",
 						Delta: int64Ptr(0),
@@ -249,7 +344,7 @@ func TestMemStorage_GetAllMetrics(t *testing.T) {
 				in0: context.Background(),
 			},
 			want: map[string]*metrics.Metrics{
-				"counterMetric": {
+				"counter:counterMetric": {
 					ID:    "counterMetric",
 					MType: "counter",
 					Delta: int64Ptr(100),
@@ -282,7 +377,8 @@ func TestMemStorage_GetAllMetrics(t *testing.T) {
 				testWG.Wait()
 			}
 
-			got := m.GetAllMetrics(tt.args.in0)
+			got, err := m.GetAllMetrics(tt.args.in0)
+			assert.NoError(t, err)
 			assert.Equalf(t, tt.want, got, "GetAllMetrics(%v)", tt.args.in0)
 		})
 	}
@@ -336,7 +432,7 @@ func TestMemStorage_UpdateMetrics(t *testing.T) {
 				expected := make(map[string]*metrics.Metrics)
 				for i := 0; i < 10000; i++ {
 					id := "metric" + strconv.Itoa(i)
-					expected[id] = &metrics.Metrics{
+					expected[MetricKey("gauge", id)] = &metrics.Metrics{
 						ID:    id,
 						MType: "gauge",
 						Value: float64Ptr(float64(i) + 0.1),
@@ -358,7 +454,7 @@ func TestMemStorage_UpdateMetrics(t *testing.T) {
 				expected := make(map[string]*metrics.Metrics)
 				for i := 0; i < 10000; i++ {
 					id := "metric" + strconv.Itoa(i)
-					expected[id] = &metrics.Metrics{
+					expected[MetricKey("counter", id)] = &metrics.Metrics{
 						ID:    id,
 						MType: "counter",
 						Delta: int64Ptr(int64(i) + 1),
@@ -383,7 +479,7 @@ func TestMemStorage_UpdateMetrics(t *testing.T) {
 
 func TestMemStorage_UpdateMetricsConcurrent(t *testing.T) {
 	m := &MemStorage{
-		metrics: map[string]*metrics.Metrics{"testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(0)}},
+		metrics: map[string]*metrics.Metrics{"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(0)}},
 		mu:      sync.RWMutex{},
 	}
 
@@ -403,7 +499,7 @@ func TestMemStorage_UpdateMetricsConcurrent(t *testing.T) {
 	}
 	testWG.Wait()
 
-	storedMetric, exists := m.metrics["testCounter"]
+	storedMetric, exists := m.metrics["counter:testCounter"]
 	assert.True(t, exists)
 	assert.Equal(t, *storedMetric.Delta, *int64Ptr(100))
 }
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4"
+	pgmigrate "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+
+	"github.com/evgfitil/go-metrics-server.git/db"
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+)
+
+// ErrSchemaOutdated is returned when the database schema lacks migrations the server needs.
+var ErrSchemaOutdated = errors.New("database schema is outdated")
+
+// MigrationStatus is the state of the database schema.
+type MigrationStatus struct {
+	// Version is the version of the last applied migration, zero if none is applied.
+	Version uint
+	// Dirty is set when a migration failed halfway. The schema has to be fixed by hand
+	// and the version set with Force.
+	Dirty bool
+	// Latest is the version of the newest embedded migration.
+	Latest uint
+}
+
+// Check returns ErrSchemaOutdated if the schema is dirty or older than the embedded migrations.
+func (s MigrationStatus) Check() error {
+	switch {
+	case s.Dirty:
+		return fmt.Errorf("%w: migration %d failed, fix the schema and run migrate force", ErrSchemaOutdated, s.Version)
+	case s.Version < s.Latest:
+		return fmt.Errorf("%w: version %d, the server requires %d, run migrate up", ErrSchemaOutdated, s.Version, s.Latest)
+	}
+	return nil
+}
+
+// Migrator applies the embedded PostgreSQL migrations over a connection of its own.
+type Migrator struct {
+	m      *migrate.Migrate
+	latest uint
+}
+
+// NewMigrator connects to the database for managing its schema.
+func NewMigrator(databaseDSN string) (*Migrator, error) {
+	src, err := iofs.New(db.PostgresMigrations, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %w", err)
+	}
+	latest, err := latestMigration(src)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("error reading migrations: %w", err)
+	}
+
+	conn, err := sql.Open(driverName, databaseDSN)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	driver, err := pgmigrate.WithInstance(conn, &pgmigrate.Config{})
+	if err != nil {
+		src.Close()
+		conn.Close()
+		return nil, classifyError(err)
+	}
+	m, err := migrate.NewWithInstance("iofs", src, "postgres", driver)
+	if err != nil {
+		src.Close()
+		driver.Close()
+		return nil, err
+	}
+	return &Migrator{m: m, latest: latest}, nil
+}
+
+// latestMigration returns the version of the newest migration of the source.
+func latestMigration(src source.Driver) (uint, error) {
+	version, err := src.First()
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	for err == nil {
+		var next uint
+		if next, err = src.Next(version); err == nil {
+			version = next
+		}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Status returns the state of the schema.
+func (m *Migrator) Status() (MigrationStatus, error) {
+	version, dirty, err := m.m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return MigrationStatus{}, err
+	}
+	return MigrationStatus{Version: version, Dirty: dirty, Latest: m.latest}, nil
+}
+
+// Up applies the pending migrations.
+func (m *Migrator) Up() error {
+	if err := m.m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return nil
+}
+
+// Down reverts the last steps migrations.
+func (m *Migrator) Down(steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("invalid number of migrations to revert: %d", steps)
+	}
+	if err := m.m.Steps(-steps); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return nil
+}
+
+// Force sets the schema version without running migrations and clears the dirty flag.
+// A version of -1 marks the schema as having no migrations applied.
+func (m *Migrator) Force(version int) error {
+	return m.m.Force(version)
+}
+
+// Close closes the connection of the migrator.
+func (m *Migrator) Close() error {
+	srcErr, dbErr := m.m.Close()
+	return errors.Join(srcErr, dbErr)
+}
+
+// prepareSchema checks that the schema of the database is up to date, applying
+// the pending migrations first if autoMigrate is set.
+func prepareSchema(databaseDSN string, autoMigrate bool) error {
+	m, err := NewMigrator(databaseDSN)
+	if err != nil {
+		return fmt.Errorf("error checking database schema: %w", err)
+	}
+	defer func() {
+		if err := m.Close(); err != nil {
+			logger.Sugar.Errorf("error closing migrator: %v", err)
+		}
+	}()
+
+	if autoMigrate {
+		if err = m.Up(); err != nil {
+			return fmt.Errorf("error applying migrations: %w", err)
+		}
+	}
+	status, err := m.Status()
+	if err != nil {
+		return fmt.Errorf("error checking database schema: %w", err)
+	}
+	if err = status.Check(); err != nil {
+		return err
+	}
+	if status.Version > status.Latest {
+		logger.Sugar.Warnf("database schema version %d is newer than the version %d of the server", status.Version, status.Latest)
+	}
+	logger.Sugar.Infof("database schema is at version %d", status.Version)
+	return nil
+}
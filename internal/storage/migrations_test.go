@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/db"
+)
+
+func TestMigrationStatus_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  MigrationStatus
+		wantErr bool
+	}{
+		{name: "up to date", status: MigrationStatus{Version: 2, Latest: 2}},
+		{name: "newer than the server", status: MigrationStatus{Version: 3, Latest: 2}},
+		{name: "pending migrations", status: MigrationStatus{Version: 1, Latest: 2}, wantErr: true},
+		{name: "empty schema", status: MigrationStatus{Latest: 2}, wantErr: true},
+		{name: "dirty", status: MigrationStatus{Version: 2, Dirty: true, Latest: 2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.status.Check()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrSchemaOutdated)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_latestMigration(t *testing.T) {
+	src, err := iofs.New(db.PostgresMigrations, "migrations")
+	require.NoError(t, err)
+	defer src.Close()
+
+	latest, err := latestMigration(src)
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), latest)
+}
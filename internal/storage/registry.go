@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Options holds the settings that apply to every storage backend.
+type Options struct {
+	// KeyMode selects how metrics of different types sharing a name are stored.
+	KeyMode KeyMode
+	// AutoMigrate applies the pending migrations of a PostgreSQL schema when the storage
+	// is opened. Without it an outdated schema is refused. The schema of the embedded
+	// SQLite file is always migrated.
+	AutoMigrate bool
+}
+
+// Opener opens a storage backend from its URL. It must reject options it does not know.
+type Opener func(u *url.URL, opts Options) (Storage, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Opener)
+)
+
+// Register makes a storage backend available under the URL scheme.
+// It panics if the scheme is registered twice or opener is nil.
+func Register(scheme string, opener Opener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if opener == nil {
+		panic("storage: Register opener is nil")
+	}
+	if _, dup := registry[scheme]; dup {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	registry[scheme] = opener
+}
+
+// Schemes returns the sorted list of the registered URL schemes.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open opens the storage backend registered for the scheme of rawURL,
+// e.g. "memory://", "file:///tmp/metrics.json?interval=300" or "postgres://host/db".
+func Open(rawURL string, opts Options) (Storage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URL: %w", err)
+	}
+	return OpenURL(u, opts)
+}
+
+// OpenURL opens the storage backend registered for the scheme of u.
+func OpenURL(u *url.URL, opts Options) (Storage, error) {
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("storage URL %q has no scheme, supported schemes: %s", u, strings.Join(Schemes(), ", "))
+	}
+
+	registryMu.RLock()
+	opener, ok := registry[strings.ToLower(u.Scheme)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage scheme %q, supported schemes: %s", u.Scheme, strings.Join(Schemes(), ", "))
+	}
+	return opener(u, opts)
+}
+
+// checkParams returns an error if the URL has query parameters other than allowed.
+func checkParams(u *url.URL, allowed ...string) error {
+	for name := range u.Query() {
+		if !slices.Contains(allowed, name) {
+			return fmt.Errorf("unknown option %q of %s storage", name, u.Scheme)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+)
+
+func TestOpen(t *testing.T) {
+	logger.InitLogger()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	tests := []struct {
+		name     string
+		rawURL   string
+		wantType Storage
+		wantErr  bool
+	}{
+		{name: "memory", rawURL: "memory://", wantType: &MemStorage{}},
+		{name: "file", rawURL: "file://" + path + "?interval=0&restore=false", wantType: &FileStorage{}},
+		{name: "file without options", rawURL: "file://" + path, wantType: &FileStorage{}},
+		{name: "sqlite", rawURL: "sqlite://" + filepath.Join(filepath.Dir(path), "metrics.db"), wantType: &SQLiteStorage{}},
+		{name: "unknown sqlite option", rawURL: "sqlite://" + path + "?cache=shared", wantErr: true},
+		{name: "bolt", rawURL: "bolt://" + filepath.Join(filepath.Dir(path), "metrics.bolt") + "?timeout=100ms", wantType: &BoltStorage{}},
+		{name: "invalid bolt timeout", rawURL: "bolt://" + path + "?timeout=soon", wantErr: true},
+		{name: "sharded memory", rawURL: "memory://?shards=16", wantType: &ShardedMemStorage{}},
+		{name: "invalid shards", rawURL: "memory://?shards=0", wantErr: true},
+		{name: "scheme in upper case", rawURL: "MEMORY://", wantType: &MemStorage{}},
+		{name: "unknown memory option", rawURL: "memory://?interval=10", wantErr: true},
+		{name: "unknown file option", rawURL: "file://" + path + "?mode=x", wantErr: true},
+		{name: "file with write-ahead log", rawURL: "file://" + path + "?wal=true&wal_max_size=1024", wantType: &FileStorage{}},
+		{name: "invalid wal", rawURL: "file://" + path + "?wal=sometimes", wantErr: true},
+		{name: "invalid wal_max_size", rawURL: "file://" + path + "?wal=true&wal_max_size=0", wantErr: true},
+		{name: "file with compressed snapshots", rawURL: "file://" + path + "?keep=5&compress=true", wantType: &FileStorage{}},
+		{name: "invalid keep", rawURL: "file://" + path + "?keep=0", wantErr: true},
+		{name: "invalid compress", rawURL: "file://" + path + "?compress=zstd", wantErr: true},
+		{name: "negative interval", rawURL: "file://" + path + "?interval=-1", wantErr: true},
+		{name: "invalid restore", rawURL: "file://" + path + "?restore=maybe", wantErr: true},
+		{name: "file without path", rawURL: "file://", wantErr: true},
+		{name: "invalid tiered interval", rawURL: "tiered+postgres://localhost/metrics?interval=0s", wantErr: true},
+		{name: "invalid tiered max_lag", rawURL: "tiered+postgres://localhost/metrics?max_lag=soon", wantErr: true},
+		{name: "unknown scheme", rawURL: "redis://localhost", wantErr: true},
+		{name: "no scheme", rawURL: "/tmp/metrics.json", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Open(tt.rawURL, Options{KeyMode: KeyModeTyped})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.IsType(t, tt.wantType, s)
+			assert.NoError(t, s.Close())
+		})
+	}
+}
+
+func TestOpen_FileOptions(t *testing.T) {
+	logger.InitLogger()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 2, "metrics": [{"id": "X", "type": "counter", "delta": 4}]}`), 0644))
+
+	s, err := Open("file://"+path+"?interval=0&keep=2&compress=true", Options{KeyMode: KeyModeStrict})
+	require.NoError(t, err)
+	defer s.Close()
+
+	fs := s.(*FileStorage)
+	assert.Equal(t, 0, fs.storeInterval)
+	assert.Equal(t, 2, fs.keepSnapshots)
+	assert.True(t, fs.compress)
+	assert.Equal(t, KeyModeStrict, fs.keyMode)
+	metric, err := fs.Get(context.Background(), "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *metric.Delta)
+}
+
+func TestRegister(t *testing.T) {
+	assert.Subset(t, Schemes(), []string{"bolt", "file", "memory", "postgres", "postgresql", "sqlite", "tiered+postgres", "tiered+postgresql"})
+	assert.Panics(t, func() { Register("memory", openMemStorage) })
+	assert.Panics(t, func() { Register("nil", nil) })
+}
@@ -1,21 +1,223 @@
 // Package storage provides various implementations of the Storage interface for
 // storing metrics collected by the agent. The available implementations include
-// in-memory storage, database storage, and file storage, allowing flexibility
-// depending on the use case and requirements.
+// in-memory storage, database storage, embedded SQLite storage, and file storage,
+// allowing flexibility depending on the use case and requirements. Backends are
+// registered by URL scheme and opened with Open.
 package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 
 	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
 )
 
+var (
+	// ErrNotFound is returned when the requested metric does not exist.
+	ErrNotFound = errors.New("metric not found")
+	// ErrTypeMismatch is returned when a metric is accessed with a type other than the stored one.
+	ErrTypeMismatch = errors.New("metric type mismatch")
+	// ErrUnavailable is returned when the storage backend cannot serve the request.
+	ErrUnavailable = errors.New("storage unavailable")
+	// ErrInvalidMetric is returned when a metric has an unsupported type or lacks its value.
+	ErrInvalidMetric = errors.New("invalid metric")
+	// ErrOutcomeUnknown is wrapped with ErrUnavailable by a write that may have been
+	// applied, e.g. when the connection was lost during a commit. Retrying such a write
+	// may apply the deltas of its counters twice.
+	ErrOutcomeUnknown = errors.New("write outcome unknown")
+	// ErrAtomicUnsupported is returned when a batch must be applied atomically by a
+	// storage that does not implement AtomicUpdater.
+	ErrAtomicUnsupported = errors.New("atomic batches are not supported")
+)
+
+// KeyMode selects how a storage treats metrics of different types sharing a name.
+type KeyMode string
+
+const (
+	// KeyModeTyped keys metrics by type and name, so a counter and a gauge may share a name.
+	KeyModeTyped KeyMode = "typed"
+	// KeyModeStrict rejects a metric whose name is already used by a metric of another type
+	// with ErrTypeMismatch.
+	KeyModeStrict KeyMode = "strict"
+)
+
+// ParseKeyMode parses the name of a key mode. An empty name selects KeyModeTyped.
+func ParseKeyMode(name string) (KeyMode, error) {
+	switch KeyMode(name) {
+	case "", KeyModeTyped:
+		return KeyModeTyped, nil
+	case KeyModeStrict:
+		return KeyModeStrict, nil
+	}
+	return "", fmt.Errorf("unknown key mode %q", name)
+}
+
+// MetricKey returns the key of a metric in the map returned by GetAllMetrics.
+func MetricKey(metricType, metricName string) string {
+	return metricType + ":" + metricName
+}
+
+// otherType returns the metric type a name may collide with.
+func otherType(metricType string) string {
+	if metricType == "counter" {
+		return "gauge"
+	}
+	return "counter"
+}
+
+// Storage defines the interface of a metrics storage backend. Errors returned by
+// its methods wrap ErrNotFound, ErrTypeMismatch, ErrUnavailable or ErrInvalidMetric
+// when they fall into one of these categories. A write failing with ErrUnavailable
+// changes nothing unless the error also wraps ErrOutcomeUnknown. GetAllMetrics keys
+// the metrics with MetricKey.
 type Storage interface {
-	Get(ctx context.Context, metricName, metricType string) (*metrics.Metrics, bool)
-	GetAllMetrics(ctx context.Context) map[string]*metrics.Metrics
+	Get(ctx context.Context, metricName, metricType string) (*metrics.Metrics, error)
+	GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error)
 	Ping(ctx context.Context) error
-	Update(ctx context.Context, metric *metrics.Metrics)
+	Update(ctx context.Context, metric *metrics.Metrics) error
 	UpdateMetrics(ctx context.Context, metrics []*metrics.Metrics) error
 	SaveMetrics(ctx context.Context) error
 	Close() error
 }
+
+// AtomicUpdater is implemented by the storages that apply a batch all or nothing.
+type AtomicUpdater interface {
+	// UpdateMetricsAtomic applies every metric of the batch or none of them. It returns
+	// the joined errors of the invalid and conflicting metrics if it rejects the batch.
+	UpdateMetricsAtomic(ctx context.Context, metrics []*metrics.Metrics) error
+}
+
+// updateAtomic applies the batch atomically to a storage implementing AtomicUpdater.
+func updateAtomic(ctx context.Context, s Storage, batchOfMetrics []*metrics.Metrics) error {
+	updater, ok := s.(AtomicUpdater)
+	if !ok {
+		return fmt.Errorf("%w by %T", ErrAtomicUnsupported, s)
+	}
+	return updater.UpdateMetricsAtomic(ctx, batchOfMetrics)
+}
+
+// MetricError is the error of a metric of a batch, identified by its name and type.
+type MetricError struct {
+	ID    string
+	MType string
+	Err   error
+}
+
+func (e *MetricError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MetricError) Unwrap() error {
+	return e.Err
+}
+
+// typeMismatch returns the ErrTypeMismatch error of a metric whose name is used by
+// a metric of another type.
+func typeMismatch(metricName, metricType string) error {
+	return &MetricError{
+		ID:    metricName,
+		MType: metricType,
+		Err:   fmt.Errorf("%w: %s is stored as %s", ErrTypeMismatch, metricName, otherType(metricType)),
+	}
+}
+
+// MetricErrors splits the errors joined by a batch update into the errors of its
+// metrics and the joined other errors.
+func MetricErrors(err error) ([]*MetricError, error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var metricErrs []*MetricError
+		var others []error
+		for _, e := range joined.Unwrap() {
+			m, other := MetricErrors(e)
+			metricErrs = append(metricErrs, m...)
+			if other != nil {
+				others = append(others, other)
+			}
+		}
+		return metricErrs, errors.Join(others...)
+	}
+	var metricErr *MetricError
+	if errors.As(err, &metricErr) {
+		return []*MetricError{metricErr}, nil
+	}
+	return nil, err
+}
+
+// validateBatch checks the metrics of a batch to be applied atomically. In the strict
+// key mode a name may not be used by both types within the batch.
+func validateBatch(batchOfMetrics []*metrics.Metrics, keyMode KeyMode) error {
+	var errs []error
+	types := make(map[string]string)
+	for _, metric := range batchOfMetrics {
+		if err := ValidateMetric(metric); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if keyMode != KeyModeStrict {
+			continue
+		}
+		if first, ok := types[metric.ID]; !ok {
+			types[metric.ID] = metric.MType
+		} else if first != metric.MType {
+			errs = append(errs, typeMismatch(metric.ID, metric.MType))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateMetric checks that the metric has a supported type and the matching value,
+// which must be finite for a gauge.
+func ValidateMetric(metric *metrics.Metrics) error {
+	if err := validateStored(metric); err != nil {
+		return err
+	}
+	if metric.MType == "gauge" && (math.IsNaN(*metric.Value) || math.IsInf(*metric.Value, 0)) {
+		return fmt.Errorf("%w: gauge %s has the non-finite value %v", ErrInvalidMetric, metric.ID, *metric.Value)
+	}
+	return nil
+}
+
+// validateStored checks a metric read from a storage like ValidateMetric, but accepts
+// the non-finite gauges stored before they were rejected.
+func validateStored(metric *metrics.Metrics) error {
+	if metric == nil || metric.ID == "" {
+		return fmt.Errorf("%w: missing metric name", ErrInvalidMetric)
+	}
+	switch metric.MType {
+	case "counter":
+		if metric.Delta == nil {
+			return fmt.Errorf("%w: counter %s has no delta", ErrInvalidMetric, metric.ID)
+		}
+	case "gauge":
+		if metric.Value == nil {
+			return fmt.Errorf("%w: gauge %s has no value", ErrInvalidMetric, metric.ID)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported type %q of metric %s", ErrInvalidMetric, metric.MType, metric.ID)
+	}
+	return nil
+}
+
+// validateType checks that the metric type is supported.
+func validateType(metricType string) error {
+	if metricType != "counter" && metricType != "gauge" {
+		return fmt.Errorf("%w: unsupported type %q", ErrInvalidMetric, metricType)
+	}
+	return nil
+}
+
+// copyMetric returns a copy of the metric that shares no pointers with it.
+func copyMetric(metric *metrics.Metrics) *metrics.Metrics {
+	metricCopy := *metric
+	if metric.Delta != nil {
+		delta := *metric.Delta
+		metricCopy.Delta = &delta
+	}
+	if metric.Value != nil {
+		value := *metric.Value
+		metricCopy.Value = &value
+	}
+	return &metricCopy
+}
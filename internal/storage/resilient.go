@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+var (
+	// ErrJournaled is returned by a ResilientStorage for a write it accepted into its
+	// journal while the backend is unavailable. The write is applied when the backend
+	// is back.
+	ErrJournaled = errors.New("write journaled until the storage is available")
+	// ErrDegraded is returned by the Ping of a ResilientStorage that accepts writes
+	// into its journal while the backend is unavailable or the journal is replayed.
+	ErrDegraded = errors.New("storage degraded")
+)
+
+// defaultProbeInterval is the interval of the checks whether the backend is available.
+const defaultProbeInterval = time.Second
+
+// ResilientStorage keeps accepting writes while its backend is unavailable. A write
+// failing with ErrUnavailable, or any write while the backend is known to be down,
+// is appended to a bounded journal in memory and ErrJournaled is returned. The
+// backend is pinged every probe interval; when it is available again, the journal is
+// replayed in order and the writes received meanwhile are journaled behind it.
+//
+// A write failing with ErrOutcomeUnknown may have been applied, e.g. when the
+// connection was lost during a commit, so it is not journaled, which could increment
+// a counter twice, and its error is returned. Writes the backend rejects during the
+// replay, such as type mismatches in the strict key mode, are logged and dropped, and
+// the journal is lost if the server stops while the backend is down. Reads are passed
+// to the backend.
+type ResilientStorage struct {
+	backend       Storage
+	maxJournal    int
+	probeInterval time.Duration
+
+	// mu guards the journal, which holds the batches of valid metrics in the order
+	// they were written, the number of metrics in it and the state of the backend.
+	mu        sync.Mutex
+	journal   [][]*metrics.Metrics
+	journaled int
+	down      bool
+	// replayMu serializes the replays.
+	replayMu sync.Mutex
+	// rejected counts the metrics that did not fit into the journal.
+	rejected atomic.Int64
+
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewResilientStorage wraps the backend with a journal of at most maxJournal metrics.
+// The backend is pinged every probeInterval, zero means defaultProbeInterval.
+func NewResilientStorage(backend Storage, maxJournal int, probeInterval time.Duration) *ResilientStorage {
+	if probeInterval <= 0 {
+		probeInterval = defaultProbeInterval
+	}
+	r := &ResilientStorage{
+		backend:       backend,
+		maxJournal:    maxJournal,
+		probeInterval: probeInterval,
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// run probes the backend every probe interval and replays the journal when it is available.
+func (r *ResilientStorage) run() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+		if err := r.probe(context.Background()); err != nil {
+			logger.Sugar.Errorf("error replaying the journal: %v", err)
+		}
+	}
+}
+
+// probe pings the backend and replays the journal if it is available. The ping and
+// the write of every batch time out after the probe interval.
+func (r *ResilientStorage) probe(ctx context.Context) error {
+	pingCtx, cancel := context.WithTimeout(ctx, r.probeInterval)
+	err := r.backend.Ping(pingCtx)
+	cancel()
+	if err != nil {
+		r.markDown(err)
+		return nil
+	}
+	return r.replay(ctx)
+}
+
+// markDown records that the backend is unavailable.
+func (r *ResilientStorage) markDown(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.down {
+		logger.Sugar.Warnf("storage is unavailable, journaling writes: %v", err)
+	}
+	r.down = true
+}
+
+// replay writes the journaled batches to the backend in order until the journal is
+// empty or the backend fails with ErrUnavailable.
+func (r *ResilientStorage) replay(ctx context.Context) error {
+	r.replayMu.Lock()
+	defer r.replayMu.Unlock()
+
+	replayed := 0
+	for {
+		r.mu.Lock()
+		if len(r.journal) == 0 {
+			if r.down || replayed > 0 {
+				logger.Sugar.Infof("storage is available, replayed %d journaled metrics", replayed)
+			}
+			r.down = false
+			r.mu.Unlock()
+			return nil
+		}
+		batch := r.journal[0]
+		r.mu.Unlock()
+
+		batchCtx, cancel := context.WithTimeout(ctx, r.probeInterval)
+		err := r.backend.UpdateMetrics(batchCtx, batch)
+		cancel()
+		if errors.Is(err, ErrUnavailable) {
+			r.markDown(err)
+			return err
+		}
+		if err != nil {
+			logger.Sugar.Errorf("dropped journaled metrics rejected by the storage: %v", err)
+		}
+
+		r.mu.Lock()
+		r.journal[0] = nil
+		r.journal = r.journal[1:]
+		r.journaled -= len(batch)
+		r.mu.Unlock()
+		replayed += len(batch)
+	}
+}
+
+// degraded reports whether writes must be journaled. The caller must hold mu.
+func (r *ResilientStorage) degraded() bool {
+	return r.down || len(r.journal) > 0
+}
+
+// append journals copies of the valid metrics and returns ErrJournaled, or
+// ErrUnavailable if the journal cannot hold them. The caller must hold mu.
+func (r *ResilientStorage) append(batch []*metrics.Metrics) error {
+	if r.journaled+len(batch) > r.maxJournal {
+		r.rejected.Add(int64(len(batch)))
+		return fmt.Errorf("%w: the journal of %d metrics is full", ErrUnavailable, r.maxJournal)
+	}
+	entry := make([]*metrics.Metrics, len(batch))
+	for i, metric := range batch {
+		entry[i] = copyMetric(metric)
+	}
+	r.journal = append(r.journal, entry)
+	r.journaled += len(entry)
+	return ErrJournaled
+}
+
+// write applies the valid metrics with update or journals them if the backend is
+// unavailable and the update changed nothing.
+func (r *ResilientStorage) write(batch []*metrics.Metrics, update func() error) error {
+	r.mu.Lock()
+	if r.degraded() {
+		defer r.mu.Unlock()
+		return r.append(batch)
+	}
+	r.mu.Unlock()
+
+	err := update()
+	if !errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	r.markDown(err)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	if errors.Is(err, ErrOutcomeUnknown) {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.append(batch)
+}
+
+func (r *ResilientStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	if err := ValidateMetric(metric); err != nil {
+		return err
+	}
+	return r.write([]*metrics.Metrics{metric}, func() error {
+		return r.backend.Update(ctx, metric)
+	})
+}
+
+// UpdateMetrics writes the batch to the backend or journals its valid metrics.
+// The errors of the invalid metrics are joined with the result.
+func (r *ResilientStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	var errs []error
+	valid := make([]*metrics.Metrics, 0, len(batchOfMetrics))
+	for _, metric := range batchOfMetrics {
+		if err := ValidateMetric(metric); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		valid = append(valid, metric)
+	}
+	if len(valid) == 0 {
+		return errors.Join(errs...)
+	}
+	err := r.write(valid, func() error {
+		return r.backend.UpdateMetrics(ctx, valid)
+	})
+	return errors.Join(append(errs, err)...)
+}
+
+// UpdateMetricsAtomic applies the batch to the backend all or nothing. The batch is
+// not journaled, since the backend could reject a part of it on replay, so it fails
+// with ErrUnavailable while the backend is unavailable.
+func (r *ResilientStorage) UpdateMetricsAtomic(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	var errs []error
+	for _, metric := range batchOfMetrics {
+		if err := ValidateMetric(metric); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	r.mu.Lock()
+	degraded := r.degraded()
+	r.mu.Unlock()
+	if degraded {
+		return fmt.Errorf("%w: atomic batches are not journaled", ErrUnavailable)
+	}
+	err := updateAtomic(ctx, r.backend, batchOfMetrics)
+	if errors.Is(err, ErrUnavailable) {
+		r.markDown(err)
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+func (r *ResilientStorage) Get(ctx context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	return r.backend.Get(ctx, metricName, metricType)
+}
+
+func (r *ResilientStorage) GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error) {
+	return r.backend.GetAllMetrics(ctx)
+}
+
+// Ping returns nil if the backend is available and the journal is empty, ErrDegraded
+// while writes are journaled and the error of the backend if the journal is full.
+func (r *ResilientStorage) Ping(ctx context.Context) error {
+	r.mu.Lock()
+	degraded, full := r.degraded(), r.journaled >= r.maxJournal
+	r.mu.Unlock()
+
+	if !degraded {
+		err := r.backend.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		r.markDown(err)
+		return fmt.Errorf("%w: %v", ErrDegraded, err)
+	}
+	if full {
+		return fmt.Errorf("%w: the journal of %d metrics is full", ErrUnavailable, r.maxJournal)
+	}
+	return ErrDegraded
+}
+
+// SaveMetrics replays the journal and saves the backend. It returns ErrDegraded
+// if the backend is unavailable.
+func (r *ResilientStorage) SaveMetrics(ctx context.Context) error {
+	if err := r.probe(ctx); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	down := r.down
+	r.mu.Unlock()
+	if down {
+		return ErrDegraded
+	}
+	return r.backend.SaveMetrics(ctx)
+}
+
+// SelfMetrics returns the number of journaled metrics, of the metrics rejected because
+// the journal was full since the last call and the metrics of the backend.
+func (r *ResilientStorage) SelfMetrics() []*metrics.Metrics {
+	r.mu.Lock()
+	journaled := metrics.NewGauge("JournalLength", float64(r.journaled))
+	r.mu.Unlock()
+	rejected := metrics.NewCounter("JournalRejected", r.rejected.Swap(0))
+
+	selfMetrics := []*metrics.Metrics{&journaled, &rejected}
+	if source, ok := r.backend.(interface{ SelfMetrics() []*metrics.Metrics }); ok {
+		selfMetrics = append(selfMetrics, source.SelfMetrics()...)
+	}
+	return selfMetrics
+}
+
+// Close stops the probes, replays the journal if the backend is available and closes
+// the backend. The metrics still journaled are lost.
+func (r *ResilientStorage) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		<-r.stopped
+		if probeErr := r.probe(context.Background()); probeErr != nil {
+			logger.Sugar.Errorf("error replaying the journal when closing: %v", probeErr)
+		}
+
+		r.mu.Lock()
+		if r.journaled > 0 {
+			logger.Sugar.Errorf("storage is unavailable, lost %d journaled metrics", r.journaled)
+		}
+		r.mu.Unlock()
+		err = r.backend.Close()
+	})
+	return err
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// switchableStorage is a MemStorage that fails the pings and the writes with
+// ErrUnavailable while it is down and records the order of the written gauges.
+// An ambiguous storage applies the writes before failing them with ErrOutcomeUnknown.
+type switchableStorage struct {
+	*MemStorage
+	down      atomic.Bool
+	ambiguous atomic.Bool
+
+	mu     sync.Mutex
+	gauges []float64
+}
+
+func (s *switchableStorage) Ping(ctx context.Context) error {
+	if s.down.Load() {
+		return ErrUnavailable
+	}
+	return s.MemStorage.Ping(ctx)
+}
+
+func (s *switchableStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	return s.UpdateMetrics(ctx, []*metrics.Metrics{metric})
+}
+
+func (s *switchableStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if s.ambiguous.Load() {
+		return errors.Join(s.MemStorage.UpdateMetrics(ctx, batchOfMetrics), fmt.Errorf("%w: %w", ErrUnavailable, ErrOutcomeUnknown))
+	}
+	if s.down.Load() {
+		return ErrUnavailable
+	}
+	s.mu.Lock()
+	for _, metric := range batchOfMetrics {
+		if metric.MType == "gauge" {
+			s.gauges = append(s.gauges, *metric.Value)
+		}
+	}
+	s.mu.Unlock()
+	return s.MemStorage.UpdateMetrics(ctx, batchOfMetrics)
+}
+
+func newTestResilient(t *testing.T, maxJournal int) (*ResilientStorage, *switchableStorage) {
+	logger.InitLogger()
+	backend := &switchableStorage{MemStorage: NewMemStorage()}
+	r := NewResilientStorage(backend, maxJournal, time.Hour)
+	t.Cleanup(func() { r.Close() })
+	return r, backend
+}
+
+func TestResilientStorage_Journal(t *testing.T) {
+	r, backend := newTestResilient(t, 3)
+	ctx := context.Background()
+
+	require.NoError(t, r.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)}))
+	assert.NoError(t, r.Ping(ctx))
+
+	// a write failing with ErrUnavailable is journaled, so are the later ones
+	backend.down.Store(true)
+	assert.ErrorIs(t, r.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(2)}), ErrJournaled)
+	assert.ErrorIs(t, r.Ping(ctx), ErrDegraded)
+	assert.ErrorIs(t, r.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "C", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "G", MType: "gauge", Value: float64Ptr(3)},
+	}), ErrJournaled)
+
+	// invalid metrics are rejected instead
+	err := r.UpdateMetrics(ctx, []*metrics.Metrics{{ID: "C", MType: "counter"}})
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+	assert.NotErrorIs(t, err, ErrJournaled)
+
+	// atomic batches are not journaled, the backend could reject a part of them on replay
+	err = r.UpdateMetricsAtomic(ctx, []*metrics.Metrics{{ID: "G", MType: "gauge", Value: float64Ptr(9)}})
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.NotErrorIs(t, err, ErrJournaled)
+
+	// the journal is full
+	err = r.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(4)})
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.NotErrorIs(t, err, ErrJournaled)
+	assert.ErrorIs(t, r.Ping(ctx), ErrUnavailable)
+	assert.ErrorIs(t, r.SaveMetrics(ctx), ErrDegraded)
+
+	// the journal is replayed in order when the backend is back
+	backend.down.Store(false)
+	require.NoError(t, r.SaveMetrics(ctx))
+	assert.NoError(t, r.Ping(ctx))
+	assert.Equal(t, []float64{1, 2, 3}, backend.gauges)
+	counter, err := backend.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *counter.Delta)
+
+	require.NoError(t, r.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(5)}))
+	assert.Equal(t, []float64{1, 2, 3, 5}, backend.gauges)
+	assert.Equal(t, []*metrics.Metrics{
+		{ID: "JournalLength", MType: "gauge", Value: float64Ptr(0)},
+		{ID: "JournalRejected", MType: "counter", Delta: int64Ptr(1)},
+	}, r.SelfMetrics())
+}
+
+func TestResilientStorage_OutcomeUnknown(t *testing.T) {
+	r, backend := newTestResilient(t, 10)
+	ctx := context.Background()
+
+	// a write that may have been applied is not journaled
+	backend.ambiguous.Store(true)
+	backend.down.Store(true)
+	err := r.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)})
+	assert.ErrorIs(t, err, ErrOutcomeUnknown)
+	assert.NotErrorIs(t, err, ErrJournaled)
+	assert.ErrorIs(t, r.Ping(ctx), ErrDegraded)
+
+	// the later writes are journaled while the backend is down
+	backend.ambiguous.Store(false)
+	assert.ErrorIs(t, r.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(2)}), ErrJournaled)
+	backend.down.Store(false)
+	require.NoError(t, r.SaveMetrics(ctx))
+	counter, err := backend.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *counter.Delta)
+}
+
+func TestResilientStorage_Probe(t *testing.T) {
+	logger.InitLogger()
+	backend := &switchableStorage{MemStorage: NewMemStorage()}
+	r := NewResilientStorage(backend, 10, 10*time.Millisecond)
+	defer r.Close()
+	ctx := context.Background()
+
+	// the probes detect the outage before a write fails
+	backend.down.Store(true)
+	assert.Eventually(t, func() bool {
+		return r.Ping(ctx) != nil
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, r.Ping(ctx), ErrDegraded)
+	assert.ErrorIs(t, r.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)}), ErrJournaled)
+
+	// and replay the journal when the backend is back
+	backend.down.Store(false)
+	assert.Eventually(t, func() bool {
+		return r.Ping(ctx) == nil
+	}, time.Second, time.Millisecond)
+	gauge, err := r.Get(ctx, "G", "gauge")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *gauge.Value)
+}
+
+func TestResilientStorage_Concurrent(t *testing.T) {
+	r, backend := newTestResilient(t, 1000)
+	ctx := context.Background()
+
+	var testWG sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		testWG.Add(1)
+		go func(i int) {
+			defer testWG.Done()
+			for j := 0; j < 50; j++ {
+				if i == 0 && j%10 == 0 {
+					backend.down.Store(j%20 == 0)
+				}
+				err := r.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)})
+				if err != nil {
+					assert.ErrorIs(t, err, ErrJournaled)
+				}
+			}
+		}(i)
+	}
+	testWG.Wait()
+
+	backend.down.Store(false)
+	require.NoError(t, r.SaveMetrics(ctx))
+	counter, err := backend.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(500), *counter.Delta)
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// defaultRetryBackoff is the wait before each retry of a failed database operation.
+var defaultRetryBackoff = []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, time.Second}
+
+// parseRetryBackoff parses a comma-separated list of positive durations, "none" disables retries.
+func parseRetryBackoff(value string) ([]time.Duration, error) {
+	if value == "none" {
+		return nil, nil
+	}
+	var backoff []time.Duration
+	for _, step := range strings.Split(value, ",") {
+		wait, err := time.ParseDuration(strings.TrimSpace(step))
+		if err != nil || wait <= 0 {
+			return nil, fmt.Errorf("invalid retry backoff step %q: must be a positive duration", step)
+		}
+		backoff = append(backoff, wait)
+	}
+	return backoff, nil
+}
+
+// commitError marks a failed commit. A connection lost during the commit leaves
+// the outcome of the transaction unknown, so it is not retried.
+type commitError struct {
+	err error
+}
+
+func (e *commitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *commitError) Unwrap() error {
+	return e.err
+}
+
+// isRetriable reports whether an operation that failed with err may succeed if it
+// is run again: connection exceptions, serialization failures and deadlocks.
+func isRetriable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == pgerrcode.SerializationFailure, pgErr.Code == pgerrcode.DeadlockDetected:
+			return true
+		case pgErr.Code == pgerrcode.TransactionResolutionUnknown:
+			return false
+		case pgerrcode.IsConnectionException(pgErr.Code):
+			var commitErr *commitError
+			return !errors.As(err, &commitErr)
+		}
+		return false
+	}
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr) || errors.Is(err, driver.ErrBadConn)
+}
+
+// retryer runs database operations and retries them after the steps of the backoff
+// while they fail with retriable errors. The zero value does not retry.
+type retryer struct {
+	backoff []time.Duration
+	// attempts counts the retries, failures the operations still failing with
+	// a retriable error when retries are exhausted.
+	attempts atomic.Int64
+	failures atomic.Int64
+}
+
+// do runs op until it succeeds, fails with an error that is not retriable, the backoff
+// is exhausted or waiting for the next step would outlast the deadline of ctx.
+func (r *retryer) do(ctx context.Context, op func() error) error {
+	err := op()
+	for step := 0; err != nil && isRetriable(err); step++ {
+		if step == len(r.backoff) || !sleep(ctx, r.backoff[step]) {
+			r.failures.Add(1)
+			return err
+		}
+		r.attempts.Add(1)
+		err = op()
+	}
+	return err
+}
+
+// sleep waits for d and reports whether it waited without reaching the deadline of ctx.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// selfMetrics returns the retries and final failures since the last call.
+func (r *retryer) selfMetrics() []*metrics.Metrics {
+	attempts := metrics.NewCounter("DBRetryAttempts", r.attempts.Swap(0))
+	failures := metrics.NewCounter("DBRetryFailures", r.failures.Swap(0))
+	return []*metrics.Metrics{&attempts, &failures}
+}
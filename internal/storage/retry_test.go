@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+func Test_parseRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{name: "steps", value: "100ms, 1s,5s", want: []time.Duration{100 * time.Millisecond, time.Second, 5 * time.Second}},
+		{name: "disabled", value: "none", want: nil},
+		{name: "invalid step", value: "1s,soon", wantErr: true},
+		{name: "zero step", value: "0s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRetryBackoff(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_isRetriable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection failure", err: &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, want: true},
+		{name: "connection exception", err: &pgconn.PgError{Code: pgerrcode.ConnectionException}, want: true},
+		{name: "serialization failure", err: &pgconn.PgError{Code: pgerrcode.SerializationFailure}, want: true},
+		{name: "deadlock", err: fmt.Errorf("upsert: %w", &pgconn.PgError{Code: pgerrcode.DeadlockDetected}), want: true},
+		{name: "connection lost during commit", err: &commitError{err: &pgconn.PgError{Code: pgerrcode.ConnectionFailure}}, want: false},
+		{name: "deadlock during commit", err: &commitError{err: &pgconn.PgError{Code: pgerrcode.DeadlockDetected}}, want: true},
+		{name: "transaction resolution unknown", err: &pgconn.PgError{Code: pgerrcode.TransactionResolutionUnknown}, want: false},
+		{name: "unique violation", err: &pgconn.PgError{Code: pgerrcode.UniqueViolation}, want: false},
+		{name: "bad connection", err: driver.ErrBadConn, want: true},
+		{name: "connect error", err: &pgconn.ConnectError{}, want: true},
+		{name: "no rows", err: sql.ErrNoRows, want: false},
+		{name: "other error", err: errors.New("some error"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetriable(tt.err))
+		})
+	}
+}
+
+func Test_retryer_do(t *testing.T) {
+	retriable := &pgconn.PgError{Code: pgerrcode.DeadlockDetected}
+	tests := []struct {
+		name         string
+		backoff      []time.Duration
+		timeout      time.Duration
+		failures     int
+		err          error
+		wantErr      error
+		wantCalls    int
+		wantAttempts int64
+		wantFailures int64
+	}{
+		{name: "success", backoff: []time.Duration{time.Millisecond}, wantCalls: 1},
+		{
+			name:         "success after retries",
+			backoff:      []time.Duration{time.Millisecond, time.Millisecond},
+			failures:     2,
+			err:          retriable,
+			wantCalls:    3,
+			wantAttempts: 2,
+		},
+		{
+			name:         "backoff exhausted",
+			backoff:      []time.Duration{time.Millisecond, time.Millisecond},
+			failures:     5,
+			err:          retriable,
+			wantErr:      retriable,
+			wantCalls:    3,
+			wantAttempts: 2,
+			wantFailures: 1,
+		},
+		{
+			name:      "error is not retriable",
+			backoff:   []time.Duration{time.Millisecond},
+			failures:  5,
+			err:       sql.ErrNoRows,
+			wantErr:   sql.ErrNoRows,
+			wantCalls: 1,
+		},
+		{
+			name:         "no retries",
+			failures:     5,
+			err:          retriable,
+			wantErr:      retriable,
+			wantCalls:    1,
+			wantFailures: 1,
+		},
+		{
+			name:         "deadline before the next step",
+			backoff:      []time.Duration{time.Millisecond, time.Hour},
+			timeout:      time.Second,
+			failures:     5,
+			err:          retriable,
+			wantErr:      retriable,
+			wantCalls:    2,
+			wantAttempts: 1,
+			wantFailures: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			r := retryer{backoff: tt.backoff}
+			calls := 0
+			start := time.Now()
+			err := r.do(ctx, func() error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantCalls, calls)
+			assert.Equal(t, tt.wantAttempts, r.attempts.Load())
+			assert.Equal(t, tt.wantFailures, r.failures.Load())
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+}
+
+func Test_retryer_doCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := retryer{backoff: []time.Duration{time.Hour}}
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err := r.do(ctx, func() error {
+		return driver.ErrBadConn
+	})
+	assert.ErrorIs(t, err, driver.ErrBadConn)
+	assert.Equal(t, int64(1), r.failures.Load())
+}
+
+func TestDBStorage_Retry(t *testing.T) {
+	logger.InitLogger()
+	storage, mock := setupMockDB(t)
+	defer storage.connPool.Close()
+	storage.SetRetryBackoff([]time.Duration{time.Millisecond, time.Millisecond})
+
+	// a read is retried after a lost connection
+	mock.ExpectQuery("SELECT id, delta, version FROM counter WHERE id = \\$1").WithArgs("X").
+		WillReturnError(&pgconn.PgError{Code: pgerrcode.ConnectionFailure})
+	mock.ExpectQuery("SELECT id, delta, version FROM counter WHERE id = \\$1").WithArgs("X").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "delta", "version"}).AddRow("X", 5, 0))
+
+	metric, err := storage.Get(context.Background(), "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *metric.Delta)
+
+	// a batch is rerun in a new transaction after a deadlock
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO counter").WithArgs([]string{"X"}, []int64{1}).
+		WillReturnError(&pgconn.PgError{Code: pgerrcode.DeadlockDetected})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO counter").WithArgs([]string{"X"}, []int64{1}).WillReturnRows(counterRows("X", 6))
+	mock.ExpectCommit()
+
+	err = storage.UpdateMetrics(context.Background(), []*metrics.Metrics{{ID: "X", MType: "counter", Delta: int64Ptr(1)}})
+	require.NoError(t, err)
+
+	// a lost connection during the commit is not retried, the batch may have been written
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO counter").WithArgs([]string{"X"}, []int64{1}).WillReturnRows(counterRows("X", 6))
+	mock.ExpectCommit().WillReturnError(&pgconn.PgError{Code: pgerrcode.ConnectionFailure})
+
+	err = storage.UpdateMetrics(context.Background(), []*metrics.Metrics{{ID: "X", MType: "counter", Delta: int64Ptr(1)}})
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	// an administrator shutdown is not retriable
+	gauge := &metrics.Metrics{ID: "Y", MType: "gauge", Value: float64Ptr(1.5)}
+	mock.ExpectQuery("INSERT INTO gauge").WillReturnError(&pgconn.PgError{Code: pgerrcode.AdminShutdown})
+
+	assert.ErrorIs(t, storage.Update(context.Background(), gauge), ErrUnavailable)
+
+	// the retries are exhausted
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("INSERT INTO gauge").WillReturnError(&pgconn.PgError{Code: pgerrcode.ConnectionFailure})
+	}
+
+	assert.ErrorIs(t, storage.Update(context.Background(), gauge), ErrUnavailable)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, []*metrics.Metrics{
+		{ID: "DBRetryAttempts", MType: "counter", Delta: int64Ptr(4)},
+		{ID: "DBRetryFailures", MType: "counter", Delta: int64Ptr(1)},
+	}, storage.SelfMetrics())
+}
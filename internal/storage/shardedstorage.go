@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// defaultShards is the number of shards of a ShardedMemStorage created with zero shards.
+const defaultShards = 32
+
+// shardEntry is a stored metric. The value holds the delta of a counter or the bits
+// of a gauge and is updated atomically, so existing metrics are updated under the
+// read lock of the shard.
+type shardEntry struct {
+	id    string
+	mtype string
+	value atomic.Uint64
+}
+
+func (e *shardEntry) add(metric *metrics.Metrics) {
+	if e.mtype == "counter" {
+		e.value.Add(uint64(*metric.Delta))
+	} else {
+		e.value.Store(math.Float64bits(*metric.Value))
+	}
+}
+
+func (e *shardEntry) metric() *metrics.Metrics {
+	metric := &metrics.Metrics{ID: e.id, MType: e.mtype}
+	if e.mtype == "counter" {
+		delta := int64(e.value.Load())
+		metric.Delta = &delta
+	} else {
+		value := math.Float64frombits(e.value.Load())
+		metric.Value = &value
+	}
+	return metric
+}
+
+// memShard holds the metrics whose names hash to it. The lock guards the map only.
+type memShard struct {
+	mu      sync.RWMutex
+	metrics map[string]*shardEntry
+}
+
+// ShardedMemStorage keeps metrics in memory like MemStorage, but spreads them
+// across shards by name, so writers of different metrics do not contend for one lock.
+// Both types of a name live in the same shard, which keeps the strict key mode
+// checks within a single lock.
+type ShardedMemStorage struct {
+	shards  []memShard
+	mask    uint32
+	keyMode KeyMode
+}
+
+// NewShardedMemStorage creates an empty ShardedMemStorage. The number of shards is
+// rounded up to a power of two, zero means defaultShards.
+func NewShardedMemStorage(shards int, keyMode KeyMode) *ShardedMemStorage {
+	if shards <= 0 {
+		shards = defaultShards
+	}
+	shards = 1 << bits.Len(uint(shards-1))
+	s := &ShardedMemStorage{
+		shards:  make([]memShard, shards),
+		mask:    uint32(shards - 1),
+		keyMode: keyMode,
+	}
+	for i := range s.shards {
+		s.shards[i].metrics = make(map[string]*shardEntry)
+	}
+	return s
+}
+
+// shardIndex returns the index of the shard of the metric name using the FNV-1a hash.
+func (s *ShardedMemStorage) shardIndex(metricName string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(metricName); i++ {
+		hash ^= uint32(metricName[i])
+		hash *= 16777619
+	}
+	return int(hash & s.mask)
+}
+
+// shard returns the shard of the metric name.
+func (s *ShardedMemStorage) shard(metricName string) *memShard {
+	return &s.shards[s.shardIndex(metricName)]
+}
+
+// conflict returns ErrTypeMismatch if the key mode is strict and the name is used
+// by a metric of another type. The caller must hold the lock of the shard.
+func (s *ShardedMemStorage) conflict(shard *memShard, metricName, metricType string) error {
+	if s.keyMode != KeyModeStrict {
+		return nil
+	}
+	if _, ok := shard.metrics[MetricKey(otherType(metricType), metricName)]; ok {
+		return typeMismatch(metricName, metricType)
+	}
+	return nil
+}
+
+func (s *ShardedMemStorage) Update(_ context.Context, metric *metrics.Metrics) error {
+	if err := ValidateMetric(metric); err != nil {
+		return err
+	}
+	shard := s.shard(metric.ID)
+	key := MetricKey(metric.MType, metric.ID)
+
+	// an existing metric has passed the conflict check when it was created
+	shard.mu.RLock()
+	entry, ok := shard.metrics[key]
+	if ok {
+		entry.add(metric)
+	}
+	shard.mu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, ok = shard.metrics[key]
+	if !ok {
+		if err := s.conflict(shard, metric.ID, metric.MType); err != nil {
+			return err
+		}
+		entry = &shardEntry{id: metric.ID, mtype: metric.MType}
+		shard.metrics[key] = entry
+	}
+	entry.add(metric)
+	return nil
+}
+
+func (s *ShardedMemStorage) Get(_ context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	if err := validateType(metricType); err != nil {
+		return nil, err
+	}
+	shard := s.shard(metricName)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	entry, ok := shard.metrics[MetricKey(metricType, metricName)]
+	if !ok {
+		if err := s.conflict(shard, metricName, metricType); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s %s", ErrNotFound, metricType, metricName)
+	}
+	return entry.metric(), nil
+}
+
+// GetAllMetrics copies the metrics shard by shard, holding one read lock at a time.
+// Updates are not blocked, so the result is not a point-in-time snapshot across shards.
+func (s *ShardedMemStorage) GetAllMetrics(_ context.Context) (map[string]*metrics.Metrics, error) {
+	size := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		size += len(shard.metrics)
+		shard.mu.RUnlock()
+	}
+
+	result := make(map[string]*metrics.Metrics, size)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		for key, entry := range shard.metrics {
+			result[key] = entry.metric()
+		}
+		shard.mu.RUnlock()
+	}
+	return result, nil
+}
+
+func (s *ShardedMemStorage) SaveMetrics(_ context.Context) error {
+	return nil
+}
+
+func (s *ShardedMemStorage) Ping(_ context.Context) error {
+	return nil
+}
+
+// UpdateMetrics applies every valid metric of the batch and returns the joined
+// errors of the metrics it could not apply.
+func (s *ShardedMemStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	var errs []error
+	for _, metric := range batchOfMetrics {
+		if err := s.Update(ctx, metric); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// UpdateMetricsAtomic applies every metric of the batch or none of them. It holds the
+// write locks of the shards of the batch, taken in order, while it checks and applies
+// the batch, so Get never sees a part of it. GetAllMetrics may, as it locks one shard at a time.
+func (s *ShardedMemStorage) UpdateMetricsAtomic(_ context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := validateBatch(batchOfMetrics, s.keyMode); err != nil {
+		return err
+	}
+	locked := make(map[int]struct{})
+	for _, metric := range batchOfMetrics {
+		locked[s.shardIndex(metric.ID)] = struct{}{}
+	}
+	indexes := make([]int, 0, len(locked))
+	for i := range locked {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		s.shards[i].mu.Lock()
+		defer s.shards[i].mu.Unlock()
+	}
+
+	var errs []error
+	for _, metric := range batchOfMetrics {
+		shard := s.shard(metric.ID)
+		if _, ok := shard.metrics[MetricKey(metric.MType, metric.ID)]; ok {
+			continue
+		}
+		if err := s.conflict(shard, metric.ID, metric.MType); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	for _, metric := range batchOfMetrics {
+		shard := s.shard(metric.ID)
+		key := MetricKey(metric.MType, metric.ID)
+		entry, ok := shard.metrics[key]
+		if !ok {
+			entry = &shardEntry{id: metric.ID, mtype: metric.MType}
+			shard.metrics[key] = entry
+		}
+		entry.add(metric)
+	}
+	return nil
+}
+
+func (s *ShardedMemStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+func TestNewShardedMemStorage(t *testing.T) {
+	tests := []struct {
+		name       string
+		shards     int
+		wantShards int
+	}{
+		{name: "default", shards: 0, wantShards: defaultShards},
+		{name: "power of two", shards: 16, wantShards: 16},
+		{name: "rounded up", shards: 20, wantShards: 32},
+		{name: "single shard", shards: 1, wantShards: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewShardedMemStorage(tt.shards, KeyModeTyped)
+			assert.Len(t, s.shards, tt.wantShards)
+			assert.Equal(t, uint32(tt.wantShards-1), s.mask)
+		})
+	}
+}
+
+func TestShardedMemStorage_Update(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyMode KeyMode
+		updates []*metrics.Metrics
+		get     *metrics.Metrics
+		want    *metrics.Metrics
+		wantErr error
+	}{
+		{
+			name: "counter is accumulated",
+			updates: []*metrics.Metrics{
+				{ID: "X", MType: "counter", Delta: int64Ptr(2)},
+				{ID: "X", MType: "counter", Delta: int64Ptr(3)},
+			},
+			get:  &metrics.Metrics{ID: "X", MType: "counter"},
+			want: &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(5)},
+		},
+		{
+			name: "gauge is replaced",
+			updates: []*metrics.Metrics{
+				{ID: "Y", MType: "gauge", Value: float64Ptr(1.5)},
+				{ID: "Y", MType: "gauge", Value: float64Ptr(-2.5)},
+			},
+			get:  &metrics.Metrics{ID: "Y", MType: "gauge"},
+			want: &metrics.Metrics{ID: "Y", MType: "gauge", Value: float64Ptr(-2.5)},
+		},
+		{
+			name: "types are separate in typed mode",
+			updates: []*metrics.Metrics{
+				{ID: "X", MType: "counter", Delta: int64Ptr(2)},
+				{ID: "X", MType: "gauge", Value: float64Ptr(1.5)},
+			},
+			get:  &metrics.Metrics{ID: "X", MType: "counter"},
+			want: &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(2)},
+		},
+		{
+			name:    "missing metric",
+			get:     &metrics.Metrics{ID: "X", MType: "counter"},
+			wantErr: ErrNotFound,
+		},
+		{
+			name:    "name of another type in strict mode",
+			keyMode: KeyModeStrict,
+			updates: []*metrics.Metrics{{ID: "X", MType: "counter", Delta: int64Ptr(2)}},
+			get:     &metrics.Metrics{ID: "X", MType: "gauge"},
+			wantErr: ErrTypeMismatch,
+		},
+		{
+			name:    "unsupported type",
+			get:     &metrics.Metrics{ID: "X", MType: "histogram"},
+			wantErr: ErrInvalidMetric,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewShardedMemStorage(4, tt.keyMode)
+			for _, metric := range tt.updates {
+				require.NoError(t, s.Update(context.Background(), metric))
+			}
+			got, err := s.Get(context.Background(), tt.get.ID, tt.get.MType)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestShardedMemStorage_UpdateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  *metrics.Metrics
+		wantErr error
+	}{
+		{
+			name:    "gauge over counter",
+			metric:  &metrics.Metrics{ID: "testCounter", MType: "gauge", Value: float64Ptr(1.5)},
+			wantErr: ErrTypeMismatch,
+		},
+		{
+			name:    "counter without delta",
+			metric:  &metrics.Metrics{ID: "testCounter", MType: "counter"},
+			wantErr: ErrInvalidMetric,
+		},
+		{
+			name:    "unsupported type",
+			metric:  &metrics.Metrics{ID: "testHistogram", MType: "histogram", Value: float64Ptr(1.5)},
+			wantErr: ErrInvalidMetric,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewShardedMemStorage(4, KeyModeStrict)
+			require.NoError(t, s.Update(context.Background(), &metrics.Metrics{ID: "testCounter", MType: "counter", Delta: int64Ptr(2)}))
+
+			err := s.Update(context.Background(), tt.metric)
+			assert.ErrorIs(t, err, tt.wantErr)
+			allMetrics, err := s.GetAllMetrics(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, map[string]*metrics.Metrics{
+				"counter:testCounter": {ID: "testCounter", MType: "counter", Delta: int64Ptr(2)},
+			}, allMetrics)
+		})
+	}
+}
+
+func TestShardedMemStorage_GetAllMetrics(t *testing.T) {
+	s := NewShardedMemStorage(8, KeyModeTyped)
+	ctx := context.Background()
+	want := make(map[string]*metrics.Metrics)
+	for i := 0; i < 100; i++ {
+		counter := &metrics.Metrics{ID: "metric_" + strconv.Itoa(i), MType: "counter", Delta: int64Ptr(int64(i))}
+		gauge := &metrics.Metrics{ID: "metric_" + strconv.Itoa(i), MType: "gauge", Value: float64Ptr(float64(i))}
+		require.NoError(t, s.UpdateMetrics(ctx, []*metrics.Metrics{counter, gauge}))
+		want[MetricKey("counter", counter.ID)] = counter
+		want[MetricKey("gauge", gauge.ID)] = gauge
+	}
+
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, want, allMetrics)
+
+	// the result is a copy
+	*allMetrics["counter:metric_1"].Delta = 100
+	metric, err := s.Get(ctx, "metric_1", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *metric.Delta)
+}
+
+func TestShardedMemStorage_UpdateMetrics(t *testing.T) {
+	s := NewShardedMemStorage(4, KeyModeTyped)
+	err := s.UpdateMetrics(context.Background(), []*metrics.Metrics{
+		{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "Y", MType: "gauge"},
+		{ID: "X", MType: "counter", Delta: int64Ptr(2)},
+	})
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+
+	metric, err := s.Get(context.Background(), "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *metric.Delta)
+}
+
+func TestShardedMemStorage_UpdateConcurrent(t *testing.T) {
+	s := NewShardedMemStorage(4, KeyModeStrict)
+	ctx := context.Background()
+
+	var testWG sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		testWG.Add(1)
+		go func(i int) {
+			defer testWG.Done()
+			for j := 0; j < 100; j++ {
+				s.Update(ctx, &metrics.Metrics{ID: "testCounter", MType: "counter", Delta: int64Ptr(1)})
+				s.Update(ctx, &metrics.Metrics{ID: "gauge_" + strconv.Itoa(j), MType: "gauge", Value: float64Ptr(float64(i))})
+				if j%10 == 0 {
+					_, _ = s.GetAllMetrics(ctx)
+				}
+			}
+		}(i)
+	}
+	testWG.Wait()
+
+	metric, err := s.Get(ctx, "testCounter", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10000), *metric.Delta)
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, allMetrics, 101)
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// snapshotMagic starts every snapshot file, files without it are read as plain JSON.
+	snapshotMagic   = "GMSS"
+	snapshotVersion = 1
+	// snapshotHeaderSize is the size of the magic, version, flags, body checksum and body length.
+	snapshotHeaderSize = len(snapshotMagic) + 1 + 1 + 4 + 8
+	snapshotFlagGzip   = 1 << 0
+	// defaultKeepSnapshots is the number of snapshots kept, including the current one.
+	defaultKeepSnapshots = 3
+)
+
+var errEmptySnapshot = errors.New("empty snapshot")
+
+// encodeSnapshot encodes the content as a snapshot: a header with the CRC-32C checksum
+// and length of the body, followed by the JSON body, optionally gzip-compressed.
+func encodeSnapshot(content fileContent, compress bool) ([]byte, error) {
+	body, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	var flags byte
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err = zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err = zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+		flags |= snapshotFlagGzip
+	}
+
+	data := make([]byte, 0, snapshotHeaderSize+len(body))
+	data = append(data, snapshotMagic...)
+	data = append(data, snapshotVersion, flags)
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(body, walTable))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(body)))
+	return append(data, body...), nil
+}
+
+// decodeSnapshot verifies and decodes a snapshot. Files without the snapshot header
+// are decoded as plain JSON written by earlier versions.
+func decodeSnapshot(data []byte) (fileContent, error) {
+	if len(data) == 0 {
+		return fileContent{}, errEmptySnapshot
+	}
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		return decodeFile(data)
+	}
+	if len(data) < snapshotHeaderSize {
+		return fileContent{}, errors.New("truncated snapshot header")
+	}
+
+	header := data[len(snapshotMagic):snapshotHeaderSize]
+	if version := header[0]; version != snapshotVersion {
+		return fileContent{}, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	flags := header[1]
+	checksum := binary.BigEndian.Uint32(header[2:])
+	length := binary.BigEndian.Uint64(header[6:])
+	body := data[snapshotHeaderSize:]
+	if uint64(len(body)) != length {
+		return fileContent{}, fmt.Errorf("snapshot body has %d bytes, header declares %d", len(body), length)
+	}
+	if crc32.Checksum(body, walTable) != checksum {
+		return fileContent{}, errors.New("snapshot checksum mismatch")
+	}
+
+	if flags&snapshotFlagGzip != 0 {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return fileContent{}, err
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return fileContent{}, err
+		}
+	}
+	return decodeFile(body)
+}
+
+// snapshotPath returns the path of the snapshot generation: 0 is the current
+// snapshot, 1 the previous one and so on.
+func snapshotPath(path string, generation int) string {
+	if generation == 0 {
+		return path
+	}
+	return path + "." + strconv.Itoa(generation)
+}
+
+// writeSnapshot atomically replaces the snapshot at path with data and keeps
+// the previous snapshots up to keep generations in total. The data is written
+// to a temporary file, synced and renamed into place, so a crash leaves either
+// the old or the new snapshot.
+func writeSnapshot(path string, data []byte, keep int) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = rotateSnapshots(path, keep); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotateSnapshots shifts the snapshots at path by one generation, dropping the oldest.
+func rotateSnapshots(path string, keep int) error {
+	if keep <= 1 {
+		return nil
+	}
+	for generation := keep - 2; generation >= 0; generation-- {
+		err := os.Rename(snapshotPath(path, generation), snapshotPath(path, generation+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir makes the renames in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readSnapshot reads the newest valid snapshot at path, falling back to older
+// generations. It returns the generation read, or -1 if there are no snapshots.
+func readSnapshot(path string) (fileContent, int, error) {
+	var errs []error
+	for generation := 0; ; generation++ {
+		data, err := os.ReadFile(snapshotPath(path, generation))
+		if os.IsNotExist(err) {
+			if generation == 0 {
+				continue
+			}
+			break
+		}
+		if err == nil {
+			var content fileContent
+			if content, err = decodeSnapshot(data); err == nil {
+				return content, generation, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", snapshotPath(path, generation), err))
+	}
+	if len(errs) == 0 || (len(errs) == 1 && errors.Is(errs[0], errEmptySnapshot)) {
+		return fileContent{}, -1, nil
+	}
+	return fileContent{}, -1, errors.Join(errs...)
+}
+
+// removeTempSnapshots removes the temporary files left by a crash during writeSnapshot.
+func removeTempSnapshots(path string) {
+	tmpFiles, err := filepath.Glob(path + ".tmp-*")
+	if err != nil {
+		return
+	}
+	for _, tmpFile := range tmpFiles {
+		os.Remove(tmpFile)
+	}
+}
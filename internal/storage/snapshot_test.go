@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+func testSnapshotContent(delta int64) fileContent {
+	return fileContent{
+		Version:  fileFormatVersion,
+		Sequence: uint64(delta),
+		Metrics: []*metrics.Metrics{
+			{ID: "X", MType: "counter", Delta: int64Ptr(delta)},
+			{ID: "Y", MType: "gauge", Value: float64Ptr(1.5)},
+		},
+	}
+}
+
+func Test_decodeSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		compress bool
+		damage   func(data []byte) []byte
+		wantErr  bool
+	}{
+		{name: "plain", damage: func(data []byte) []byte { return data }},
+		{name: "compressed", compress: true, damage: func(data []byte) []byte { return data }},
+		{
+			name: "corrupted body",
+			damage: func(data []byte) []byte {
+				data[len(data)-3] ^= 0xff
+				return data
+			},
+			wantErr: true,
+		},
+		{
+			name: "corrupted compressed body",
+			damage: func(data []byte) []byte {
+				data[len(data)-3] ^= 0xff
+				return data
+			},
+			compress: true,
+			wantErr:  true,
+		},
+		{name: "truncated body", damage: func(data []byte) []byte { return data[:len(data)-1] }, wantErr: true},
+		{name: "truncated header", damage: func(data []byte) []byte { return data[:snapshotHeaderSize-1] }, wantErr: true},
+		{
+			name: "unsupported version",
+			damage: func(data []byte) []byte {
+				data[len(snapshotMagic)] = snapshotVersion + 1
+				return data
+			},
+			wantErr: true,
+		},
+		{name: "empty", damage: func(data []byte) []byte { return nil }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := testSnapshotContent(3)
+			data, err := encodeSnapshot(want, tt.compress)
+			require.NoError(t, err)
+
+			got, err := decodeSnapshot(tt.damage(data))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func Test_decodeSnapshot_legacyJSON(t *testing.T) {
+	got, err := decodeSnapshot([]byte(`{"version": 2, "sequence": 7, "metrics": [{"id": "X", "type": "counter", "delta": 4}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), got.Sequence)
+	assert.Len(t, got.Metrics, 1)
+}
+
+func Test_writeSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	for delta := int64(1); delta <= 5; delta++ {
+		data, err := encodeSnapshot(testSnapshotContent(delta), false)
+		require.NoError(t, err)
+		require.NoError(t, writeSnapshot(path, data, 3))
+	}
+
+	// the current snapshot and two previous ones are kept
+	for generation, wantSequence := range []uint64{5, 4, 3} {
+		data, err := os.ReadFile(snapshotPath(path, generation))
+		require.NoError(t, err)
+		content, err := decodeSnapshot(data)
+		require.NoError(t, err)
+		assert.Equal(t, wantSequence, content.Sequence)
+	}
+	assert.NoFileExists(t, snapshotPath(path, 3))
+	tmpFiles, err := filepath.Glob(path + ".tmp-*")
+	require.NoError(t, err)
+	assert.Empty(t, tmpFiles)
+}
+
+func Test_readSnapshot(t *testing.T) {
+	tests := []struct {
+		name           string
+		damage         func(t *testing.T, path string)
+		wantGeneration int
+		wantSequence   uint64
+		wantErr        bool
+	}{
+		{
+			name:           "current snapshot",
+			damage:         func(t *testing.T, path string) {},
+			wantGeneration: 0,
+			wantSequence:   3,
+		},
+		{
+			name: "corrupted current snapshot",
+			damage: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, []byte(snapshotMagic+"garbage"), 0644))
+			},
+			wantGeneration: 1,
+			wantSequence:   2,
+		},
+		{
+			name: "missing current snapshot",
+			damage: func(t *testing.T, path string) {
+				require.NoError(t, os.Remove(path))
+			},
+			wantGeneration: 1,
+			wantSequence:   2,
+		},
+		{
+			name: "empty current snapshot",
+			damage: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, nil, 0644))
+			},
+			wantGeneration: 1,
+			wantSequence:   2,
+		},
+		{
+			name: "all snapshots corrupted",
+			damage: func(t *testing.T, path string) {
+				for generation := 0; generation < 3; generation++ {
+					require.NoError(t, os.WriteFile(snapshotPath(path, generation), []byte("{"), 0644))
+				}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.json")
+			for delta := int64(1); delta <= 3; delta++ {
+				data, err := encodeSnapshot(testSnapshotContent(delta), true)
+				require.NoError(t, err)
+				require.NoError(t, writeSnapshot(path, data, 3))
+			}
+			tt.damage(t, path)
+
+			content, generation, err := readSnapshot(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantGeneration, generation)
+			assert.Equal(t, tt.wantSequence, content.Sequence)
+		})
+	}
+}
+
+func Test_readSnapshot_none(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	_, generation, err := readSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, generation)
+
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	_, generation, err = readSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, generation)
+}
+
+func TestFileStorage_SnapshotFallback(t *testing.T) {
+	logger.InitLogger()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs, err := NewFileStorage(path, 0, KeyModeTyped)
+	require.NoError(t, err)
+	fs.SetSnapshotOptions(2, true)
+	require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+	require.NoError(t, fs.Close())
+	fs, err = NewFileStorage(path, 0, KeyModeTyped)
+	require.NoError(t, err)
+	fs.SetSnapshotOptions(2, true)
+	require.NoError(t, fs.LoadMetrics())
+	require.NoError(t, fs.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}))
+
+	// a crash while writing leaves a temporary file and a torn current snapshot
+	require.NoError(t, os.WriteFile(path+".tmp-123", []byte("partial"), 0644))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data[:len(data)/2], 0644))
+
+	restored, err := NewFileStorage(path, 0, KeyModeTyped)
+	require.NoError(t, err)
+	require.NoError(t, restored.LoadMetrics())
+	metric, err := restored.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *metric.Delta)
+	assert.NoFileExists(t, path+".tmp-123")
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/golang-migrate/migrate/v4"
+	sqlitemigrate "github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/evgfitil/go-metrics-server.git/db"
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+const (
+	sqliteDriverName = "sqlite"
+	// sqliteOptions enables the write-ahead log, waits for locks instead of failing
+	// and takes the write lock when a transaction begins, so transactions do not deadlock.
+	sqliteOptions = "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+
+	sqliteUpsertCounterQuery = "INSERT INTO counter (id, delta) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET delta = counter.delta + EXCLUDED.delta"
+	sqliteUpsertGaugeQuery   = "INSERT INTO gauge (id, value) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET value = $2"
+)
+
+func init() {
+	Register("sqlite", openSQLiteStorage)
+}
+
+// openSQLiteStorage opens an SQLiteStorage from a URL of the form "sqlite:///path/to/metrics.db".
+func openSQLiteStorage(u *url.URL, opts Options) (Storage, error) {
+	if err := checkParams(u); err != nil {
+		return nil, err
+	}
+	path := u.Host + u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, errors.New("sqlite storage requires a path")
+	}
+	return NewSQLiteStorage(path, opts.KeyMode)
+}
+
+// SQLiteStorage stores metrics in an embedded SQLite database. It has the same
+// upsert semantics as DBStorage.
+type SQLiteStorage struct {
+	conn    *sql.DB
+	keyMode KeyMode
+}
+
+// NewSQLiteStorage opens the database file at path in WAL mode, applies the embedded
+// migrations and creates an SQLiteStorage with the given key mode.
+func NewSQLiteStorage(path string, keyMode KeyMode) (*SQLiteStorage, error) {
+	conn, err := sql.Open(sqliteDriverName, "file:"+path+"?"+sqliteOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sqlite database: %w", err)
+	}
+	if err = migrateSQLite(conn); err != nil {
+		if closeErr := conn.Close(); closeErr != nil {
+			logger.Sugar.Errorf("error closing sqlite database: %v", closeErr)
+		}
+		return nil, err
+	}
+	return &SQLiteStorage{conn: conn, keyMode: keyMode}, nil
+}
+
+// migrateSQLite applies the embedded migrations to the database.
+func migrateSQLite(conn *sql.DB) error {
+	source, err := iofs.New(db.SQLiteMigrations, "sqlite")
+	if err != nil {
+		return fmt.Errorf("error reading sqlite migrations: %w", err)
+	}
+	driver, err := sqlitemigrate.WithInstance(conn, &sqlitemigrate.Config{})
+	if err != nil {
+		return fmt.Errorf("error preparing sqlite migrations: %w", err)
+	}
+	m, err := migrate.NewWithInstance("iofs", source, sqliteDriverName, driver)
+	if err != nil {
+		return fmt.Errorf("error preparing sqlite migrations: %w", err)
+	}
+	// closing m would close conn, so only the source is released
+	defer source.Close()
+
+	if err = m.Up(); err != nil {
+		if errors.Is(err, migrate.ErrNoChange) {
+			logger.Sugar.Infoln("skipping sqlite migrations, no changes")
+			return nil
+		}
+		return fmt.Errorf("error applying sqlite migrations: %w", err)
+	}
+	logger.Sugar.Infoln("sqlite migrations applied successfully")
+	return nil
+}
+
+// classifySQLiteError wraps SQLite errors into the storage errors.
+func classifySQLiteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_CANTOPEN, sqlite3.SQLITE_IOERR, sqlite3.SQLITE_FULL:
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return err
+	}
+	if errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
+
+func (s *SQLiteStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	if err := ValidateMetric(metric); err != nil {
+		return err
+	}
+	if s.keyMode == KeyModeStrict {
+		return s.UpdateMetrics(ctx, []*metrics.Metrics{metric})
+	}
+	if err := s.upsert(ctx, s.conn, metric); err != nil {
+		logger.Sugar.Errorf("error updating %s metric: %v", metric.MType, err)
+		return classifySQLiteError(err)
+	}
+	return nil
+}
+
+// upsert writes a valid metric, adding the delta of a counter to the stored one.
+func (s *SQLiteStorage) upsert(ctx context.Context, q queryExecer, metric *metrics.Metrics) error {
+	var err error
+	switch metric.MType {
+	case "counter":
+		_, err = q.ExecContext(ctx, sqliteUpsertCounterQuery, metric.ID, *metric.Delta)
+	case "gauge":
+		_, err = q.ExecContext(ctx, sqliteUpsertGaugeQuery, metric.ID, *metric.Value)
+	}
+	return err
+}
+
+// conflict returns ErrTypeMismatch if the key mode is strict and the name is used
+// by a metric of another type. Write transactions hold the database lock, so no
+// extra locking is needed.
+func (s *SQLiteStorage) conflict(ctx context.Context, q queryExecer, metricName, metricType string) error {
+	if s.keyMode != KeyModeStrict {
+		return nil
+	}
+	var exists bool
+	if err := q.QueryRowContext(ctx, existsQueries[otherType(metricType)], metricName).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return typeMismatch(metricName, metricType)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) Get(ctx context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	metric := metrics.Metrics{MType: metricType}
+	var err error
+
+	switch metricType {
+	case "counter":
+		err = s.conn.QueryRowContext(ctx, "SELECT id, delta FROM counter WHERE id = $1", metricName).Scan(&metric.ID, &metric.Delta)
+	case "gauge":
+		err = s.conn.QueryRowContext(ctx, "SELECT id, value FROM gauge WHERE id = $1", metricName).Scan(&metric.ID, &metric.Value)
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %q", ErrInvalidMetric, metricType)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		if conflictErr := s.conflict(ctx, s.conn, metricName, metricType); conflictErr != nil {
+			return nil, classifySQLiteError(conflictErr)
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.Sugar.Errorf("error retrieving metric: %v", err)
+		}
+		return nil, classifySQLiteError(err)
+	}
+	return &metric, nil
+}
+
+func (s *SQLiteStorage) GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error) {
+	allMetrics := make(map[string]*metrics.Metrics)
+	if err := s.fetchMetrics(ctx, "counter", "SELECT id, delta FROM counter", allMetrics); err != nil {
+		return nil, classifySQLiteError(err)
+	}
+	if err := s.fetchMetrics(ctx, "gauge", "SELECT id, value FROM gauge", allMetrics); err != nil {
+		return nil, classifySQLiteError(err)
+	}
+	return allMetrics, nil
+}
+
+func (s *SQLiteStorage) fetchMetrics(ctx context.Context, metricType, query string, allMetrics map[string]*metrics.Metrics) error {
+	rows, err := s.conn.QueryContext(ctx, query)
+	if err != nil {
+		logger.Sugar.Errorf("error retrieving metrics: %v", err)
+		return err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logger.Sugar.Errorf("error closing the SQL rows: %v", err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		m := metrics.Metrics{MType: metricType}
+		if metricType == "counter" {
+			err = rows.Scan(&m.ID, &m.Delta)
+		} else {
+			err = rows.Scan(&m.ID, &m.Value)
+		}
+		if err != nil {
+			logger.Sugar.Errorf("error retrieving metric: %v", err)
+			return err
+		}
+		allMetrics[MetricKey(m.MType, m.ID)] = &m
+	}
+	if err = rows.Err(); err != nil {
+		logger.Sugar.Errorf("error after row iteration: %v", err)
+		return err
+	}
+	return nil
+}
+
+// UpdateMetrics applies every valid metric of the batch in a single transaction and
+// returns the joined errors of the invalid and conflicting metrics.
+func (s *SQLiteStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	var invalid []error
+	validMetrics := make([]*metrics.Metrics, 0, len(batchOfMetrics))
+	for _, metric := range batchOfMetrics {
+		if err := ValidateMetric(metric); err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		validMetrics = append(validMetrics, metric)
+	}
+	if len(validMetrics) == 0 {
+		return errors.Join(invalid...)
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Sugar.Errorf("error starting transaction: %v", err)
+		return classifySQLiteError(err)
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			logger.Sugar.Errorf("error rolling back the transaction: %v", err)
+		}
+	}(tx)
+
+	for _, metric := range validMetrics {
+		err = s.conflict(ctx, tx, metric.ID, metric.MType)
+		if errors.Is(err, ErrTypeMismatch) {
+			invalid = append(invalid, err)
+			continue
+		}
+		if err == nil {
+			err = s.upsert(ctx, tx, metric)
+		}
+		if err != nil {
+			return classifySQLiteError(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return classifySQLiteError(err)
+	}
+	return errors.Join(invalid...)
+}
+
+// UpdateMetricsAtomic applies every metric of the batch in a single transaction, or none
+// of them if any is invalid or conflicting.
+func (s *SQLiteStorage) UpdateMetricsAtomic(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := validateBatch(batchOfMetrics, s.keyMode); err != nil {
+		return err
+	}
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Sugar.Errorf("error starting transaction: %v", err)
+		return classifySQLiteError(err)
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			logger.Sugar.Errorf("error rolling back the transaction: %v", err)
+		}
+	}(tx)
+
+	var conflicts []error
+	for _, metric := range batchOfMetrics {
+		err = s.conflict(ctx, tx, metric.ID, metric.MType)
+		if errors.Is(err, ErrTypeMismatch) {
+			conflicts = append(conflicts, err)
+			continue
+		}
+		if err != nil {
+			return classifySQLiteError(err)
+		}
+	}
+	if len(conflicts) > 0 {
+		return errors.Join(conflicts...)
+	}
+	for _, metric := range batchOfMetrics {
+		if err = s.upsert(ctx, tx, metric); err != nil {
+			return classifySQLiteError(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return classifySQLiteError(err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) Ping(ctx context.Context) error {
+	if err := s.conn.PingContext(ctx); err != nil {
+		logger.Sugar.Errorf("error connecting to sqlite database: %v", err)
+		return classifySQLiteError(err)
+	}
+	return nil
+}
+
+// SaveMetrics moves the committed transactions from the write-ahead log into the database file.
+func (s *SQLiteStorage) SaveMetrics(ctx context.Context) error {
+	if _, err := s.conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return classifySQLiteError(err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+func newTestSQLiteStorage(t *testing.T, path string, keyMode KeyMode) *SQLiteStorage {
+	logger.InitLogger()
+	s, err := NewSQLiteStorage(path, keyMode)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteStorage_Update(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteStorage(t, filepath.Join(t.TempDir(), "metrics.db"), KeyModeTyped)
+
+	var journalMode string
+	require.NoError(t, s.conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+
+	assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(2)}))
+	assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(3)}))
+	assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "gauge", Value: float64Ptr(1.5)}))
+	assert.NoError(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "gauge", Value: float64Ptr(2.5)}))
+	assert.ErrorIs(t, s.Update(ctx, &metrics.Metrics{ID: "X", MType: "counter"}), ErrInvalidMetric)
+
+	counter, err := s.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(5)}, counter)
+	gauge, err := s.Get(ctx, "X", "gauge")
+	require.NoError(t, err)
+	assert.Equal(t, &metrics.Metrics{ID: "X", MType: "gauge", Value: float64Ptr(2.5)}, gauge)
+
+	_, err = s.Get(ctx, "Y", "counter")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.Get(ctx, "X", "histogram")
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		"counter:X": {ID: "X", MType: "counter", Delta: int64Ptr(5)},
+		"gauge:X":   {ID: "X", MType: "gauge", Value: float64Ptr(2.5)},
+	}, allMetrics)
+}
+
+func TestSQLiteStorage_UpdateMetrics(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	s := newTestSQLiteStorage(t, path, KeyModeStrict)
+
+	err := s.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "X", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "X", MType: "gauge", Value: float64Ptr(1.5)},
+		{ID: "Y", MType: "gauge"},
+		{ID: "Z", MType: "gauge", Value: float64Ptr(0.5)},
+	})
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+
+	_, err = s.Get(ctx, "X", "gauge")
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	assert.NoError(t, s.SaveMetrics(ctx))
+	require.NoError(t, s.Close())
+
+	// the metrics survive reopening the database
+	s = newTestSQLiteStorage(t, path, KeyModeStrict)
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		"counter:X": {ID: "X", MType: "counter", Delta: int64Ptr(2)},
+		"gauge:Z":   {ID: "Z", MType: "gauge", Value: float64Ptr(0.5)},
+	}, allMetrics)
+}
+
+func TestSQLiteStorage_UpdateConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteStorage(t, filepath.Join(t.TempDir(), "metrics.db"), KeyModeTyped)
+
+	var testWG sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		testWG.Add(1)
+		go func() {
+			defer testWG.Done()
+			assert.NoError(t, s.UpdateMetrics(ctx, []*metrics.Metrics{{ID: "X", MType: "counter", Delta: int64Ptr(1)}}))
+		}()
+	}
+	testWG.Wait()
+
+	counter, err := s.Get(ctx, "X", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), *counter.Delta)
+	assert.NoError(t, s.Ping(ctx))
+}
@@ -0,0 +1,321 @@
+// Package storagetest provides a conformance suite for the implementations of
+// storage.Storage. Every backend is expected to behave the same way for the behaviors
+// it checks, so the server does not depend on the backend it is configured with.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+	"github.com/evgfitil/go-metrics-server.git/internal/storage"
+)
+
+// Harness creates the storages under test.
+type Harness struct {
+	// New prepares an empty storage with the key mode and returns the function that
+	// opens it. The persistence checks call the function again after Close to reopen
+	// the same storage.
+	New func(t *testing.T, keyMode storage.KeyMode) func() (storage.Storage, error)
+	// Persistent reports whether the metrics are kept when the storage is reopened.
+	Persistent bool
+}
+
+// open prepares and opens an empty storage, which is closed when the test ends.
+func (h Harness) open(t *testing.T, keyMode storage.KeyMode) storage.Storage {
+	s, err := h.New(t, keyMode)()
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Run runs the conformance suite against the storages created by the harness.
+func Run(t *testing.T, h Harness) {
+	t.Run("CounterAccumulation", func(t *testing.T) { testCounterAccumulation(t, h) })
+	t.Run("GaugeOverwrite", func(t *testing.T) { testGaugeOverwrite(t, h) })
+	t.Run("TypeIsolation", func(t *testing.T) { testTypeIsolation(t, h) })
+	t.Run("StrictKeyMode", func(t *testing.T) { testStrictKeyMode(t, h) })
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, h) })
+	t.Run("InvalidMetrics", func(t *testing.T) { testInvalidMetrics(t, h) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, h) })
+	t.Run("AtomicBatch", func(t *testing.T) { testAtomicBatch(t, h) })
+	t.Run("Copies", func(t *testing.T) { testCopies(t, h) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, h) })
+	t.Run("Persistence", func(t *testing.T) {
+		if !h.Persistent {
+			t.Skip("the storage does not persist metrics")
+		}
+		testPersistence(t, h)
+	})
+}
+
+func counter(id string, delta int64) *metrics.Metrics {
+	return &metrics.Metrics{ID: id, MType: "counter", Delta: &delta}
+}
+
+func gauge(id string, value float64) *metrics.Metrics {
+	return &metrics.Metrics{ID: id, MType: "gauge", Value: &value}
+}
+
+// requireMetric checks the stored metric.
+func requireMetric(t *testing.T, s storage.Storage, want *metrics.Metrics) {
+	t.Helper()
+	got, err := s.Get(context.Background(), want.ID, want.MType)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func testCounterAccumulation(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	for _, delta := range []int64{5, 10, -3, 0} {
+		require.NoError(t, s.Update(ctx, counter("requests", delta)))
+	}
+	requireMetric(t, s, counter("requests", 12))
+}
+
+func testGaugeOverwrite(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	for _, value := range []float64{1.5, -2.25, 0} {
+		require.NoError(t, s.Update(ctx, gauge("temperature", value)))
+		requireMetric(t, s, gauge("temperature", value))
+	}
+}
+
+func testTypeIsolation(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	require.NoError(t, s.Update(ctx, counter("shared", 3)))
+	require.NoError(t, s.Update(ctx, gauge("shared", 4.5)))
+	require.NoError(t, s.Update(ctx, counter("shared", 1)))
+
+	requireMetric(t, s, counter("shared", 4))
+	requireMetric(t, s, gauge("shared", 4.5))
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		storage.MetricKey("counter", "shared"): counter("shared", 4),
+		storage.MetricKey("gauge", "shared"):   gauge("shared", 4.5),
+	}, allMetrics)
+}
+
+func testStrictKeyMode(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeStrict)
+	ctx := context.Background()
+
+	require.NoError(t, s.Update(ctx, counter("owned", 1)))
+	assert.ErrorIs(t, s.Update(ctx, gauge("owned", 1)), storage.ErrTypeMismatch)
+	_, err := s.Get(ctx, "owned", "gauge")
+	assert.ErrorIs(t, err, storage.ErrTypeMismatch)
+
+	// the first type of a name in a batch wins
+	err = s.UpdateMetrics(ctx, []*metrics.Metrics{gauge("batched", 1), counter("batched", 1), counter("owned", 1)})
+	assert.ErrorIs(t, err, storage.ErrTypeMismatch)
+	requireMetric(t, s, gauge("batched", 1))
+	requireMetric(t, s, counter("owned", 2))
+
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, allMetrics, 2)
+}
+
+func testNotFound(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	_, err := s.Get(ctx, "missing", "counter")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	require.NoError(t, s.Update(ctx, counter("present", 1)))
+	_, err = s.Get(ctx, "present", "gauge")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = s.Get(ctx, "present", "histogram")
+	assert.ErrorIs(t, err, storage.ErrInvalidMetric)
+
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, allMetrics, 1)
+}
+
+// invalidMetrics are the metrics every storage must reject with ErrInvalidMetric.
+var invalidMetrics = map[string]*metrics.Metrics{
+	"nil":                   nil,
+	"empty name":            gauge("", 1),
+	"counter without delta": {ID: "c", MType: "counter"},
+	"gauge without value":   {ID: "g", MType: "gauge"},
+	"counter with value":    {ID: "c", MType: "counter", Value: gauge("c", 1).Value},
+	"unsupported type":      {ID: "h", MType: "histogram", Value: gauge("h", 1).Value},
+	"NaN gauge":             gauge("g", math.NaN()),
+	"infinite gauge":        gauge("g", math.Inf(-1)),
+}
+
+func testInvalidMetrics(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	for name, metric := range invalidMetrics {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorIs(t, s.Update(ctx, metric), storage.ErrInvalidMetric)
+			assert.ErrorIs(t, s.UpdateMetrics(ctx, []*metrics.Metrics{metric}), storage.ErrInvalidMetric)
+		})
+	}
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, allMetrics)
+}
+
+func testBatch(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	assert.NoError(t, s.UpdateMetrics(ctx, nil))
+	require.NoError(t, s.UpdateMetrics(ctx, []*metrics.Metrics{
+		counter("c", 1), gauge("g", 1), counter("c", 2), gauge("g", 2),
+	}))
+	requireMetric(t, s, counter("c", 3))
+	requireMetric(t, s, gauge("g", 2))
+
+	// the valid metrics of a batch are applied, the invalid ones reported
+	err := s.UpdateMetrics(ctx, []*metrics.Metrics{counter("c", 4), nil, {ID: "g", MType: "gauge"}, gauge("g", 5)})
+	assert.ErrorIs(t, err, storage.ErrInvalidMetric)
+	requireMetric(t, s, counter("c", 7))
+	requireMetric(t, s, gauge("g", 5))
+}
+
+// atomic returns the storage as an AtomicUpdater, which every backend implements.
+func atomic(t *testing.T, s storage.Storage) storage.AtomicUpdater {
+	t.Helper()
+	updater, ok := s.(storage.AtomicUpdater)
+	require.True(t, ok, "%T does not implement storage.AtomicUpdater", s)
+	return updater
+}
+
+func testAtomicBatch(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeStrict)
+	updater := atomic(t, s)
+	ctx := context.Background()
+
+	assert.NoError(t, updater.UpdateMetricsAtomic(ctx, nil))
+	require.NoError(t, updater.UpdateMetricsAtomic(ctx, []*metrics.Metrics{
+		counter("c", 1), gauge("g", 1), counter("c", 2), gauge("g", 2),
+	}))
+	requireMetric(t, s, counter("c", 3))
+	requireMetric(t, s, gauge("g", 2))
+
+	// a batch with an invalid or conflicting metric changes nothing
+	rejected := map[string]struct {
+		batch   []*metrics.Metrics
+		wantErr error
+	}{
+		"invalid":              {[]*metrics.Metrics{counter("c", 1), nil, gauge("new", 1)}, storage.ErrInvalidMetric},
+		"stored as other type": {[]*metrics.Metrics{counter("c", 1), gauge("new", 1), counter("g", 1)}, storage.ErrTypeMismatch},
+		"both types in batch":  {[]*metrics.Metrics{counter("c", 1), gauge("new", 1), counter("new", 1)}, storage.ErrTypeMismatch},
+	}
+	for name, tt := range rejected {
+		t.Run(name, func(t *testing.T) {
+			err := updater.UpdateMetricsAtomic(ctx, tt.batch)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+	requireMetric(t, s, counter("c", 3))
+	requireMetric(t, s, gauge("g", 2))
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, allMetrics, 2)
+
+	// the conflicting metrics are reported by name and type
+	metricErrs, other := storage.MetricErrors(updater.UpdateMetricsAtomic(ctx, []*metrics.Metrics{gauge("c", 1), gauge("new", 1)}))
+	assert.NoError(t, other)
+	require.Len(t, metricErrs, 1)
+	assert.Equal(t, "c", metricErrs[0].ID)
+	assert.Equal(t, "gauge", metricErrs[0].MType)
+}
+
+func testCopies(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	// the storage keeps no pointers of the caller
+	written := counter("c", 1)
+	require.NoError(t, s.Update(ctx, written))
+	*written.Delta = 100
+	batch := []*metrics.Metrics{gauge("g", 1)}
+	require.NoError(t, s.UpdateMetrics(ctx, batch))
+	*batch[0].Value = 100
+
+	// and returns none of its own
+	got, err := s.Get(ctx, "c", "counter")
+	require.NoError(t, err)
+	*got.Delta = 200
+	allMetrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	*allMetrics[storage.MetricKey("gauge", "g")].Value = 200
+
+	requireMetric(t, s, counter("c", 1))
+	requireMetric(t, s, gauge("g", 1))
+}
+
+func testConcurrency(t *testing.T, h Harness) {
+	s := h.open(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	const writers, writes = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				assert.NoError(t, s.Update(ctx, counter("shared", 1)))
+				assert.NoError(t, s.UpdateMetrics(ctx, []*metrics.Metrics{
+					counter("batched", 2), gauge(fmt.Sprintf("gauge_%d", i), float64(j)),
+				}))
+				if j%10 == 0 {
+					_, err := s.GetAllMetrics(ctx)
+					assert.NoError(t, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	requireMetric(t, s, counter("shared", writers*writes))
+	requireMetric(t, s, counter("batched", 2*writers*writes))
+	for i := 0; i < writers; i++ {
+		requireMetric(t, s, gauge(fmt.Sprintf("gauge_%d", i), writes-1))
+	}
+}
+
+func testPersistence(t *testing.T, h Harness) {
+	reopen := h.New(t, storage.KeyModeTyped)
+	ctx := context.Background()
+
+	s, err := reopen()
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateMetrics(ctx, []*metrics.Metrics{counter("c", 5), gauge("g", 0.125), gauge("c", 2)}))
+	require.NoError(t, atomic(t, s).UpdateMetricsAtomic(ctx, []*metrics.Metrics{counter("c", 1), gauge("a", 1)}))
+	require.NoError(t, s.SaveMetrics(ctx))
+	want, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = reopen()
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// the reopened storage keeps accumulating
+	require.NoError(t, s.Update(ctx, counter("c", 1)))
+	requireMetric(t, s, counter("c", 7))
+}
@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+const (
+	// defaultTieredInterval is the interval of persisting the changes of a TieredStorage.
+	defaultTieredInterval = time.Second
+	// defaultMaxLag is the age of the oldest change not yet persisted by a TieredStorage
+	// after which writes are refused.
+	defaultMaxLag = 30 * time.Second
+	// tieredPersistTimeout bounds the periodic persisting of the changes and the final
+	// one on Close.
+	tieredPersistTimeout = 10 * time.Second
+)
+
+func init() {
+	Register("tiered+postgres", openTieredStorage)
+	Register("tiered+postgresql", openTieredStorage)
+}
+
+// openTieredStorage opens a TieredStorage from a URL of the form
+// "tiered+postgres://host/db?interval=1s&max_lag=30s". The other query parameters
+// are passed to the PostgreSQL storage, whose cache is disabled unless set.
+func openTieredStorage(u *url.URL, opts Options) (Storage, error) {
+	query := u.Query()
+	interval, err := parseDurationParam(query, "interval", defaultTieredInterval)
+	if err != nil {
+		return nil, err
+	}
+	maxLag, err := parseDurationParam(query, "max_lag", defaultMaxLag)
+	if err != nil {
+		return nil, err
+	}
+	query.Del("interval")
+	query.Del("max_lag")
+	if !query.Has("cache") {
+		query.Set("cache", "false")
+	}
+	coldURL := *u
+	coldURL.Scheme = strings.TrimPrefix(u.Scheme, "tiered+")
+	coldURL.RawQuery = query.Encode()
+
+	cold, err := OpenURL(&coldURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	tiered, err := NewTieredStorage(cold, opts.KeyMode, interval, maxLag)
+	if err != nil {
+		return nil, errors.Join(err, cold.Close())
+	}
+	return tiered, nil
+}
+
+// parseDurationParam parses the positive duration of the query parameter, which defaults to def.
+func parseDurationParam(query url.Values, name string, def time.Duration) (time.Duration, error) {
+	value := query.Get(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration", name, value)
+	}
+	return d, nil
+}
+
+// tieredChanges holds the changes not yet persisted: the summed deltas of the counters,
+// the names of the changed gauges, whose values are read from memory when persisted,
+// and the time of the oldest change.
+type tieredChanges struct {
+	counters map[string]int64
+	gauges   map[string]struct{}
+	since    time.Time
+}
+
+func newTieredChanges() tieredChanges {
+	return tieredChanges{counters: make(map[string]int64), gauges: make(map[string]struct{})}
+}
+
+func (c *tieredChanges) len() int {
+	return len(c.counters) + len(c.gauges)
+}
+
+// TieredStorage serves all reads from memory and persists the changes to a cold
+// storage, such as DBStorage, in the background. It is warmed with the metrics of the
+// cold storage when it is created, so it must be the only writer of the cold storage.
+//
+// The changes are persisted every interval, counters as the sum of their deltas and
+// gauges with their latest value. While the cold storage is unavailable they are kept,
+// and writes are refused with ErrUnavailable once the oldest change not yet persisted
+// is older than maxLag, which bounds the changes lost if the server fails.
+type TieredStorage struct {
+	hot    *ShardedMemStorage
+	cold   Storage
+	maxLag time.Duration
+	// persistTimeout bounds the persisting in the background and on Close.
+	persistTimeout time.Duration
+
+	// mu guards the changes not yet persisted.
+	mu      sync.Mutex
+	changes tieredChanges
+	// saveMu serializes persisting the changes.
+	saveMu sync.Mutex
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTieredStorage warms a memory storage with the metrics of the cold storage and
+// persists the changes to it every interval.
+func NewTieredStorage(cold Storage, keyMode KeyMode, interval, maxLag time.Duration) (*TieredStorage, error) {
+	stored, err := cold.GetAllMetrics(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error warming the tiered storage: %w", err)
+	}
+	hot := NewShardedMemStorage(0, keyMode)
+	for _, key := range sortedKeys(stored) {
+		if err = hot.Update(context.Background(), stored[key]); err != nil {
+			logger.Sugar.Warnf("skipped stored metric %s: %v", key, err)
+		}
+	}
+	logger.Sugar.Infof("tiered storage warmed with %d metrics", len(stored))
+
+	t := &TieredStorage{
+		hot:            hot,
+		cold:           cold,
+		maxLag:         maxLag,
+		persistTimeout: tieredPersistTimeout,
+		changes:        newTieredChanges(),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	go t.run(interval)
+	return t, nil
+}
+
+// run persists the changes every interval until Close.
+func (t *TieredStorage) run(interval time.Duration) {
+	defer close(t.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+		if err := t.withTimeout(t.persist); err != nil {
+			logger.Sugar.Errorf("error persisting metrics: %v", err)
+		}
+	}
+}
+
+// withTimeout runs save within the persist timeout and logs if it is abandoned.
+func (t *TieredStorage) withTimeout(save func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.persistTimeout)
+	defer cancel()
+	err := save(ctx)
+	if ctx.Err() != nil {
+		logger.Sugar.Errorf("persisting metrics abandoned after %s", t.persistTimeout)
+	}
+	return err
+}
+
+// lag returns the age of the oldest change not yet persisted. The caller must hold mu.
+func (t *TieredStorage) lag() time.Duration {
+	if t.changes.len() == 0 {
+		return 0
+	}
+	return time.Since(t.changes.since)
+}
+
+// Lag returns the age of the oldest change not yet persisted to the cold storage.
+func (t *TieredStorage) Lag() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lag()
+}
+
+// checkLag returns ErrUnavailable if the changes not yet persisted are older than maxLag.
+func (t *TieredStorage) checkLag() error {
+	if lag := t.Lag(); lag > t.maxLag {
+		return fmt.Errorf("%w: changes are not persisted for %s", ErrUnavailable, lag.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// record adds the change of a metric applied in memory.
+func (t *TieredStorage) record(metric *metrics.Metrics) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.changes.len() == 0 {
+		t.changes.since = time.Now()
+	}
+	if metric.MType == "counter" {
+		t.changes.counters[metric.ID] += *metric.Delta
+	} else {
+		t.changes.gauges[metric.ID] = struct{}{}
+	}
+}
+
+func (t *TieredStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	if err := t.checkLag(); err != nil {
+		return err
+	}
+	if err := t.hot.Update(ctx, metric); err != nil {
+		return err
+	}
+	t.record(metric)
+	return nil
+}
+
+// UpdateMetrics applies every valid metric of the batch and returns the joined
+// errors of the metrics it could not apply.
+func (t *TieredStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := t.checkLag(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, metric := range batchOfMetrics {
+		if err := t.hot.Update(ctx, metric); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		t.record(metric)
+	}
+	return errors.Join(errs...)
+}
+
+// UpdateMetricsAtomic applies every metric of the batch in memory or none of them.
+func (t *TieredStorage) UpdateMetricsAtomic(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := t.checkLag(); err != nil {
+		return err
+	}
+	if err := t.hot.UpdateMetricsAtomic(ctx, batchOfMetrics); err != nil {
+		return err
+	}
+	for _, metric := range batchOfMetrics {
+		t.record(metric)
+	}
+	return nil
+}
+
+func (t *TieredStorage) Get(ctx context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	return t.hot.Get(ctx, metricName, metricType)
+}
+
+func (t *TieredStorage) GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error) {
+	return t.hot.GetAllMetrics(ctx)
+}
+
+// persist writes the changes recorded so far to the cold storage. If it is unavailable,
+// the changes are kept with the time of the oldest one and persisted with the next ones.
+// If the failure also wraps ErrOutcomeUnknown, the changes may have been persisted, so
+// only the gauges are kept and the deltas of the counters are logged and dropped rather
+// than counted twice. Changes the cold storage rejects are dropped.
+func (t *TieredStorage) persist(ctx context.Context) error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	changes := t.changes
+	t.changes = newTieredChanges()
+	t.mu.Unlock()
+	if changes.len() == 0 {
+		return nil
+	}
+
+	batch := make([]*metrics.Metrics, 0, changes.len())
+	for _, id := range sortedKeys(changes.counters) {
+		delta := changes.counters[id]
+		batch = append(batch, &metrics.Metrics{ID: id, MType: "counter", Delta: &delta})
+	}
+	for _, id := range sortedKeys(changes.gauges) {
+		// the value in memory is the latest one, even if it changed after the swap
+		gauge, err := t.hot.Get(ctx, id, "gauge")
+		if err != nil {
+			t.restore(changes, true)
+			return fmt.Errorf("error reading gauge %s: %w", id, err)
+		}
+		batch = append(batch, gauge)
+	}
+
+	err := t.cold.UpdateMetrics(ctx, batch)
+	if !errors.Is(err, ErrUnavailable) {
+		if err != nil {
+			logger.Sugar.Errorf("dropped metrics rejected by the cold storage: %v", err)
+		}
+		return nil
+	}
+
+	counters := !errors.Is(err, ErrOutcomeUnknown)
+	if !counters {
+		for _, id := range sortedKeys(changes.counters) {
+			logger.Sugar.Errorf("dropped delta %d of counter %s that may have been persisted", changes.counters[id], id)
+		}
+	}
+	t.restore(changes, counters)
+	return err
+}
+
+// restore merges the changes that were not persisted back into the recorded ones,
+// the counters only if counters is set.
+func (t *TieredStorage) restore(changes tieredChanges, counters bool) {
+	if !counters {
+		changes.counters = nil
+	}
+	if changes.len() == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.changes.len() == 0 || changes.since.Before(t.changes.since) {
+		t.changes.since = changes.since
+	}
+	for id, delta := range changes.counters {
+		t.changes.counters[id] += delta
+	}
+	for id := range changes.gauges {
+		t.changes.gauges[id] = struct{}{}
+	}
+}
+
+// SaveMetrics is a barrier: it persists every change applied before the call and
+// saves the cold storage.
+func (t *TieredStorage) SaveMetrics(ctx context.Context) error {
+	if err := t.persist(ctx); err != nil {
+		return err
+	}
+	return t.cold.SaveMetrics(ctx)
+}
+
+// Ping checks the cold storage and the replication lag.
+func (t *TieredStorage) Ping(ctx context.Context) error {
+	if err := t.checkLag(); err != nil {
+		return err
+	}
+	return t.cold.Ping(ctx)
+}
+
+// SelfMetrics returns the replication lag in seconds, the number of changed metrics not
+// yet persisted and the metrics of the cold storage.
+func (t *TieredStorage) SelfMetrics() []*metrics.Metrics {
+	t.mu.Lock()
+	lag := metrics.NewGauge("TieredReplicationLag", t.lag().Seconds())
+	pending := metrics.NewGauge("TieredPending", float64(t.changes.len()))
+	t.mu.Unlock()
+
+	selfMetrics := []*metrics.Metrics{&lag, &pending}
+	if source, ok := t.cold.(interface{ SelfMetrics() []*metrics.Metrics }); ok {
+		selfMetrics = append(selfMetrics, source.SelfMetrics()...)
+	}
+	return selfMetrics
+}
+
+// Close stops the background persistence, persists the remaining changes, giving up
+// after tieredPersistTimeout, and closes the cold storage.
+func (t *TieredStorage) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.done)
+		<-t.stopped
+		saveErr := t.withTimeout(t.SaveMetrics)
+		if saveErr != nil {
+			logger.Sugar.Errorf("error persisting metrics when closing: %v", saveErr)
+		}
+		err = errors.Join(saveErr, t.cold.Close())
+	})
+	return err
+}
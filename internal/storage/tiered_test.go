@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+func newTestTiered(t *testing.T, keyMode KeyMode, maxLag time.Duration) (*TieredStorage, *switchableStorage) {
+	logger.InitLogger()
+	cold := &switchableStorage{MemStorage: NewMemStorageWithKeyMode(keyMode)}
+	require.NoError(t, cold.MemStorage.UpdateMetrics(context.Background(), []*metrics.Metrics{
+		{ID: "C", MType: "counter", Delta: int64Ptr(10)},
+		{ID: "G", MType: "gauge", Value: float64Ptr(1.5)},
+	}))
+	tiered, err := NewTieredStorage(cold, keyMode, time.Hour, maxLag)
+	require.NoError(t, err)
+	t.Cleanup(func() { tiered.Close() })
+	return tiered, cold
+}
+
+func TestTieredStorage(t *testing.T) {
+	tiered, cold := newTestTiered(t, KeyModeTyped, time.Hour)
+	ctx := context.Background()
+
+	// the memory is warmed from the cold storage
+	allMetrics, err := tiered.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		"counter:C": {ID: "C", MType: "counter", Delta: int64Ptr(10)},
+		"gauge:G":   {ID: "G", MType: "gauge", Value: float64Ptr(1.5)},
+	}, allMetrics)
+
+	// writes are served from memory before they are persisted
+	for i := 0; i < 3; i++ {
+		require.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+		require.NoError(t, tiered.UpdateMetrics(ctx, []*metrics.Metrics{{ID: "G", MType: "gauge", Value: float64Ptr(float64(i))}}))
+	}
+	counter, err := tiered.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), *counter.Delta)
+	stored, err := cold.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), *stored.Delta)
+	assert.Positive(t, tiered.Lag())
+
+	// SaveMetrics persists the coalesced changes
+	require.NoError(t, tiered.SaveMetrics(ctx))
+	assert.Zero(t, tiered.Lag())
+	assert.Equal(t, []float64{2}, cold.gauges)
+	coldMetrics, err := cold.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	allMetrics, err = tiered.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, allMetrics, coldMetrics)
+}
+
+func TestTieredStorage_Strict(t *testing.T) {
+	tiered, _ := newTestTiered(t, KeyModeStrict, time.Hour)
+	ctx := context.Background()
+
+	err := tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "gauge", Value: float64Ptr(1)})
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	err = tiered.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "G", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "H", MType: "gauge"},
+		{ID: "C", MType: "counter", Delta: int64Ptr(1)},
+	})
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+	selfMetrics := tiered.SelfMetrics()
+	require.Len(t, selfMetrics, 2)
+	assert.Equal(t, "TieredReplicationLag", selfMetrics[0].ID)
+	assert.Positive(t, *selfMetrics[0].Value)
+	assert.Equal(t, &metrics.Metrics{ID: "TieredPending", MType: "gauge", Value: float64Ptr(1)}, selfMetrics[1])
+}
+
+func TestTieredStorage_MaxLag(t *testing.T) {
+	tiered, cold := newTestTiered(t, KeyModeTyped, 50*time.Millisecond)
+	ctx := context.Background()
+
+	// the changes are kept while the cold storage is unavailable
+	cold.down.Store(true)
+	require.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+	assert.ErrorIs(t, tiered.SaveMetrics(ctx), ErrUnavailable)
+	require.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(2)}))
+
+	// until they are older than the maximum lag
+	time.Sleep(60 * time.Millisecond)
+	assert.ErrorIs(t, tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(4)}), ErrUnavailable)
+	assert.ErrorIs(t, tiered.Ping(ctx), ErrUnavailable)
+	_, err := tiered.Get(ctx, "C", "counter")
+	assert.NoError(t, err)
+
+	cold.down.Store(false)
+	require.NoError(t, tiered.SaveMetrics(ctx))
+	assert.NoError(t, tiered.Ping(ctx))
+	stored, err := cold.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), *stored.Delta)
+}
+
+func TestTieredStorage_PersistFailure(t *testing.T) {
+	tiered, cold := newTestTiered(t, KeyModeTyped, time.Hour)
+	ctx := context.Background()
+
+	// the counters of changes that may have been persisted are not persisted again
+	cold.ambiguous.Store(true)
+	require.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+	require.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(3)}))
+	assert.ErrorIs(t, tiered.SaveMetrics(ctx), ErrOutcomeUnknown)
+	assert.Equal(t, &metrics.Metrics{ID: "TieredPending", MType: "gauge", Value: float64Ptr(1)}, tiered.SelfMetrics()[1])
+	cold.ambiguous.Store(false)
+	require.NoError(t, tiered.SaveMetrics(ctx))
+	stored, err := cold.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), *stored.Delta)
+
+	// the changes are kept if a gauge cannot be read from memory
+	require.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+	tiered.record(&metrics.Metrics{ID: "Missing", MType: "gauge"})
+	assert.ErrorIs(t, tiered.SaveMetrics(ctx), ErrNotFound)
+	tiered.mu.Lock()
+	assert.Equal(t, map[string]int64{"C": 1}, tiered.changes.counters)
+	tiered.mu.Unlock()
+}
+
+// hangingStorage is a MemStorage whose writes hang until the context is done.
+type hangingStorage struct {
+	*MemStorage
+}
+
+func (h hangingStorage) UpdateMetrics(ctx context.Context, _ []*metrics.Metrics) error {
+	<-ctx.Done()
+	return fmt.Errorf("%w: %v", ErrUnavailable, ctx.Err())
+}
+
+func TestTieredStorage_PersistTimeout(t *testing.T) {
+	logger.InitLogger()
+	tiered, err := NewTieredStorage(hangingStorage{NewMemStorage()}, KeyModeTyped, time.Hour, time.Hour)
+	require.NoError(t, err)
+	tiered.persistTimeout = 10 * time.Millisecond
+	ctx := context.Background()
+	require.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+
+	// a hanging cold storage does not block Close
+	closed := make(chan error)
+	go func() { closed <- tiered.Close() }()
+	select {
+	case err = <-closed:
+		assert.ErrorIs(t, err, ErrUnavailable)
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+func TestTieredStorage_Concurrent(t *testing.T) {
+	logger.InitLogger()
+	cold := &switchableStorage{MemStorage: NewMemStorage()}
+	tiered, err := NewTieredStorage(cold, KeyModeTyped, time.Millisecond, time.Hour)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	var testWG sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		testWG.Add(1)
+		go func(i int) {
+			defer testWG.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+				assert.NoError(t, tiered.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(float64(i))}))
+			}
+		}(i)
+	}
+	testWG.Wait()
+	require.NoError(t, tiered.Close())
+
+	hot, err := tiered.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	persisted, err := cold.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, hot, persisted)
+	assert.Equal(t, int64(1000), *persisted["counter:C"].Delta)
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// errWALTorn is returned by an append that failed and could not be undone, so its
+// records may be replayed when the log is read.
+var errWALTorn = errors.New("write-ahead log could not be cut back")
+
+// errWALGap is returned by LoadMetrics when the write-ahead log does not continue the
+// loaded snapshot, so replaying it would skip the records between them.
+var errWALGap = errors.New("write-ahead log does not continue the snapshot")
+
+// walHeaderSize is the size of the record header: the payload length and its CRC-32C checksum.
+const walHeaderSize = 8
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is an update appended to the write-ahead log: a metric, or the metrics of
+// a batch applied atomically, which the checksum of the record keeps whole. Seq orders
+// the records relative to the snapshot, so records already contained in the snapshot
+// are skipped on replay.
+type walRecord struct {
+	Seq    uint64             `json:"seq"`
+	Metric *metrics.Metrics   `json:"metric,omitempty"`
+	Batch  []*metrics.Metrics `json:"batch,omitempty"`
+}
+
+// updates returns the metrics of the record.
+func (r walRecord) updates() []*metrics.Metrics {
+	if r.Batch != nil {
+		return r.Batch
+	}
+	return []*metrics.Metrics{r.Metric}
+}
+
+// writeAheadLog is an append-only file of checksummed update records.
+type writeAheadLog struct {
+	file *os.File
+	size int64
+	buf  []byte
+	// broken is the error of a failed append that could not be undone. The log may end
+	// with a partial record, so it refuses appends until it is truncated.
+	broken error
+}
+
+// openWAL opens the log at path for appending, creating it if needed.
+func openWAL(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &writeAheadLog{file: file, size: size}, nil
+}
+
+// append writes the records with a single write and syncs the log. If the write or
+// the sync fails, the log is cut back to its previous size, so no partial record is
+// left for the later ones to follow.
+func (w *writeAheadLog) append(records []walRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if w.broken != nil {
+		return fmt.Errorf("write-ahead log needs compaction after a failed append: %w", w.broken)
+	}
+	w.buf = w.buf[:0]
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(len(payload)))
+		w.buf = binary.BigEndian.AppendUint32(w.buf, crc32.Checksum(payload, walTable))
+		w.buf = append(w.buf, payload...)
+	}
+	_, err := w.file.Write(w.buf)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err == nil {
+		w.size += int64(len(w.buf))
+		return nil
+	}
+	if truncateErr := w.truncate(w.size); truncateErr != nil {
+		w.broken = err
+		return errors.Join(err, fmt.Errorf("%w: %v", errWALTorn, truncateErr))
+	}
+	return err
+}
+
+// truncate cuts the log to size bytes, dropping the records after it.
+func (w *writeAheadLog) truncate(size int64) error {
+	if err := w.file.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = size
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.broken = nil
+	return nil
+}
+
+func (w *writeAheadLog) close() error {
+	return w.file.Close()
+}
+
+// readWAL reads the records of the log at path. A torn or corrupted final record,
+// left by a crash during append, ends the log; validSize is the size of the log
+// without it. Corruption followed by further data is reported as an error.
+func readWAL(path string) (records []walRecord, validSize int64, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	var offset int64
+	for offset < int64(len(data)) {
+		rest := data[offset:]
+		if len(rest) < walHeaderSize {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(rest))
+		checksum := binary.BigEndian.Uint32(rest[4:])
+		if int64(len(rest)-walHeaderSize) < length {
+			break
+		}
+		payload := rest[walHeaderSize : walHeaderSize+length]
+		end := offset + walHeaderSize + length
+
+		var record walRecord
+		if crc32.Checksum(payload, walTable) != checksum || json.Unmarshal(payload, &record) != nil {
+			if end < int64(len(data)) {
+				return nil, 0, fmt.Errorf("corrupted write-ahead log record at offset %d", offset)
+			}
+			break
+		}
+		records = append(records, record)
+		offset = end
+	}
+	return records, offset, nil
+}
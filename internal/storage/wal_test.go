@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+func writeTestWAL(t *testing.T, path string, n int) int64 {
+	wal, err := openWAL(path)
+	require.NoError(t, err)
+	defer wal.close()
+
+	records := make([]walRecord, n)
+	for i := range records {
+		records[i] = walRecord{Seq: uint64(i + 1), Metric: &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}}
+	}
+	require.NoError(t, wal.append(records))
+	return wal.size
+}
+
+func Test_readWAL(t *testing.T) {
+	tests := []struct {
+		name        string
+		damage      func(data []byte) []byte
+		wantRecords int
+		wantErr     bool
+	}{
+		{
+			name:        "intact log",
+			damage:      func(data []byte) []byte { return data },
+			wantRecords: 3,
+		},
+		{
+			name:        "torn header",
+			damage:      func(data []byte) []byte { return append(data, 0, 0, 1) },
+			wantRecords: 3,
+		},
+		{
+			name:        "torn payload",
+			damage:      func(data []byte) []byte { return data[:len(data)-5] },
+			wantRecords: 2,
+		},
+		{
+			name: "corrupted final record",
+			damage: func(data []byte) []byte {
+				data[len(data)-2] ^= 0xff
+				return data
+			},
+			wantRecords: 2,
+		},
+		{
+			name: "corrupted record in the middle",
+			damage: func(data []byte) []byte {
+				data[walHeaderSize+2] ^= 0xff
+				return data
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.json.wal")
+			writeTestWAL(t, path, 3)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			data = tt.damage(data)
+			require.NoError(t, os.WriteFile(path, data, 0644))
+
+			records, validSize, err := readWAL(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, records, tt.wantRecords)
+			for i, record := range records {
+				assert.Equal(t, uint64(i+1), record.Seq)
+			}
+			assert.LessOrEqual(t, validSize, int64(len(data)))
+		})
+	}
+}
+
+func Test_readWAL_missing(t *testing.T) {
+	records, validSize, err := readWAL(filepath.Join(t.TempDir(), "missing.wal"))
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+	assert.Zero(t, validSize)
+}
+
+func Test_writeAheadLog_failedAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	size := writeTestWAL(t, path, 2)
+	wal, err := openWAL(path)
+	require.NoError(t, err)
+	defer wal.close()
+	record := []walRecord{{Seq: 3, Metric: &metrics.Metrics{ID: "X", MType: "counter", Delta: int64Ptr(1)}}}
+
+	// a read-only handle fails the write and the truncation that undoes it
+	writable := wal.file
+	wal.file, err = os.Open(path)
+	require.NoError(t, err)
+	assert.ErrorIs(t, wal.append(record), errWALTorn)
+	assert.Equal(t, size, wal.size)
+	require.NoError(t, wal.file.Close())
+
+	// the log refuses appends until it is truncated
+	wal.file = writable
+	err = wal.append(record)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errWALTorn)
+	require.NoError(t, wal.truncate(size))
+	require.NoError(t, wal.append(record))
+
+	records, validSize, err := readWAL(path)
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, wal.size, validSize)
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+const (
+	// defaultWatchBuffer is the number of change events buffered per subscriber.
+	defaultWatchBuffer = 256
+	// watchStripes is the number of locks the metric keys of watched writes are spread over.
+	watchStripes = 64
+)
+
+// ChangeEvent describes the change of a metric by a write.
+type ChangeEvent struct {
+	// Key is the key of the metric, as returned by MetricKey.
+	Key string
+	// Old is the metric before the write, nil if it was created by the write.
+	Old *metrics.Metrics
+	// New is the metric after the write.
+	New *metrics.Metrics
+	// Time is when the write was applied.
+	Time time.Time
+}
+
+// WatchFilter selects the metrics a subscriber is notified of.
+type WatchFilter struct {
+	// Name is a glob pattern, as in path.Match, the metric names must match.
+	// An empty pattern matches every name.
+	Name string
+	// Type is the type of the metrics, empty for both types.
+	Type string
+}
+
+// Validate checks the name pattern and the type of the filter.
+func (f WatchFilter) Validate() error {
+	if _, err := path.Match(f.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q: %w", f.Name, err)
+	}
+	if f.Type != "" {
+		return validateType(f.Type)
+	}
+	return nil
+}
+
+// Match reports whether the metric is selected by the valid filter.
+func (f WatchFilter) Match(metric *metrics.Metrics) bool {
+	if f.Type != "" && f.Type != metric.MType {
+		return false
+	}
+	if f.Name == "" {
+		return true
+	}
+	matched, _ := path.Match(f.Name, metric.ID)
+	return matched
+}
+
+// Watcher is implemented by the storages that notify subscribers of metric changes.
+type Watcher interface {
+	// Watch subscribes to the changes of the metrics selected by the filter until the
+	// context is done or the storage is closed.
+	Watch(ctx context.Context, filter WatchFilter) (*Subscription, error)
+}
+
+// Subscription receives the change events of a Watcher. The events are buffered;
+// the ones that do not fit into the buffer of a slow subscriber are dropped and counted.
+type Subscription struct {
+	filter  WatchFilter
+	events  chan ChangeEvent
+	dropped atomic.Int64
+}
+
+// Events returns the channel of the change events, closed when the subscription ends.
+func (s *Subscription) Events() <-chan ChangeEvent {
+	return s.events
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// WatchableStorage notifies subscribers of the changes its writes make to the metrics
+// of the backend. It implements Watcher for any backend: while there are subscribers,
+// the writes of a metric are serialized and every written metric is read before and
+// after the write to build the events, so it must be the outermost storage and only
+// the changes made through it are seen. Writes that leave a metric unchanged, such as
+// a zero delta or a rejected write, emit no event.
+type WatchableStorage struct {
+	backend    Storage
+	bufferSize int
+
+	// writeMu is held for reading by every write and for writing by Watch, which
+	// waits for the writes started before there were subscribers.
+	writeMu sync.RWMutex
+	// keyMu serializes the watched writes of the metrics whose keys hash to a lock,
+	// so the events of concurrent writes of a metric are consistent.
+	keyMu [watchStripes]sync.Mutex
+	// mu guards the subscribers.
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+	watched     atomic.Bool
+	// dropped counts the events dropped for slow subscribers.
+	dropped atomic.Int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWatchableStorage wraps the backend with change notifications buffering up to
+// bufferSize events per subscriber, zero means defaultWatchBuffer.
+func NewWatchableStorage(backend Storage, bufferSize int) *WatchableStorage {
+	if bufferSize <= 0 {
+		bufferSize = defaultWatchBuffer
+	}
+	return &WatchableStorage{
+		backend:     backend,
+		bufferSize:  bufferSize,
+		subscribers: make(map[*Subscription]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Watch subscribes to the changes of the metrics selected by the filter. The
+// subscription ends when the context is done or the storage is closed.
+func (w *WatchableStorage) Watch(ctx context.Context, filter WatchFilter) (*Subscription, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	sub := &Subscription{filter: filter, events: make(chan ChangeEvent, w.bufferSize)}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil, fmt.Errorf("%w: storage is closed", ErrUnavailable)
+	}
+	w.subscribers[sub] = struct{}{}
+	w.watched.Store(true)
+	w.mu.Unlock()
+	// the writes that found no subscribers publish no event, so they must end before
+	// the caller reads the metrics the events are applied to
+	w.writeMu.Lock()
+	w.writeMu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.done:
+		}
+		w.unsubscribe(sub)
+	}()
+	return sub, nil
+}
+
+// unsubscribe ends the subscription.
+func (w *WatchableStorage) unsubscribe(sub *Subscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.subscribers[sub]; !ok {
+		return
+	}
+	delete(w.subscribers, sub)
+	close(sub.events)
+	w.watched.Store(len(w.subscribers) > 0)
+}
+
+// publish sends the event to the subscribers whose filter selects the metric.
+func (w *WatchableStorage) publish(event ChangeEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for sub := range w.subscribers {
+		if !sub.filter.Match(event.New) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+			w.dropped.Add(1)
+		}
+	}
+}
+
+// read returns the stored metric, nil if it cannot be read.
+func (w *WatchableStorage) read(ctx context.Context, metricName, metricType string) *metrics.Metrics {
+	metric, err := w.backend.Get(ctx, metricName, metricType)
+	if err != nil {
+		return nil
+	}
+	return metric
+}
+
+// lockKeys locks the stripes of the keys in order and returns the function unlocking them.
+func (w *WatchableStorage) lockKeys(keys []string) func() {
+	var locked [watchStripes]bool
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		locked[h.Sum32()%watchStripes] = true
+	}
+	for i := range locked {
+		if locked[i] {
+			w.keyMu[i].Lock()
+		}
+	}
+	return func() {
+		for i := range locked {
+			if locked[i] {
+				w.keyMu[i].Unlock()
+			}
+		}
+	}
+}
+
+// write applies the batch with update and publishes the changes of its valid metrics.
+func (w *WatchableStorage) write(ctx context.Context, batch []*metrics.Metrics, update func() error) error {
+	w.writeMu.RLock()
+	defer w.writeMu.RUnlock()
+	if !w.watched.Load() {
+		return update()
+	}
+
+	var keys []string
+	written := make(map[string]*metrics.Metrics)
+	old := make(map[string]*metrics.Metrics)
+	for _, metric := range batch {
+		if ValidateMetric(metric) != nil {
+			continue
+		}
+		key := MetricKey(metric.MType, metric.ID)
+		if _, ok := written[key]; ok {
+			continue
+		}
+		keys = append(keys, key)
+		written[key] = metric
+	}
+	unlock := w.lockKeys(keys)
+	defer unlock()
+	for _, key := range keys {
+		old[key] = w.read(ctx, written[key].ID, written[key].MType)
+	}
+
+	err := update()
+	now := time.Now()
+	for _, key := range keys {
+		metric := written[key]
+		current := w.read(ctx, metric.ID, metric.MType)
+		if current == nil || sameMetric(old[key], current) {
+			continue
+		}
+		w.publish(ChangeEvent{Key: key, Old: old[key], New: current, Time: now})
+	}
+	return err
+}
+
+// sameMetric reports whether the metrics, which may be nil, are equal.
+func sameMetric(a, b *metrics.Metrics) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.ID != b.ID || a.MType != b.MType {
+		return false
+	}
+	if a.MType == "counter" {
+		return *a.Delta == *b.Delta
+	}
+	return *a.Value == *b.Value
+}
+
+func (w *WatchableStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	return w.write(ctx, []*metrics.Metrics{metric}, func() error {
+		return w.backend.Update(ctx, metric)
+	})
+}
+
+func (w *WatchableStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	return w.write(ctx, batchOfMetrics, func() error {
+		return w.backend.UpdateMetrics(ctx, batchOfMetrics)
+	})
+}
+
+func (w *WatchableStorage) UpdateMetricsAtomic(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	return w.write(ctx, batchOfMetrics, func() error {
+		return updateAtomic(ctx, w.backend, batchOfMetrics)
+	})
+}
+
+func (w *WatchableStorage) Get(ctx context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	return w.backend.Get(ctx, metricName, metricType)
+}
+
+func (w *WatchableStorage) GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error) {
+	return w.backend.GetAllMetrics(ctx)
+}
+
+func (w *WatchableStorage) SaveMetrics(ctx context.Context) error {
+	return w.backend.SaveMetrics(ctx)
+}
+
+func (w *WatchableStorage) Ping(ctx context.Context) error {
+	return w.backend.Ping(ctx)
+}
+
+// SelfMetrics returns the number of subscribers, of the events dropped for slow
+// subscribers since the last call and the metrics of the backend.
+func (w *WatchableStorage) SelfMetrics() []*metrics.Metrics {
+	w.mu.Lock()
+	subscribers := metrics.NewGauge("WatchSubscribers", float64(len(w.subscribers)))
+	w.mu.Unlock()
+	dropped := metrics.NewCounter("WatchDropped", w.dropped.Swap(0))
+
+	selfMetrics := []*metrics.Metrics{&subscribers, &dropped}
+	if source, ok := w.backend.(interface{ SelfMetrics() []*metrics.Metrics }); ok {
+		selfMetrics = append(selfMetrics, source.SelfMetrics()...)
+	}
+	return selfMetrics
+}
+
+// Close ends the subscriptions and closes the backend.
+func (w *WatchableStorage) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.mu.Lock()
+		w.closed = true
+		for sub := range w.subscribers {
+			delete(w.subscribers, sub)
+			close(sub.events)
+		}
+		w.watched.Store(false)
+		w.mu.Unlock()
+		err = w.backend.Close()
+	})
+	return err
+}
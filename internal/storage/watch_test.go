@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// receive returns the events of the subscription received so far.
+func receive(sub *Subscription) []ChangeEvent {
+	var events []ChangeEvent
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return events
+			}
+			event.Time = time.Time{}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestWatchFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  WatchFilter
+		metric  *metrics.Metrics
+		want    bool
+		wantErr bool
+	}{
+		{"empty", WatchFilter{}, &metrics.Metrics{ID: "Alloc", MType: "gauge"}, true, false},
+		{"glob", WatchFilter{Name: "Heap*"}, &metrics.Metrics{ID: "HeapAlloc", MType: "gauge"}, true, false},
+		{"glob mismatch", WatchFilter{Name: "Heap*"}, &metrics.Metrics{ID: "Alloc", MType: "gauge"}, false, false},
+		{"type", WatchFilter{Type: "counter"}, &metrics.Metrics{ID: "PollCount", MType: "counter"}, true, false},
+		{"type mismatch", WatchFilter{Name: "*", Type: "counter"}, &metrics.Metrics{ID: "Alloc", MType: "gauge"}, false, false},
+		{"invalid glob", WatchFilter{Name: "[a"}, nil, false, true},
+		{"invalid type", WatchFilter{Type: "histogram"}, nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filter.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tt.filter.Match(tt.metric))
+		})
+	}
+}
+
+func TestWatchableStorage_Events(t *testing.T) {
+	w := NewWatchableStorage(NewMemStorageWithKeyMode(KeyModeStrict), 0)
+	defer w.Close()
+	ctx := context.Background()
+
+	all, err := w.Watch(ctx, WatchFilter{})
+	require.NoError(t, err)
+	counters, err := w.Watch(ctx, WatchFilter{Type: "counter"})
+	require.NoError(t, err)
+	_, err = w.Watch(ctx, WatchFilter{Name: "[a"})
+	assert.Error(t, err)
+
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)}))
+	require.NoError(t, w.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "C", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "G", MType: "gauge", Value: float64Ptr(2)},
+		{ID: "C", MType: "counter", Delta: int64Ptr(2)},
+	}))
+	// unchanged and rejected metrics emit no events
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(2)}))
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(0)}))
+	assert.ErrorIs(t, w.Update(ctx, &metrics.Metrics{ID: "G", MType: "counter", Delta: int64Ptr(1)}), ErrTypeMismatch)
+	assert.ErrorIs(t, w.UpdateMetrics(ctx, []*metrics.Metrics{nil}), ErrInvalidMetric)
+
+	counterEvent := ChangeEvent{
+		Key: "counter:C",
+		New: &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(3)},
+	}
+	assert.Equal(t, []ChangeEvent{
+		{Key: "gauge:G", New: &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)}},
+		counterEvent,
+		{
+			Key: "gauge:G",
+			Old: &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)},
+			New: &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(2)},
+		},
+	}, receive(all))
+	assert.Equal(t, []ChangeEvent{counterEvent}, receive(counters))
+}
+
+func TestWatchableStorage_Drops(t *testing.T) {
+	w := NewWatchableStorage(NewMemStorage(), 2)
+	defer w.Close()
+	ctx := context.Background()
+
+	slow, err := w.Watch(ctx, WatchFilter{})
+	require.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+	}
+
+	events := receive(slow)
+	require.Len(t, events, 2)
+	assert.Equal(t, int64(2), *events[1].New.Delta)
+	assert.Equal(t, int64(3), slow.Dropped())
+	assert.Equal(t, []*metrics.Metrics{
+		{ID: "WatchSubscribers", MType: "gauge", Value: float64Ptr(1)},
+		{ID: "WatchDropped", MType: "counter", Delta: int64Ptr(3)},
+	}, w.SelfMetrics())
+}
+
+func TestWatchableStorage_Unsubscribe(t *testing.T) {
+	w := NewWatchableStorage(NewMemStorage(), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancelled, err := w.Watch(ctx, WatchFilter{})
+	require.NoError(t, err)
+	closed, err := w.Watch(context.Background(), WatchFilter{})
+	require.NoError(t, err)
+
+	cancel()
+	_, ok := <-cancelled.Events()
+	assert.False(t, ok)
+
+	require.NoError(t, w.Update(context.Background(), &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)}))
+	require.NoError(t, w.Close())
+	assert.Len(t, receive(closed), 1)
+	_, ok = <-closed.Events()
+	assert.False(t, ok)
+
+	_, err = w.Watch(context.Background(), WatchFilter{})
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
+
+func TestWatchableStorage_Concurrent(t *testing.T) {
+	w := NewWatchableStorage(NewShardedMemStorage(4, KeyModeTyped), 10000)
+	defer w.Close()
+	ctx := context.Background()
+
+	sub, err := w.Watch(ctx, WatchFilter{Name: "C"})
+	require.NoError(t, err)
+	var testWG sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		testWG.Add(1)
+		go func() {
+			defer testWG.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+			}
+		}()
+	}
+	testWG.Wait()
+
+	// the events of the serialized writes chain from one value to the next
+	events := receive(sub)
+	require.Len(t, events, 500)
+	for i, event := range events {
+		assert.Equal(t, int64(i+1), *event.New.Delta)
+		if i > 0 {
+			assert.Equal(t, event.Old, events[i-1].New)
+		}
+	}
+}
+
+// slowStorage is a MemStorage whose writes take a while, so they are in progress
+// when a subscription starts.
+type slowStorage struct {
+	*MemStorage
+}
+
+func (s slowStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	time.Sleep(time.Millisecond)
+	return s.MemStorage.Update(ctx, metric)
+}
+
+func TestWatchableStorage_WatchDuringWrites(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		w := NewWatchableStorage(slowStorage{NewMemStorage()}, 100000)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var writersWG sync.WaitGroup
+		for writer := 0; writer < 8; writer++ {
+			writersWG.Add(1)
+			go func(writer int) {
+				defer writersWG.Done()
+				for j := 0; ctx.Err() == nil; j++ {
+					id := fmt.Sprintf("G%d-%d", writer, j)
+					assert.NoError(t, w.Update(context.Background(), &metrics.Metrics{ID: id, MType: "gauge", Value: float64Ptr(1)}))
+				}
+			}(writer)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		// every metric is in the snapshot read after Watch or in an event
+		sub, err := w.Watch(context.Background(), WatchFilter{})
+		require.NoError(t, err)
+		seen, err := w.GetAllMetrics(context.Background())
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+		writersWG.Wait()
+
+		for _, event := range receive(sub) {
+			seen[event.Key] = event.New
+		}
+		stored, err := w.GetAllMetrics(context.Background())
+		require.NoError(t, err)
+		for key := range stored {
+			assert.Contains(t, seen, key)
+		}
+		require.NoError(t, w.Close())
+	}
+}
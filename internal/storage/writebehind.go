@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+const (
+	// defaultWriteBehindSize is the number of buffered metrics that triggers a flush.
+	defaultWriteBehindSize = 1000
+	// writeBehindLimitFactor is the default limit of the buffered metrics as a multiple
+	// of the number of buffered metrics that triggers a flush.
+	writeBehindLimitFactor = 100
+	// writeBehindFlushTimeout bounds the periodic flushes and the flush on Close.
+	writeBehindFlushTimeout = 10 * time.Second
+)
+
+// WriteBehindStorage buffers the writes to a backend in memory and coalesces them per
+// metric: the deltas of a counter are summed and the last value of a gauge wins.
+// The buffer is flushed to the backend every interval, when it holds maxPending
+// metrics and on SaveMetrics and Close. Reads see the buffered writes; a read of a
+// metric being flushed waits until the flush ends, since the backend may apply it
+// at any time before.
+//
+// While the backend is unavailable the writes stay buffered, and the writes of new
+// metrics are refused with ErrUnavailable once maxBuffered metrics are buffered.
+//
+// In the strict key mode a name is checked against the buffer and the backend when
+// it is first buffered, so concurrent first writes of both types may still reach the
+// backend, which rejects one of them during the flush.
+type WriteBehindStorage struct {
+	backend     Storage
+	keyMode     KeyMode
+	maxPending  int
+	maxBuffered int
+
+	// mu guards pending, the writes received since the last flush, flushing, the
+	// writes being flushed, flushDone, which is closed when the flush ends, and
+	// flushGen, which counts the starts and ends of the flushes, so a read can tell
+	// whether a flush changed the backend while it read it.
+	mu        sync.Mutex
+	pending   map[string]*metrics.Metrics
+	flushing  map[string]*metrics.Metrics
+	flushDone chan struct{}
+	flushGen  uint64
+	// saveMu serializes the flushes.
+	saveMu sync.Mutex
+
+	full      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWriteBehindStorage wraps the backend with a write buffer flushed every interval or
+// when it holds maxPending metrics, zero means defaultWriteBehindSize. The buffer holds
+// at most maxBuffered metrics, zero means writeBehindLimitFactor times maxPending.
+func NewWriteBehindStorage(backend Storage, interval time.Duration, maxPending, maxBuffered int, keyMode KeyMode) *WriteBehindStorage {
+	if maxPending <= 0 {
+		maxPending = defaultWriteBehindSize
+	}
+	if maxBuffered <= 0 {
+		maxBuffered = writeBehindLimitFactor * maxPending
+	}
+	w := &WriteBehindStorage{
+		backend:     backend,
+		keyMode:     keyMode,
+		maxPending:  maxPending,
+		maxBuffered: maxBuffered,
+		pending:     make(map[string]*metrics.Metrics),
+		full:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go w.run(interval)
+	return w
+}
+
+// run flushes the buffer every interval and when it is full until Close.
+func (w *WriteBehindStorage) run(interval time.Duration) {
+	defer close(w.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.full:
+		}
+		if err := w.flushWithTimeout(); err != nil {
+			logger.Sugar.Errorf("error flushing buffered metrics: %v", err)
+		}
+	}
+}
+
+// flushWithTimeout flushes the buffer within writeBehindFlushTimeout.
+func (w *WriteBehindStorage) flushWithTimeout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeBehindFlushTimeout)
+	defer cancel()
+	return w.flush(ctx)
+}
+
+// buffered returns the buffered writes of the metric, pending first. The caller must hold mu.
+func (w *WriteBehindStorage) buffered(key string) []*metrics.Metrics {
+	var writes []*metrics.Metrics
+	if metric, ok := w.pending[key]; ok {
+		writes = append(writes, metric)
+	}
+	if metric, ok := w.flushing[key]; ok {
+		writes = append(writes, metric)
+	}
+	return writes
+}
+
+// conflict returns ErrTypeMismatch if the key mode is strict and the name is buffered
+// or stored as a metric of another type.
+func (w *WriteBehindStorage) conflict(ctx context.Context, metricName, metricType string) error {
+	if w.keyMode != KeyModeStrict {
+		return nil
+	}
+	w.mu.Lock()
+	known := len(w.buffered(MetricKey(metricType, metricName))) > 0
+	conflicting := len(w.buffered(MetricKey(otherType(metricType), metricName))) > 0
+	w.mu.Unlock()
+	if known {
+		return nil
+	}
+	if !conflicting {
+		_, err := w.backend.Get(ctx, metricName, otherType(metricType))
+		switch {
+		case err == nil:
+			conflicting = true
+		case !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrTypeMismatch):
+			return err
+		}
+	}
+	if conflicting {
+		return typeMismatch(metricName, metricType)
+	}
+	return nil
+}
+
+// add coalesces the valid metrics into the pending writes and triggers a flush if the
+// buffer is full. It adds none of them and returns ErrUnavailable if the new metrics
+// would exceed the limit of the buffer.
+func (w *WriteBehindStorage) add(batchOfMetrics ...*metrics.Metrics) error {
+	w.mu.Lock()
+	added := make(map[string]struct{})
+	for _, metric := range batchOfMetrics {
+		if key := MetricKey(metric.MType, metric.ID); w.pending[key] == nil {
+			added[key] = struct{}{}
+		}
+	}
+	if len(added) > 0 && len(w.pending)+len(w.flushing)+len(added) > w.maxBuffered {
+		w.mu.Unlock()
+		return fmt.Errorf("%w: the write-behind buffer of %d metrics is full", ErrUnavailable, w.maxBuffered)
+	}
+	for _, metric := range batchOfMetrics {
+		key := MetricKey(metric.MType, metric.ID)
+		old, ok := w.pending[key]
+		switch {
+		case !ok:
+			w.pending[key] = copyMetric(metric)
+		case metric.MType == "counter":
+			delta := *old.Delta + *metric.Delta
+			old.Delta = &delta
+		default:
+			value := *metric.Value
+			old.Value = &value
+		}
+	}
+	full := len(w.pending) >= w.maxPending
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (w *WriteBehindStorage) Update(ctx context.Context, metric *metrics.Metrics) error {
+	if err := ValidateMetric(metric); err != nil {
+		return err
+	}
+	if err := w.conflict(ctx, metric.ID, metric.MType); err != nil {
+		return err
+	}
+	return w.add(metric)
+}
+
+// UpdateMetrics buffers every valid metric of the batch and returns the joined
+// errors of the metrics it could not buffer.
+func (w *WriteBehindStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	var errs []error
+	for _, metric := range batchOfMetrics {
+		if err := w.Update(ctx, metric); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// UpdateMetricsAtomic buffers every metric of the batch or none of them. The batch is
+// flushed with the other buffered writes, so in the strict key mode the backend may
+// still reject a part of it if both types of a name are first written concurrently.
+func (w *WriteBehindStorage) UpdateMetricsAtomic(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if err := validateBatch(batchOfMetrics, w.keyMode); err != nil {
+		return err
+	}
+	var conflicts []error
+	for _, metric := range batchOfMetrics {
+		err := w.conflict(ctx, metric.ID, metric.MType)
+		if errors.Is(err, ErrTypeMismatch) {
+			conflicts = append(conflicts, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(conflicts) > 0 {
+		return errors.Join(conflicts...)
+	}
+	return w.add(batchOfMetrics...)
+}
+
+// overlay applies the buffered writes to the stored metric, which may be nil.
+func overlay(stored *metrics.Metrics, writes []*metrics.Metrics) *metrics.Metrics {
+	if len(writes) == 0 {
+		return stored
+	}
+	result := *writes[0]
+	if result.MType == "gauge" {
+		// the first write is the newest
+		value := *result.Value
+		result.Value = &value
+		return &result
+	}
+	delta := int64(0)
+	if stored != nil {
+		delta = *stored.Delta
+	}
+	for _, write := range writes {
+		delta += *write.Delta
+	}
+	result.Delta = &delta
+	return &result
+}
+
+// waitFlush waits until the flush ends. It returns ErrUnavailable if the context is
+// done first.
+func waitFlush(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrUnavailable, ctx.Err())
+	}
+}
+
+func (w *WriteBehindStorage) Get(ctx context.Context, metricName string, metricType string) (*metrics.Metrics, error) {
+	if err := validateType(metricType); err != nil {
+		return nil, err
+	}
+	key := MetricKey(metricType, metricName)
+	for {
+		w.mu.Lock()
+		gen, done := w.flushGen, w.flushDone
+		_, flushing := w.flushing[key]
+		w.mu.Unlock()
+		if flushing {
+			if err := waitFlush(ctx, done); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		stored, err := w.backend.Get(ctx, metricName, metricType)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		w.mu.Lock()
+		if w.flushGen != gen {
+			// a flush started or ended during the read, which may have seen its writes
+			w.mu.Unlock()
+			continue
+		}
+		writes := w.buffered(key)
+		conflicting := len(w.buffered(MetricKey(otherType(metricType), metricName))) > 0
+		metric := overlay(stored, writes)
+		w.mu.Unlock()
+
+		if metric == nil {
+			if w.keyMode == KeyModeStrict && conflicting {
+				return nil, typeMismatch(metricName, metricType)
+			}
+			return nil, err
+		}
+		return metric, nil
+	}
+}
+
+// GetAllMetrics waits until the flush in progress ends, since it may change any of
+// the stored metrics.
+func (w *WriteBehindStorage) GetAllMetrics(ctx context.Context) (map[string]*metrics.Metrics, error) {
+	for {
+		w.mu.Lock()
+		gen, done := w.flushGen, w.flushDone
+		w.mu.Unlock()
+		if done != nil {
+			if err := waitFlush(ctx, done); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		allMetrics, err := w.backend.GetAllMetrics(ctx)
+		if err != nil {
+			return nil, err
+		}
+		w.mu.Lock()
+		if w.flushGen != gen {
+			w.mu.Unlock()
+			continue
+		}
+		for key := range w.pending {
+			allMetrics[key] = overlay(allMetrics[key], w.buffered(key))
+		}
+		w.mu.Unlock()
+		return allMetrics, nil
+	}
+}
+
+// flush writes the pending metrics to the backend. If the backend is unavailable,
+// they are merged back into the buffer and retried on the next flush, so the backend
+// must not apply a batch it fails with ErrUnavailable. If the failure also wraps
+// ErrOutcomeUnknown, the batch may have been applied, so only the gauges are retried
+// and the deltas of the counters are logged and dropped rather than counted twice.
+// Metrics the backend rejects are dropped, the ones it journals are flushed.
+func (w *WriteBehindStorage) flush(ctx context.Context) error {
+	w.saveMu.Lock()
+	defer w.saveMu.Unlock()
+
+	w.mu.Lock()
+	if len(w.pending) == 0 {
+		w.mu.Unlock()
+		return nil
+	}
+	w.flushing, w.pending = w.pending, make(map[string]*metrics.Metrics)
+	w.flushDone = make(chan struct{})
+	w.flushGen++
+	w.mu.Unlock()
+
+	batch := make([]*metrics.Metrics, 0, len(w.flushing))
+	for _, key := range sortedKeys(w.flushing) {
+		batch = append(batch, w.flushing[key])
+	}
+	err := w.backend.UpdateMetrics(ctx, batch)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	flushed := w.flushing
+	w.flushing = nil
+	close(w.flushDone)
+	w.flushDone = nil
+	w.flushGen++
+	if !errors.Is(err, ErrUnavailable) {
+		if err != nil && !errors.Is(err, ErrJournaled) {
+			logger.Sugar.Errorf("dropped buffered metrics rejected by the storage: %v", err)
+		}
+		return nil
+	}
+	outcomeUnknown := errors.Is(err, ErrOutcomeUnknown)
+	for key, metric := range flushed {
+		if outcomeUnknown && metric.MType == "counter" {
+			logger.Sugar.Errorf("dropped delta %d of counter %s that may have been applied", *metric.Delta, metric.ID)
+			continue
+		}
+		if newer, ok := w.pending[key]; ok {
+			w.pending[key] = overlay(metric, []*metrics.Metrics{newer})
+		} else {
+			w.pending[key] = metric
+		}
+	}
+	return err
+}
+
+// SaveMetrics flushes the buffer and saves the backend.
+func (w *WriteBehindStorage) SaveMetrics(ctx context.Context) error {
+	if err := w.flush(ctx); err != nil {
+		return err
+	}
+	return w.backend.SaveMetrics(ctx)
+}
+
+func (w *WriteBehindStorage) Ping(ctx context.Context) error {
+	return w.backend.Ping(ctx)
+}
+
+// SelfMetrics returns the number of buffered metrics and the metrics of the backend.
+func (w *WriteBehindStorage) SelfMetrics() []*metrics.Metrics {
+	w.mu.Lock()
+	pending := metrics.NewGauge("WriteBehindPending", float64(len(w.pending)))
+	w.mu.Unlock()
+
+	selfMetrics := []*metrics.Metrics{&pending}
+	if source, ok := w.backend.(interface{ SelfMetrics() []*metrics.Metrics }); ok {
+		selfMetrics = append(selfMetrics, source.SelfMetrics()...)
+	}
+	return selfMetrics
+}
+
+// Close stops the periodic flushes, flushes the buffer and closes the backend.
+func (w *WriteBehindStorage) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		<-w.stopped
+		flushErr := w.flushWithTimeout()
+		if flushErr != nil {
+			logger.Sugar.Errorf("error flushing buffered metrics when closing: %v", flushErr)
+		}
+		err = errors.Join(flushErr, w.backend.Close())
+	})
+	return err
+}
@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/evgfitil/go-metrics-server.git/internal/logger"
+	"github.com/evgfitil/go-metrics-server.git/internal/metrics"
+)
+
+// flakyStorage is a MemStorage that counts the batches written to it and rejects
+// them as a whole while it is down. While it is ambiguous, it applies the batches
+// and fails them with ErrOutcomeUnknown. A non-nil gate holds the batches until it
+// is closed.
+type flakyStorage struct {
+	*MemStorage
+	down      atomic.Bool
+	ambiguous atomic.Bool
+	batches   atomic.Int64
+	gate      chan struct{}
+}
+
+func (f *flakyStorage) UpdateMetrics(ctx context.Context, batchOfMetrics []*metrics.Metrics) error {
+	if f.gate != nil {
+		<-f.gate
+	}
+	if f.down.Load() {
+		return ErrUnavailable
+	}
+	f.batches.Add(1)
+	err := f.MemStorage.UpdateMetrics(ctx, batchOfMetrics)
+	if f.ambiguous.Load() {
+		return errors.Join(err, fmt.Errorf("%w: %w", ErrUnavailable, ErrOutcomeUnknown))
+	}
+	return err
+}
+
+func newTestWriteBehind(t *testing.T, maxPending int, keyMode KeyMode) (*WriteBehindStorage, *flakyStorage) {
+	logger.InitLogger()
+	backend := &flakyStorage{MemStorage: NewMemStorageWithKeyMode(keyMode)}
+	w := NewWriteBehindStorage(backend, time.Hour, maxPending, 0, keyMode)
+	t.Cleanup(func() { w.Close() })
+	return w, backend
+}
+
+func TestWriteBehindStorage_Coalescing(t *testing.T) {
+	w, backend := newTestWriteBehind(t, 0, KeyModeTyped)
+	ctx := context.Background()
+	require.NoError(t, backend.MemStorage.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(10)}))
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+		require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(float64(i))}))
+	}
+
+	// reads combine the backend with the buffer
+	counter, err := w.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), *counter.Delta)
+	gauge, err := w.Get(ctx, "G", "gauge")
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, *gauge.Value)
+	allMetrics, err := w.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*metrics.Metrics{
+		"counter:C": {ID: "C", MType: "counter", Delta: int64Ptr(15)},
+		"gauge:G":   {ID: "G", MType: "gauge", Value: float64Ptr(4)},
+	}, allMetrics)
+	_, err = backend.MemStorage.Get(ctx, "G", "gauge")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// the writes reach the backend as one coalesced batch
+	require.NoError(t, w.SaveMetrics(ctx))
+	assert.Equal(t, int64(1), backend.batches.Load())
+	stored, err := backend.MemStorage.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, allMetrics, stored)
+
+	counter, err = w.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), *counter.Delta)
+}
+
+func TestWriteBehindStorage_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyMode KeyMode
+		metric  *metrics.Metrics
+		wantErr error
+	}{
+		{name: "counter without delta", metric: &metrics.Metrics{ID: "C", MType: "counter"}, wantErr: ErrInvalidMetric},
+		{name: "unsupported type", metric: &metrics.Metrics{ID: "H", MType: "histogram", Value: float64Ptr(1)}, wantErr: ErrInvalidMetric},
+		{
+			name:    "name buffered as another type",
+			keyMode: KeyModeStrict,
+			metric:  &metrics.Metrics{ID: "buffered", MType: "gauge", Value: float64Ptr(1)},
+			wantErr: ErrTypeMismatch,
+		},
+		{
+			name:    "name stored as another type",
+			keyMode: KeyModeStrict,
+			metric:  &metrics.Metrics{ID: "stored", MType: "gauge", Value: float64Ptr(1)},
+			wantErr: ErrTypeMismatch,
+		},
+		{
+			name:   "both types in typed mode",
+			metric: &metrics.Metrics{ID: "stored", MType: "gauge", Value: float64Ptr(1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, backend := newTestWriteBehind(t, 0, tt.keyMode)
+			ctx := context.Background()
+			require.NoError(t, backend.MemStorage.Update(ctx, &metrics.Metrics{ID: "stored", MType: "counter", Delta: int64Ptr(1)}))
+			require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "buffered", MType: "counter", Delta: int64Ptr(1)}))
+
+			err := w.Update(ctx, tt.metric)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+			if tt.keyMode == KeyModeStrict {
+				_, err = w.Get(ctx, tt.metric.ID, tt.metric.MType)
+				assert.ErrorIs(t, err, ErrTypeMismatch)
+			}
+		})
+	}
+}
+
+func TestWriteBehindStorage_FlushOnSize(t *testing.T) {
+	w, backend := newTestWriteBehind(t, 3, KeyModeTyped)
+	ctx := context.Background()
+
+	require.NoError(t, w.UpdateMetrics(ctx, []*metrics.Metrics{
+		{ID: "A", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "B", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "C", MType: "counter", Delta: int64Ptr(1)},
+	}))
+	assert.Eventually(t, func() bool {
+		return backend.batches.Load() == 1
+	}, time.Second, time.Millisecond)
+	allMetrics, err := backend.MemStorage.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, allMetrics, 3)
+}
+
+func TestWriteBehindStorage_FlushOnInterval(t *testing.T) {
+	logger.InitLogger()
+	backend := &flakyStorage{MemStorage: NewMemStorage()}
+	w := NewWriteBehindStorage(backend, 10*time.Millisecond, 0, 0, KeyModeTyped)
+	defer w.Close()
+
+	require.NoError(t, w.Update(context.Background(), &metrics.Metrics{ID: "A", MType: "counter", Delta: int64Ptr(1)}))
+	assert.Eventually(t, func() bool {
+		_, err := backend.MemStorage.Get(context.Background(), "A", "counter")
+		return err == nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestWriteBehindStorage_Unavailable(t *testing.T) {
+	w, backend := newTestWriteBehind(t, 0, KeyModeTyped)
+	ctx := context.Background()
+
+	backend.down.Store(true)
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)}))
+	assert.ErrorIs(t, w.SaveMetrics(ctx), ErrUnavailable)
+
+	// the writes stay buffered and coalesce with the later ones
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(2)}))
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(2)}))
+	counter, err := w.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *counter.Delta)
+
+	backend.down.Store(false)
+	require.NoError(t, w.Close())
+	counter, err = backend.MemStorage.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *counter.Delta)
+	gauge, err := backend.MemStorage.Get(ctx, "G", "gauge")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *gauge.Value)
+}
+
+func TestWriteBehindStorage_Limit(t *testing.T) {
+	logger.InitLogger()
+	backend := &flakyStorage{MemStorage: NewMemStorage()}
+	w := NewWriteBehindStorage(backend, time.Hour, 10, 2, KeyModeTyped)
+	defer w.Close()
+	ctx := context.Background()
+
+	backend.down.Store(true)
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)}))
+	assert.ErrorIs(t, w.SaveMetrics(ctx), ErrUnavailable)
+
+	// the buffer refuses new metrics and still coalesces the buffered ones
+	assert.ErrorIs(t, w.Update(ctx, &metrics.Metrics{ID: "A", MType: "gauge", Value: float64Ptr(1)}), ErrUnavailable)
+	assert.ErrorIs(t, w.UpdateMetricsAtomic(ctx, []*metrics.Metrics{
+		{ID: "C", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "A", MType: "gauge", Value: float64Ptr(1)},
+	}), ErrUnavailable)
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(2)}))
+	counter, err := w.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *counter.Delta)
+
+	// the flushed metrics make room again
+	backend.down.Store(false)
+	require.NoError(t, w.SaveMetrics(ctx))
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "A", MType: "gauge", Value: float64Ptr(1)}))
+}
+
+func TestWriteBehindStorage_OutcomeUnknown(t *testing.T) {
+	w, backend := newTestWriteBehind(t, 0, KeyModeTyped)
+	ctx := context.Background()
+
+	// the counters of a batch that may have been applied are not flushed again
+	backend.ambiguous.Store(true)
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)}))
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "G", MType: "gauge", Value: float64Ptr(1)}))
+	assert.ErrorIs(t, w.SaveMetrics(ctx), ErrOutcomeUnknown)
+	w.mu.Lock()
+	assert.Len(t, w.pending, 1)
+	w.mu.Unlock()
+
+	backend.ambiguous.Store(false)
+	require.NoError(t, w.Close())
+	counter, err := backend.MemStorage.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *counter.Delta)
+	gauge, err := backend.MemStorage.Get(ctx, "G", "gauge")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *gauge.Value)
+}
+
+func TestWriteBehindStorage_ReadDuringFlush(t *testing.T) {
+	w, backend := newTestWriteBehind(t, 0, KeyModeTyped)
+	backend.gate = make(chan struct{})
+	ctx := context.Background()
+
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "A", MType: "counter", Delta: int64Ptr(1)}))
+	flushed := make(chan error)
+	go func() { flushed <- w.SaveMetrics(ctx) }()
+	assert.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.flushing != nil
+	}, time.Second, time.Millisecond)
+
+	// a metric that is not being flushed is read without waiting
+	require.NoError(t, w.Update(ctx, &metrics.Metrics{ID: "B", MType: "counter", Delta: int64Ptr(2)}))
+	counter, err := w.Get(ctx, "B", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *counter.Delta)
+
+	// a metric being flushed is read once the flush ends
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = w.Get(timeoutCtx, "A", "counter")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	_, err = w.GetAllMetrics(timeoutCtx)
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	close(backend.gate)
+	require.NoError(t, <-flushed)
+	counter, err = w.Get(ctx, "A", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *counter.Delta)
+}
+
+func TestWriteBehindStorage_Concurrent(t *testing.T) {
+	w, backend := newTestWriteBehind(t, 10, KeyModeTyped)
+	ctx := context.Background()
+
+	var testWG sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		testWG.Add(1)
+		go func() {
+			defer testWG.Done()
+			for j := 0; j < 100; j++ {
+				w.Update(ctx, &metrics.Metrics{ID: "C", MType: "counter", Delta: int64Ptr(1)})
+				w.Update(ctx, &metrics.Metrics{ID: "G" + string(rune('a'+j%20)), MType: "gauge", Value: float64Ptr(1)})
+				if j%10 == 0 {
+					counter, err := w.Get(ctx, "C", "counter")
+					if assert.NoError(t, err) {
+						assert.Positive(t, *counter.Delta)
+						assert.LessOrEqual(t, *counter.Delta, int64(2000))
+					}
+				}
+			}
+		}()
+	}
+	testWG.Wait()
+
+	require.NoError(t, w.Close())
+	counter, err := backend.MemStorage.Get(ctx, "C", "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2000), *counter.Delta)
+}